@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"own-paynet/api/response"
 	"own-paynet/services"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,7 +22,9 @@ func NewAPIKeyHandler(apiKeyService *services.APIKeyService) *APIKeyHandler {
 }
 
 type GenerateAPIKeyRequest struct {
-	Description string `json:"description" binding:"required"`
+	Description string     `json:"description" binding:"required"`
+	Scopes      []string   `json:"scopes"`     // Defaults to every scope
+	ExpiresAt   *time.Time `json:"expires_at"` // RFC 3339, the key never expires if omitted
 }
 
 func (h *APIKeyHandler) GenerateAPIKey(c *gin.Context) {
@@ -31,8 +35,12 @@ func (h *APIKeyHandler) GenerateAPIKey(c *gin.Context) {
 	}
 
 	userID := c.GetUint("user_id")
-	apiKey, err := h.apiKeyService.GenerateAPIKey(userID, req.Description)
+	apiKey, err := h.apiKeyService.GenerateAPIKey(userID, req.Description, req.Scopes, req.ExpiresAt)
 	if err != nil {
+		if errors.Is(err, services.ErrInvalidScope) || errors.Is(err, services.ErrInvalidKeyExpiry) {
+			response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
 		response.ErrorResponse(c, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -68,6 +76,112 @@ func (h *APIKeyHandler) SetDefaultKey(c *gin.Context) {
 	response.SuccessResponse(c, http.StatusOK, "Default API key updated successfully", nil)
 }
 
+// RotateAPIKey issues a new secret for a key. The previous secret keeps
+// working for a grace period so integrations can switch over.
+func (h *APIKeyHandler) RotateAPIKey(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	apiKeyID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, "invalid API key ID")
+		return
+	}
+
+	apiKey, err := h.apiKeyService.RotateAPIKey(userID, uint(apiKeyID))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrAPIKeyNotFound):
+			response.ErrorResponse(c, http.StatusNotFound, err.Error())
+		case errors.Is(err, services.ErrAPIKeyDisabled):
+			response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+		default:
+			response.ErrorResponse(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "API key rotated successfully", apiKey)
+}
+
+type SetAllowedIPsRequest struct {
+	CIDRs []string `json:"cidrs"` // Empty allows any address
+}
+
+type AllowedIPRequest struct {
+	CIDR string `json:"cidr" binding:"required"`
+}
+
+// GetAllowedIPs lists the networks an API key may be used from
+func (h *APIKeyHandler) GetAllowedIPs(c *gin.Context) {
+	h.handleAllowedIPs(c, "API key allowlist retrieved successfully", func(userID, apiKeyID uint) ([]string, error) {
+		return h.apiKeyService.GetAllowedCIDRs(userID, apiKeyID)
+	})
+}
+
+// SetAllowedIPs replaces the networks an API key may be used from
+func (h *APIKeyHandler) SetAllowedIPs(c *gin.Context) {
+	var req SetAllowedIPsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.handleAllowedIPs(c, "API key allowlist updated successfully", func(userID, apiKeyID uint) ([]string, error) {
+		return h.apiKeyService.SetAllowedCIDRs(userID, apiKeyID, req.CIDRs)
+	})
+}
+
+// AddAllowedIP adds a network to an API key's allowlist
+func (h *APIKeyHandler) AddAllowedIP(c *gin.Context) {
+	var req AllowedIPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.handleAllowedIPs(c, "IP range added to API key allowlist", func(userID, apiKeyID uint) ([]string, error) {
+		return h.apiKeyService.AddAllowedCIDR(userID, apiKeyID, req.CIDR)
+	})
+}
+
+// RemoveAllowedIP removes a network from an API key's allowlist
+func (h *APIKeyHandler) RemoveAllowedIP(c *gin.Context) {
+	var req AllowedIPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.handleAllowedIPs(c, "IP range removed from API key allowlist", func(userID, apiKeyID uint) ([]string, error) {
+		return h.apiKeyService.RemoveAllowedCIDR(userID, apiKeyID, req.CIDR)
+	})
+}
+
+func (h *APIKeyHandler) handleAllowedIPs(c *gin.Context, message string, action func(userID, apiKeyID uint) ([]string, error)) {
+	userID := c.GetUint("user_id")
+	apiKeyID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, "invalid API key ID")
+		return
+	}
+
+	cidrs, err := action(userID, uint(apiKeyID))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrAPIKeyNotFound):
+			response.ErrorResponse(c, http.StatusNotFound, err.Error())
+		case errors.Is(err, services.ErrInvalidCIDR):
+			response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+		default:
+			response.ErrorResponse(c, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if cidrs == nil {
+		cidrs = []string{}
+	}
+	response.SuccessResponse(c, http.StatusOK, message, gin.H{
+		"cidrs": cidrs,
+	})
+}
+
 func (h *APIKeyHandler) DeleteAPIKey(c *gin.Context) {
 	userID := c.GetUint("user_id")
 	apiKeyID, err := strconv.ParseUint(c.Param("id"), 10, 32)
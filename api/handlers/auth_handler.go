@@ -1,42 +1,29 @@
 package handlers
 
 import (
-	"encoding/json"
+	"errors"
 	"net/http"
-	"os"
 	response "own-paynet/api/response"
+	"own-paynet/models"
 	"own-paynet/services"
+	"own-paynet/services/bitcoin"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
 type AuthHandler struct {
-	authService       *services.AuthService
-	googleOauthConfig *oauth2.Config
+	authService *services.AuthService
 }
 
 func NewAuthHandler(authService *services.AuthService) *AuthHandler {
-	googleOauthConfig := &oauth2.Config{
-		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
-		RedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
-		Scopes: []string{
-			"https://www.googleapis.com/auth/userinfo.email",
-			"https://www.googleapis.com/auth/userinfo.profile",
-		},
-		Endpoint: google.Endpoint,
-	}
-	return &AuthHandler{
-		authService:       authService,
-		googleOauthConfig: googleOauthConfig,
-	}
+	return &AuthHandler{authService: authService}
 }
 
 type SignupRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required,min=6"`
+	// Account xpub, ypub or zpub the default payout wallet is created from
+	ExtendedPublicKey string `json:"extended_public_key"`
 }
 
 func (h *AuthHandler) Signup(c *gin.Context) {
@@ -46,12 +33,16 @@ func (h *AuthHandler) Signup(c *gin.Context) {
 		return
 	}
 
-	if err := h.authService.Signup(req.Email, req.Password); err != nil {
+	if err := h.authService.Signup(req.Email, req.Password, req.ExtendedPublicKey); err != nil {
 		// Check for specific error types and return appropriate status codes
 		if err.Error() == "an account with this email already exists" {
 			response.ErrorResponse(c, http.StatusConflict, "This email address is already registered. Please use a different email or try logging in.")
 			return
 		}
+		if errors.Is(err, bitcoin.ErrInvalidExtendedKey) || errors.Is(err, bitcoin.ErrExtendedKeyNetwork) {
+			response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
 		// For other errors, use a more specific message with 500 status
 		response.ErrorResponse(c, http.StatusInternalServerError, "Unable to create account at this time. Please try again later.")
 		return
@@ -61,8 +52,21 @@ func (h *AuthHandler) Signup(c *gin.Context) {
 }
 
 type SigninRequest struct {
-	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required"`
+	Email      string `json:"email" binding:"required,email"`
+	Password   string `json:"password" binding:"required"`
+	DeviceName string `json:"device_name"`
+}
+
+// sessionMetadata collects the device details recorded on a new or refreshed session
+func sessionMetadata(c *gin.Context, deviceName string) services.SessionMetadata {
+	if deviceName == "" {
+		deviceName = c.GetHeader("X-Device-Name")
+	}
+	return services.SessionMetadata{
+		DeviceName: deviceName,
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+	}
 }
 
 func (h *AuthHandler) Signin(c *gin.Context) {
@@ -72,7 +76,7 @@ func (h *AuthHandler) Signin(c *gin.Context) {
 		return
 	}
 
-	token, user, err := h.authService.Signin(req.Email, req.Password)
+	result, user, err := h.authService.Signin(req.Email, req.Password, sessionMetadata(c, req.DeviceName))
 	if err != nil {
 		switch err.Error() {
 		case "user not found":
@@ -97,13 +101,98 @@ func (h *AuthHandler) Signin(c *gin.Context) {
 		return
 	}
 
+	respondSignin(c, "Login successful", result, user)
+}
+
+// respondSignin sends either the new session or, for accounts with 2FA enabled, the pending challenge
+func respondSignin(c *gin.Context, message string, result *services.SigninResult, user *models.User) {
+	if result.MFARequired {
+		response.SuccessResponse(c, http.StatusOK, "Two-factor authentication required. Please submit your verification code to complete sign in.", gin.H{
+			"mfa_required":    true,
+			"challenge_token": result.ChallengeToken,
+			"methods":         result.MFAMethods,
+		})
+		return
+	}
+
+	respondSession(c, message, result.Tokens, user)
+}
+
+// respondSession sends a newly created session to the client
+func respondSession(c *gin.Context, message string, tokens *services.TokenPair, user *models.User) {
 	user.Password = "" // Clear password for security reason
-	response.SuccessResponse(c, http.StatusOK, "Login successful", gin.H{
-		"token": token,
-		"user":  user,
+	response.SuccessResponse(c, http.StatusOK, message, gin.H{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_at":    tokens.ExpiresAt,
+		"session_id":    tokens.SessionID,
+		"user":          user,
 	})
 }
 
+type Signin2FARequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
+	DeviceName     string `json:"device_name"`
+}
+
+// Signin2FA completes a sign in for accounts with 2FA enabled
+func (h *AuthHandler) Signin2FA(c *gin.Context) {
+	var req Signin2FARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tokens, user, err := h.authService.VerifySignin2FA(req.ChallengeToken, req.Code, sessionMetadata(c, req.DeviceName))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidMFAChallenge):
+			response.ErrorResponse(c, http.StatusUnauthorized, "Your sign in attempt has expired. Please sign in again.")
+		case errors.Is(err, services.ErrTooManyMFAAttempts):
+			response.ErrorResponse(c, http.StatusTooManyRequests, "Too many incorrect codes. Please sign in again.")
+		case errors.Is(err, services.ErrInvalid2FACode):
+			response.ErrorResponse(c, http.StatusUnauthorized, "Invalid 2FA code")
+		case err.Error() == "OTP expired":
+			response.ErrorResponse(c, http.StatusUnauthorized, "Your verification code has expired. Please sign in again to receive a new one.")
+		default:
+			response.ErrorResponse(c, http.StatusInternalServerError, "Unable to complete sign in. Please try again later.")
+		}
+		return
+	}
+
+	respondSession(c, "Login successful", tokens, user)
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+	DeviceName   string `json:"device_name"`
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token pair
+func (h *AuthHandler) RefreshToken(c *gin.Context) {
+	var req RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tokens, err := h.authService.RefreshSession(req.RefreshToken, sessionMetadata(c, req.DeviceName))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrRefreshTokenReused):
+			response.ErrorResponse(c, http.StatusUnauthorized, "This refresh token has already been used. The session has been revoked for your security, please sign in again.")
+		case errors.Is(err, services.ErrInvalidRefreshToken):
+			response.ErrorResponse(c, http.StatusUnauthorized, "Invalid or expired refresh token")
+		default:
+			response.ErrorResponse(c, http.StatusInternalServerError, "Unable to refresh session. Please try again later.")
+		}
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Token refreshed successfully", tokens)
+}
+
 type ResetPasswordRequest struct {
 	Email       string `json:"email" binding:"required,email"`
 	NewPassword string `json:"new_password" binding:"required,min=6"`
@@ -196,7 +285,7 @@ func (h *AuthHandler) Logout(c *gin.Context) {
 		return
 	}
 
-	if err := h.authService.Logout(userID.(uint)); err != nil {
+	if err := h.authService.Logout(userID.(uint), c.GetString("session_id")); err != nil {
 		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to logout")
 		return
 	}
@@ -248,63 +337,3 @@ func (h *AuthHandler) ResendVerificationEmail(c *gin.Context) {
 
 	response.SuccessResponse(c, http.StatusOK, "Verification email sent successfully", nil)
 }
-
-type GoogleUserInfo struct {
-	ID            string `json:"id"`
-	Email         string `json:"email"`
-	VerifiedEmail bool   `json:"verified_email"`
-	Name          string `json:"name"`
-	GivenName     string `json:"given_name"`
-	FamilyName    string `json:"family_name"`
-	Picture       string `json:"picture"`
-	Locale        string `json:"locale"`
-}
-
-// GoogleLogin initiates the Google OAuth flow
-func (h *AuthHandler) GoogleLogin(c *gin.Context) {
-	url := h.googleOauthConfig.AuthCodeURL("state")
-	c.Redirect(http.StatusTemporaryRedirect, url)
-}
-
-// GoogleCallback handles the callback from Google OAuth
-func (h *AuthHandler) GoogleCallback(c *gin.Context) {
-	code := c.Query("code")
-	token, err := h.googleOauthConfig.Exchange(c, code)
-	if err != nil {
-		response.ErrorResponse(c, http.StatusBadRequest, "Failed to exchange token")
-		return
-	}
-
-	// Get user info from Google
-	client := h.googleOauthConfig.Client(c, token)
-	resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
-	if err != nil {
-		response.ErrorResponse(c, http.StatusBadRequest, "Failed to get user info")
-		return
-	}
-	defer resp.Body.Close()
-
-	var userInfo GoogleUserInfo
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		response.ErrorResponse(c, http.StatusBadRequest, "Failed to decode user info")
-		return
-	}
-
-	// Handle Google user authentication
-	jwtToken, user, err := h.authService.HandleGoogleUser(
-		userInfo.Email,
-		userInfo.Name,
-		userInfo.ID,
-		userInfo.Picture, // Google's picture field maps to our avatar field
-		userInfo.Locale,
-	)
-	if err != nil {
-		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to authenticate user")
-		return
-	}
-
-	response.SuccessResponse(c, http.StatusOK, "Successfully authenticated with Google", gin.H{
-		"token": jwtToken,
-		"user":  user,
-	})
-}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+
+	response "own-paynet/api/response"
+	"own-paynet/services"
+	"own-paynet/utils/qrcode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checkoutQRSize is the width and height of the checkout QR code in pixels
+const checkoutQRSize = 256
+
+// CheckoutHandler serves the public hosted checkout that payment URLs point to
+type CheckoutHandler struct {
+	paymentService *services.PaymentService
+}
+
+func NewCheckoutHandler(paymentService *services.PaymentService) *CheckoutHandler {
+	return &CheckoutHandler{paymentService: paymentService}
+}
+
+// ShowCheckout renders the checkout page of a payment
+func (h *CheckoutHandler) ShowCheckout(c *gin.Context) {
+	checkout, err := h.paymentService.GetCheckout(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, services.ErrPaymentNotFound) {
+			c.String(http.StatusNotFound, "Payment not found")
+			return
+		}
+		c.String(http.StatusInternalServerError, "Failed to load payment")
+		return
+	}
+
+	// The QR code is inlined so the page needs no further requests
+	var qrCode template.URL
+	if png, err := qrcode.PNG(checkout.PaymentURI, checkoutQRSize); err != nil {
+		log.Printf("checkout %s: %v", checkout.PaymentID, err)
+	} else {
+		qrCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.HTML(http.StatusOK, "checkout.html", gin.H{
+		"Checkout": checkout,
+		"QRCode":   qrCode,
+		// html/template only allows http(s) links unless told the URL is safe.
+		// The URI is built from our own address and amount.
+		"WalletURI": template.URL(checkout.PaymentURI),
+	})
+}
+
+// GetCheckoutStatus returns the live status the checkout page polls
+func (h *CheckoutHandler) GetCheckoutStatus(c *gin.Context) {
+	checkout, err := h.paymentService.GetCheckout(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, services.ErrPaymentNotFound) {
+			response.ErrorResponse(c, http.StatusNotFound, "Payment not found")
+			return
+		}
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to load payment")
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	response.SuccessResponse(c, http.StatusOK, "Payment status retrieved successfully", checkout)
+}
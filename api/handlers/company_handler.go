@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -40,6 +41,10 @@ func (h *CompanyHandler) UpdateCompany(c *gin.Context) {
 			response.ErrorResponse(c, http.StatusNotFound, "Company not found")
 			return
 		}
+		if errors.Is(err, services.ErrInvalidPaymentExpiry) {
+			response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
 		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to update company")
 		return
 	}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"net/http"
+
+	response "own-paynet/api/response"
+	"own-paynet/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JWKSHandler struct{}
+
+func NewJWKSHandler() *JWKSHandler {
+	return &JWKSHandler{}
+}
+
+// GetJWKS serves the public keys other services use to verify our tokens.
+// The key set is returned as a bare JWK Set document, as clients expect.
+func (h *JWKSHandler) GetJWKS(c *gin.Context) {
+	jwks, err := utils.JWKS()
+	if err != nil {
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to load signing keys")
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, jwks)
+}
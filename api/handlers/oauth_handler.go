@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	response "own-paynet/api/response"
+	"own-paynet/config"
+	"own-paynet/models"
+	"own-paynet/services"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// oauthStateCookie binds an OAuth flow to the browser that started it
+const oauthStateCookie = "oauth_state"
+
+type OAuthHandler struct {
+	oauthService  *services.OAuthService
+	secureCookies bool
+}
+
+func NewOAuthHandler(oauthService *services.OAuthService, cfg *config.Config) *OAuthHandler {
+	return &OAuthHandler{
+		oauthService:  oauthService,
+		secureCookies: strings.HasPrefix(cfg.BaseURL, "https://"),
+	}
+}
+
+// GetProviders lists the identity providers users can sign in with
+func (h *OAuthHandler) GetProviders(c *gin.Context) {
+	response.SuccessResponse(c, http.StatusOK, "Identity providers retrieved successfully", gin.H{
+		"providers": h.oauthService.Providers(),
+	})
+}
+
+// Login initiates the OAuth flow with the provider in the URL
+func (h *OAuthHandler) Login(c *gin.Context) {
+	url, err := h.startFlow(c, 0)
+	if err != nil {
+		h.respondStartError(c, err)
+		return
+	}
+	c.Redirect(http.StatusTemporaryRedirect, url)
+}
+
+// Link starts the OAuth flow for linking a provider to the authenticated account.
+// The client should send the user to the returned URL.
+func (h *OAuthHandler) Link(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		response.ErrorResponse(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	url, err := h.startFlow(c, userID.(uint))
+	if err != nil {
+		h.respondStartError(c, err)
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Continue to the provider to link your account", gin.H{
+		"auth_url": url,
+	})
+}
+
+// Unlink removes the provider in the URL from the authenticated account
+func (h *OAuthHandler) Unlink(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		response.ErrorResponse(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	if err := h.oauthService.UnlinkIdentity(userID.(uint), c.Param("provider")); err != nil {
+		switch {
+		case errors.Is(err, services.ErrIdentityNotLinked):
+			response.ErrorResponse(c, http.StatusNotFound, err.Error())
+		case errors.Is(err, services.ErrLastSigninMethod):
+			response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+		default:
+			response.ErrorResponse(c, http.StatusInternalServerError, "Failed to unlink account")
+		}
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Account unlinked successfully", nil)
+}
+
+// GetIdentities lists the provider accounts linked to the authenticated account
+func (h *OAuthHandler) GetIdentities(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		response.ErrorResponse(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	identities, err := h.oauthService.ListIdentities(userID.(uint))
+	if err != nil {
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to retrieve linked accounts")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Linked accounts retrieved successfully", identities)
+}
+
+// startFlow creates the state for a new OAuth flow, binds it to the browser
+// with a cookie and returns the consent URL
+func (h *OAuthHandler) startFlow(c *gin.Context, userID uint) (string, error) {
+	state, url, err := h.oauthService.StartFlow(c.Request.Context(), c.Param("provider"), userID)
+	if err != nil {
+		return "", err
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oauthStateCookie, state, 600, "/api/v1/auth", "", h.secureCookies, true)
+
+	return url, nil
+}
+
+func (h *OAuthHandler) respondStartError(c *gin.Context, err error) {
+	if errors.Is(err, services.ErrUnknownIdentityProvider) {
+		response.ErrorResponse(c, http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+	log.Printf("failed to start OAuth flow with %s: %v", c.Param("provider"), err)
+	response.ErrorResponse(c, http.StatusInternalServerError, "Unable to reach the identity provider. Please try again later.")
+}
+
+// Callback handles the redirect back from an identity provider
+func (h *OAuthHandler) Callback(c *gin.Context) {
+	if c.Query("error") != "" {
+		response.ErrorResponse(c, http.StatusBadRequest, "Sign in was cancelled or failed")
+		return
+	}
+
+	// The state must match the one issued to this browser and can only be used once
+	state := c.Query("state")
+	cookieState, _ := c.Cookie(oauthStateCookie)
+	c.SetCookie(oauthStateCookie, "", -1, "/api/v1/auth", "", h.secureCookies, true)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(cookieState)) != 1 {
+		response.ErrorResponse(c, http.StatusBadRequest, "Invalid OAuth state")
+		return
+	}
+
+	provider := c.Param("provider")
+	oauthState, profile, err := h.oauthService.CompleteFlow(c.Request.Context(), provider, state, c.Query("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidOAuthState):
+			response.ErrorResponse(c, http.StatusBadRequest, "Invalid or expired OAuth state. Please try again.")
+		case errors.Is(err, services.ErrUnknownIdentityProvider):
+			response.ErrorResponse(c, http.StatusNotFound, "Unknown identity provider")
+		default:
+			log.Printf("failed to complete OAuth flow with %s: %v", provider, err)
+			response.ErrorResponse(c, http.StatusBadRequest, "Failed to verify your identity with the provider")
+		}
+		return
+	}
+
+	if oauthState.Mode == models.OAuthModeLink {
+		userIdentity, err := h.oauthService.LinkIdentity(oauthState.UserID, provider, profile)
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrProviderAlreadyLinked), errors.Is(err, services.ErrIdentityAlreadyLinked):
+				response.ErrorResponse(c, http.StatusConflict, err.Error())
+			default:
+				response.ErrorResponse(c, http.StatusInternalServerError, "Failed to link account")
+			}
+			return
+		}
+		response.SuccessResponse(c, http.StatusOK, "Account linked successfully", userIdentity)
+		return
+	}
+
+	result, user, err := h.oauthService.SigninWithProvider(provider, profile, sessionMetadata(c, ""))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrOAuthAccountExists):
+			response.ErrorResponse(c, http.StatusConflict, "An account with this email already exists. Please sign in with your password and link this provider from your account settings.")
+		case errors.Is(err, services.ErrOAuthEmailNotVerified):
+			response.ErrorResponse(c, http.StatusForbidden, "Your email address is not verified with this provider")
+		default:
+			response.ErrorResponse(c, http.StatusInternalServerError, "Failed to authenticate user")
+		}
+		return
+	}
+
+	respondSignin(c, "Successfully authenticated", result, user)
+}
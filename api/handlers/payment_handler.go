@@ -1,35 +1,42 @@
 package handlers
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	response "own-paynet/api/response"
-	"own-paynet/config"
+	"own-paynet/models"
 	"own-paynet/services"
+	"own-paynet/services/bitcoin"
+	"own-paynet/utils/qrcode"
 
 	"github.com/gin-gonic/gin"
 )
 
 type PaymentHandler struct {
 	paymentService *services.PaymentService
-	webhookSecret  string
 }
 
-func NewPaymentHandler(paymentService *services.PaymentService, cfg *config.Config) *PaymentHandler {
+func NewPaymentHandler(paymentService *services.PaymentService) *PaymentHandler {
 	return &PaymentHandler{
 		paymentService: paymentService,
-		webhookSecret:  cfg.WebhookSecret,
 	}
 }
 
 type CreatePaymentRequest struct {
 	Amount         float64 `json:"amount" binding:"required,gt=0"`
 	MerchantWallet string  `json:"merchant_wallet" binding:"required"`
-	Currency       string  `json:"currency" binding:"required"`
+	// BTC, SATS, or a fiat currency such as USD that is converted at the current rate
+	Currency string `json:"currency" binding:"required"`
+	// Shown to payers in their wallet
+	Description string `json:"description"`
+	// Minutes until the payment expires, the merchant's default applies if omitted
+	ExpiresInMinutes int `json:"expires_in_minutes"`
 }
 
 func (h *PaymentHandler) CreatePayment(c *gin.Context) {
@@ -45,54 +52,256 @@ func (h *PaymentHandler) CreatePayment(c *gin.Context) {
 		return
 	}
 
-	payment, err := h.paymentService.CreatePayment(userID.(uint), req.Amount, req.MerchantWallet, req.Currency)
+	payment, err := h.paymentService.CreatePayment(c.Request.Context(), userID.(uint), req.Amount, req.MerchantWallet, req.Currency, req.Description, req.ExpiresInMinutes)
 	if err != nil {
+		if errors.Is(err, services.ErrUnsupportedCurrency) || errors.Is(err, services.ErrInvalidPaymentExpiry) ||
+			errors.Is(err, services.ErrPaymentDescriptionTooLong) || errors.Is(err, bitcoin.ErrInvalidAddress) ||
+			errors.Is(err, bitcoin.ErrAddressNetwork) {
+			response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if errors.Is(err, services.ErrAddressGapLimit) {
+			response.ErrorResponse(c, http.StatusConflict, err.Error())
+			return
+		}
+		if errors.Is(err, services.ErrExchangeRateUnavailable) {
+			response.ErrorResponse(c, http.StatusServiceUnavailable, services.ErrExchangeRateUnavailable.Error())
+			return
+		}
 		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to create payment")
 		return
 	}
 
-	paymentData := gin.H{
-		"payment_id":      payment.PaymentID,
-		"payment_url":     payment.PaymentURL,
-		"bitcoin_address": payment.BitcoinAddress,
-		"status":          payment.Status,
+	response.SuccessResponse(c, http.StatusOK, "Payment created successfully", paymentData(payment))
+}
+
+// paymentData is the public representation of a payment
+func paymentData(payment *models.Payment) gin.H {
+	return gin.H{
+		"payment_id":        payment.PaymentID,
+		"payment_url":       payment.PaymentURL,
+		"bitcoin_address":   payment.BitcoinAddress,
+		"amount":            payment.Amount,
+		"currency":          payment.Currency,
+		"amount_sats":       payment.AmountSats,
+		"received_sats":     payment.ReceivedSats,
+		"status":            payment.Status,
+		"confirmations":     payment.Confirmations,
+		"transaction_id":    payment.TransactionID,
+		"merchant_wallet":   payment.MerchantWallet,
+		"label":             payment.Label,
+		"description":       payment.Description,
+		"payment_uri":       services.PaymentURI(payment),
+		"exchange_rate":     payment.ExchangeRate,
+		"rate_source":       payment.RateSource,
+		"rate_locked_until": payment.RateLockedUntil,
+		"expires_at":        payment.ExpiresAt,
+		"created_at":        payment.CreatedAt,
+		"updated_at":        payment.UpdatedAt,
+	}
+}
+
+// GetPayment returns a single payment
+func (h *PaymentHandler) GetPayment(c *gin.Context) {
+	payment, err := h.paymentService.GetPayment(c.GetUint("user_id"), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, services.ErrPaymentNotFound) {
+			response.ErrorResponse(c, http.StatusNotFound, "Payment not found")
+			return
+		}
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to retrieve payment")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Payment retrieved successfully", paymentData(payment))
+}
+
+// ListPayments returns a page of payments. It accepts the filters status
+// (comma separated), currency, created_after and created_before (RFC 3339),
+// min_amount_sats and max_amount_sats, along with sort, limit and cursor.
+func (h *PaymentHandler) ListPayments(c *gin.Context) {
+	query, err := parsePaymentQuery(c)
+	if err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := h.paymentService.ListPayments(c.GetUint("user_id"), query)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidPaymentQuery) {
+			response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to retrieve payments")
+		return
 	}
 
-	response.SuccessResponse(c, http.StatusOK, "Payment created successfully", paymentData)
+	payments := make([]gin.H, 0, len(page.Payments))
+	for i := range page.Payments {
+		payments = append(payments, paymentData(&page.Payments[i]))
+	}
+	response.SuccessResponse(c, http.StatusOK, "Payments retrieved successfully", gin.H{
+		"payments":    payments,
+		"next_cursor": page.NextCursor,
+	})
 }
 
-type WebhookRequest struct {
-	PaymentID string `json:"payment_id"`
-	Status    string `json:"status"`
-	Address   string `json:"address"`
+// parsePaymentQuery reads the payment list parameters from the query string
+func parsePaymentQuery(c *gin.Context) (services.PaymentQuery, error) {
+	query := services.PaymentQuery{
+		Currency: c.Query("currency"),
+		Sort:     c.Query("sort"),
+		Cursor:   c.Query("cursor"),
+	}
+
+	for _, status := range strings.Split(c.Query("status"), ",") {
+		if status = strings.TrimSpace(status); status != "" {
+			query.Statuses = append(query.Statuses, models.PaymentStatus(status))
+		}
+	}
+
+	var err error
+	if query.CreatedAfter, err = parseTimeParam(c, "created_after"); err != nil {
+		return query, err
+	}
+	if query.CreatedBefore, err = parseTimeParam(c, "created_before"); err != nil {
+		return query, err
+	}
+	if query.MinAmountSats, err = parseIntParam(c, "min_amount_sats"); err != nil {
+		return query, err
+	}
+	if query.MaxAmountSats, err = parseIntParam(c, "max_amount_sats"); err != nil {
+		return query, err
+	}
+	if limit, err := parseIntParam(c, "limit"); err != nil {
+		return query, err
+	} else if limit != nil {
+		query.Limit = int(*limit)
+	}
+	return query, nil
 }
 
-func (h *PaymentHandler) HandleWebhook(c *gin.Context) {
-	signature := c.GetHeader("X-Webhook-Signature")
-	payload, err := c.GetRawData()
+// parseTimeParam reads an optional RFC 3339 timestamp from the query string
+func parseTimeParam(c *gin.Context, name string) (*time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
 	if err != nil {
+		return nil, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+	}
+	return &t, nil
+}
+
+// parseIntParam reads an optional integer from the query string
+func parseIntParam(c *gin.Context, name string) (*int64, error) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an integer", name)
+	}
+	return &n, nil
+}
+
+// maxWebhookBodySize caps the size of inbound webhook bodies
+const maxWebhookBodySize = 64 << 10
+
+// HandleWebhook applies a signed payment status update. See
+// services.ProcessWebhook for the signature scheme.
+func (h *PaymentHandler) HandleWebhook(c *gin.Context) {
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBodySize+1))
+	if err != nil || len(payload) > maxWebhookBodySize {
 		response.ErrorResponse(c, http.StatusBadRequest, "Invalid payload")
 		return
 	}
 
-	mac := hmac.New(sha256.New, []byte(h.webhookSecret))
-	mac.Write(payload)
-	expectedSignature := hex.EncodeToString(mac.Sum(nil))
-	if signature != expectedSignature {
+	err = h.paymentService.ProcessWebhook(c.Request.Context(), c.GetHeader("X-Webhook-Signature"), payload)
+	switch {
+	case err == nil:
+		response.SuccessResponse(c, http.StatusOK, "Webhook processed successfully", nil)
+	case errors.Is(err, services.ErrInvalidWebhookSignature):
 		response.ErrorResponse(c, http.StatusUnauthorized, "Invalid webhook signature")
+	case errors.Is(err, services.ErrDuplicateWebhookEvent):
+		// Already applied, so the sender can stop retrying
+		response.SuccessResponse(c, http.StatusOK, "Webhook already processed", nil)
+	case errors.Is(err, services.ErrInvalidWebhookPayload), errors.Is(err, services.ErrInvalidPaymentStatus),
+		errors.Is(err, services.ErrPaymentAddressMismatch):
+		response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, services.ErrPaymentNotFound):
+		response.ErrorResponse(c, http.StatusNotFound, "Payment not found")
+	case errors.Is(err, models.ErrInvalidPaymentTransition):
+		response.ErrorResponse(c, http.StatusConflict, err.Error())
+	default:
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to update payment status")
+	}
+}
+
+// GetPaymentEvents returns the status history of a payment
+func (h *PaymentHandler) GetPaymentEvents(c *gin.Context) {
+	events, err := h.paymentService.GetPaymentEvents(c.GetUint("user_id"), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, services.ErrPaymentNotFound) {
+			response.ErrorResponse(c, http.StatusNotFound, "Payment not found")
+			return
+		}
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to retrieve payment events")
 		return
 	}
 
-	var webhook WebhookRequest
-	if err := json.Unmarshal(payload, &webhook); err != nil {
-		response.ErrorResponse(c, http.StatusBadRequest, "Invalid webhook payload")
+	response.SuccessResponse(c, http.StatusOK, "Payment events retrieved successfully", events)
+}
+
+// QR code sizes in pixels
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 1024
+)
+
+// GetPaymentQRPNG returns the payment's BIP21 URI as a QR code PNG
+func (h *PaymentHandler) GetPaymentQRPNG(c *gin.Context) {
+	h.renderPaymentQR(c, "image/png", qrcode.PNG)
+}
+
+// GetPaymentQRSVG returns the payment's BIP21 URI as a QR code SVG
+func (h *PaymentHandler) GetPaymentQRSVG(c *gin.Context) {
+	h.renderPaymentQR(c, "image/svg+xml", qrcode.SVG)
+}
+
+// renderPaymentQR writes a payment's QR code in the format produced by
+// render, sized by the optional size query parameter
+func (h *PaymentHandler) renderPaymentQR(c *gin.Context, contentType string, render func(content string, size int) ([]byte, error)) {
+	size := defaultQRSize
+	if value := c.Query("size"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < minQRSize || n > maxQRSize {
+			response.ErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("size must be between %d and %d", minQRSize, maxQRSize))
+			return
+		}
+		size = n
+	}
+
+	uri, err := h.paymentService.GetPaymentURI(c.GetUint("user_id"), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, services.ErrPaymentNotFound) {
+			response.ErrorResponse(c, http.StatusNotFound, "Payment not found")
+			return
+		}
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to retrieve payment")
 		return
 	}
 
-	if err := h.paymentService.UpdatePaymentStatus(webhook.PaymentID, webhook.Status); err != nil {
-		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to update payment status")
+	image, err := render(uri, size)
+	if err != nil {
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to render QR code")
 		return
 	}
 
-	response.SuccessResponse(c, http.StatusOK, "Webhook processed successfully", nil)
+	// The URI shrinks to the missing amount as funds arrive, so never cache
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, contentType, image)
 }
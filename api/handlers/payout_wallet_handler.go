@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
 	response "own-paynet/api/response"
 	"own-paynet/services"
+	"own-paynet/services/bitcoin"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,8 +22,10 @@ func NewPayoutWalletHandler(payoutWalletService *services.PayoutWalletService) *
 
 type CreatePayoutWalletRequest struct {
 	Currency      string `json:"currency" binding:"required"`
-	WalletAddress string `json:"wallet_address" binding:"required"`
-	IsDefault     bool   `json:"is_default"`
+	WalletAddress string `json:"wallet_address" binding:"required_without=ExtendedPublicKey,excluded_with=ExtendedPublicKey"`
+	// Account xpub, ypub or zpub to derive a fresh address per payment from
+	ExtendedPublicKey string `json:"extended_public_key"`
+	IsDefault         bool   `json:"is_default"`
 }
 
 // CreatePayoutWallet handles the creation of a new payout wallet
@@ -51,8 +55,12 @@ func (h *PayoutWalletHandler) CreatePayoutWallet(c *gin.Context) {
 		return
 	}
 
-	wallet, err := h.payoutWalletService.CreatePayoutWallet(userID.(uint), req.Currency, req.WalletAddress, req.IsDefault)
+	wallet, err := h.payoutWalletService.CreatePayoutWallet(userID.(uint), req.Currency, req.WalletAddress, req.ExtendedPublicKey, req.IsDefault)
 	if err != nil {
+		if isWalletValidationError(err) {
+			response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
 		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to create payout wallet: "+err.Error())
 		return
 	}
@@ -60,6 +68,14 @@ func (h *PayoutWalletHandler) CreatePayoutWallet(c *gin.Context) {
 	response.SuccessResponse(c, http.StatusCreated, "Payout wallet created successfully", wallet)
 }
 
+// isWalletValidationError reports whether err rejects the wallet details given
+func isWalletValidationError(err error) bool {
+	return errors.Is(err, bitcoin.ErrInvalidAddress) || errors.Is(err, bitcoin.ErrAddressNetwork) ||
+		errors.Is(err, bitcoin.ErrInvalidExtendedKey) || errors.Is(err, bitcoin.ErrExtendedKeyNetwork) ||
+		errors.Is(err, services.ErrExtendedKeyNotBTC) || errors.Is(err, services.ErrWalletAddressRequired) ||
+		errors.Is(err, services.ErrDerivedAddressImmutable) || errors.Is(err, services.ErrExtendedKeyImmutable)
+}
+
 // GetPayoutWallet handles retrieving a single payout wallet
 func (h *PayoutWalletHandler) GetPayoutWallet(c *gin.Context) {
 	idStr := c.Param("id")
@@ -105,7 +121,9 @@ func (h *PayoutWalletHandler) GetUserPayoutWallets(c *gin.Context) {
 type UpdatePayoutWalletRequest struct {
 	Currency      string `json:"currency"`
 	WalletAddress string `json:"wallet_address"`
-	IsDefault     bool   `json:"is_default"`
+	// Only accepted unchanged, a different key needs a new wallet
+	ExtendedPublicKey string `json:"extended_public_key"`
+	IsDefault         bool   `json:"is_default"`
 }
 
 // UpdatePayoutWallet handles updating a payout wallet
@@ -136,8 +154,12 @@ func (h *PayoutWalletHandler) UpdatePayoutWallet(c *gin.Context) {
 		return
 	}
 
-	updatedWallet, err := h.payoutWalletService.UpdatePayoutWallet(uint(id), req.Currency, req.WalletAddress, req.IsDefault)
+	updatedWallet, err := h.payoutWalletService.UpdatePayoutWallet(uint(id), req.Currency, req.WalletAddress, req.ExtendedPublicKey, req.IsDefault)
 	if err != nil {
+		if isWalletValidationError(err) {
+			response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
 		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to update payout wallet")
 		return
 	}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	response "own-paynet/api/response"
+	"own-paynet/models"
+	"own-paynet/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SessionHandler struct {
+	sessionService *services.SessionService
+}
+
+func NewSessionHandler(sessionService *services.SessionService) *SessionHandler {
+	return &SessionHandler{sessionService: sessionService}
+}
+
+// SessionResponse is a session as shown to its owner
+type SessionResponse struct {
+	models.Session
+	Current bool `json:"current"`
+}
+
+// GetSessions handles listing the active sessions of the authenticated user
+func (h *SessionHandler) GetSessions(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		response.ErrorResponse(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	sessions, err := h.sessionService.ListSessions(userID.(uint))
+	if err != nil {
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to retrieve sessions")
+		return
+	}
+
+	currentSessionID := c.GetString("session_id")
+	result := make([]SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		result = append(result, SessionResponse{
+			Session: session,
+			Current: session.ID == currentSessionID,
+		})
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Sessions retrieved successfully", result)
+}
+
+// RevokeSession handles signing out a single session
+func (h *SessionHandler) RevokeSession(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		response.ErrorResponse(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	err := h.sessionService.Revoke(userID.(uint), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, services.ErrSessionNotFound) {
+			response.ErrorResponse(c, http.StatusNotFound, "Session not found")
+			return
+		}
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to revoke session")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Session revoked successfully", nil)
+}
+
+// RevokeOtherSessions handles signing out every session except the current one
+func (h *SessionHandler) RevokeOtherSessions(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		response.ErrorResponse(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	revoked, err := h.sessionService.RevokeOthers(userID.(uint), c.GetString("session_id"))
+	if err != nil {
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to revoke sessions")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Other sessions revoked successfully", gin.H{
+		"revoked": revoked,
+	})
+}
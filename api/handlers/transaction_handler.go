@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -74,6 +75,10 @@ func (h *TransactionHandler) CreateTransaction(c *gin.Context) {
 		req.ReceiverWallet,
 	)
 	if err != nil {
+		if errors.Is(err, models.ErrInsufficientFunds) || errors.Is(err, services.ErrWalletCurrencyMismatch) {
+			response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
 		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to create transaction: "+err.Error())
 		return
 	}
@@ -148,6 +153,38 @@ func (h *TransactionHandler) GetWalletTransactions(c *gin.Context) {
 	response.SuccessResponse(c, http.StatusOK, "Transactions retrieved successfully", transactions)
 }
 
+// GetWalletLedger handles retrieving the latest ledger entries of a wallet
+func (h *TransactionHandler) GetWalletLedger(c *gin.Context) {
+	walletID, err := strconv.ParseUint(c.Param("wallet_id"), 10, 64)
+	if err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, "Invalid wallet ID")
+		return
+	}
+
+	// Verify the wallet belongs to the authenticated user
+	wallet, err := h.walletService.GetPayoutWallet(uint(walletID))
+	if err != nil {
+		response.ErrorResponse(c, http.StatusNotFound, "Payout wallet not found")
+		return
+	}
+	if wallet.UserID != c.GetUint("user_id") {
+		response.ErrorResponse(c, http.StatusForbidden, "You don't have permission to access this wallet")
+		return
+	}
+
+	entries, err := h.transactionService.GetWalletLedger(wallet)
+	if err != nil {
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to retrieve ledger entries")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Ledger entries retrieved successfully", gin.H{
+		"balance":  wallet.Balance,
+		"currency": wallet.Currency,
+		"entries":  entries,
+	})
+}
+
 // GetUserTransactions handles retrieving all transactions for the authenticated user
 func (h *TransactionHandler) GetUserTransactions(c *gin.Context) {
 	userID, exists := c.Get("user_id")
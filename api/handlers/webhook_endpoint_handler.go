@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"own-paynet/api/response"
+	"own-paynet/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WebhookEndpointHandler manages the endpoints merchants receive webhooks on
+// and their delivery log
+type WebhookEndpointHandler struct {
+	webhookService *services.WebhookService
+}
+
+func NewWebhookEndpointHandler(webhookService *services.WebhookService) *WebhookEndpointHandler {
+	return &WebhookEndpointHandler{webhookService: webhookService}
+}
+
+type CreateWebhookEndpointRequest struct {
+	URL         string   `json:"url" binding:"required"`
+	Description string   `json:"description"`
+	Events      []string `json:"events"` // Defaults to every event
+}
+
+type UpdateWebhookEndpointRequest struct {
+	URL         *string  `json:"url"`
+	Description *string  `json:"description"`
+	Events      []string `json:"events"`
+	IsActive    *bool    `json:"is_active"`
+}
+
+// CreateEndpoint registers a webhook endpoint. The response holds the signing secret, which is not shown again.
+func (h *WebhookEndpointHandler) CreateEndpoint(c *gin.Context) {
+	var req CreateWebhookEndpointRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	endpoint, err := h.webhookService.CreateEndpoint(c.GetUint("user_id"), req.URL, req.Description, req.Events)
+	if err != nil {
+		h.handleError(c, err, "Failed to create webhook endpoint")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusCreated, "Webhook endpoint created successfully", endpoint)
+}
+
+func (h *WebhookEndpointHandler) GetEndpoints(c *gin.Context) {
+	endpoints, err := h.webhookService.ListEndpoints(c.GetUint("user_id"))
+	if err != nil {
+		response.ErrorResponse(c, http.StatusInternalServerError, "Failed to retrieve webhook endpoints")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Webhook endpoints retrieved successfully", endpoints)
+}
+
+func (h *WebhookEndpointHandler) GetEndpoint(c *gin.Context) {
+	endpointID, ok := parseIDParam(c, "id", "Invalid webhook endpoint ID")
+	if !ok {
+		return
+	}
+
+	endpoint, err := h.webhookService.GetEndpoint(c.GetUint("user_id"), endpointID)
+	if err != nil {
+		h.handleError(c, err, "Failed to retrieve webhook endpoint")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Webhook endpoint retrieved successfully", endpoint)
+}
+
+func (h *WebhookEndpointHandler) UpdateEndpoint(c *gin.Context) {
+	endpointID, ok := parseIDParam(c, "id", "Invalid webhook endpoint ID")
+	if !ok {
+		return
+	}
+
+	var req UpdateWebhookEndpointRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	endpoint, err := h.webhookService.UpdateEndpoint(c.GetUint("user_id"), endpointID, services.WebhookEndpointUpdate{
+		URL:         req.URL,
+		Description: req.Description,
+		Events:      req.Events,
+		IsActive:    req.IsActive,
+	})
+	if err != nil {
+		h.handleError(c, err, "Failed to update webhook endpoint")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Webhook endpoint updated successfully", endpoint)
+}
+
+func (h *WebhookEndpointHandler) DeleteEndpoint(c *gin.Context) {
+	endpointID, ok := parseIDParam(c, "id", "Invalid webhook endpoint ID")
+	if !ok {
+		return
+	}
+
+	if err := h.webhookService.DeleteEndpoint(c.GetUint("user_id"), endpointID); err != nil {
+		h.handleError(c, err, "Failed to delete webhook endpoint")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Webhook endpoint deleted successfully", nil)
+}
+
+// GetDeliveries returns the most recent deliveries to an endpoint
+func (h *WebhookEndpointHandler) GetDeliveries(c *gin.Context) {
+	endpointID, ok := parseIDParam(c, "id", "Invalid webhook endpoint ID")
+	if !ok {
+		return
+	}
+
+	deliveries, err := h.webhookService.ListDeliveries(c.GetUint("user_id"), endpointID)
+	if err != nil {
+		h.handleError(c, err, "Failed to retrieve webhook deliveries")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Webhook deliveries retrieved successfully", deliveries)
+}
+
+// GetDelivery returns a delivery with the log of attempts to send it
+func (h *WebhookEndpointHandler) GetDelivery(c *gin.Context) {
+	deliveryID, ok := parseIDParam(c, "id", "Invalid webhook delivery ID")
+	if !ok {
+		return
+	}
+
+	delivery, attempts, err := h.webhookService.GetDelivery(c.GetUint("user_id"), deliveryID)
+	if err != nil {
+		h.handleError(c, err, "Failed to retrieve webhook delivery")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusOK, "Webhook delivery retrieved successfully", gin.H{
+		"delivery": delivery,
+		"attempts": attempts,
+	})
+}
+
+// Redeliver queues a delivery to be sent again right away
+func (h *WebhookEndpointHandler) Redeliver(c *gin.Context) {
+	deliveryID, ok := parseIDParam(c, "id", "Invalid webhook delivery ID")
+	if !ok {
+		return
+	}
+
+	if err := h.webhookService.Redeliver(c.GetUint("user_id"), deliveryID); err != nil {
+		h.handleError(c, err, "Failed to redeliver webhook")
+		return
+	}
+
+	response.SuccessResponse(c, http.StatusAccepted, "Webhook queued for redelivery", nil)
+}
+
+// handleError maps webhook service errors to responses
+func (h *WebhookEndpointHandler) handleError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, services.ErrWebhookEndpointNotFound), errors.Is(err, services.ErrWebhookDeliveryNotFound):
+		response.ErrorResponse(c, http.StatusNotFound, err.Error())
+	case errors.Is(err, services.ErrInvalidWebhookURL), errors.Is(err, services.ErrInvalidWebhookEvent),
+		errors.Is(err, services.ErrTooManyWebhookEndpoints):
+		response.ErrorResponse(c, http.StatusBadRequest, err.Error())
+	default:
+		response.ErrorResponse(c, http.StatusInternalServerError, message)
+	}
+}
+
+// parseIDParam reads a numeric ID from the path, answering 400 if it is malformed
+func parseIDParam(c *gin.Context, name, message string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param(name), 10, 32)
+	if err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, message)
+		return 0, false
+	}
+	return uint(id), true
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	response "own-paynet/api/response"
+	"own-paynet/models"
+	"own-paynet/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Headers carrying an API key signature
+const (
+	HeaderAPIKey    = "X-API-Key"
+	HeaderTimestamp = "X-Timestamp"
+	HeaderNonce     = "X-Nonce"
+	HeaderSignature = "X-Signature"
+)
+
+// maxSignedBodySize caps the body read into memory for signature verification
+const maxSignedBodySize = 1 << 20
+
+// APIKeyMiddleware authenticates server-to-server requests signed with an API key
+func APIKeyMiddleware(apiKeyService *services.APIKeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader(HeaderAPIKey) == "" {
+			response.ErrorResponse(c, http.StatusUnauthorized, "API key required")
+			c.Abort()
+			return
+		}
+		authenticateAPIKey(c, apiKeyService)
+	}
+}
+
+// AuthOrAPIKeyMiddleware accepts either a user access token or a signed API key request
+func AuthOrAPIKeyMiddleware(apiKeyService *services.APIKeyService) gin.HandlerFunc {
+	authMiddleware := AuthMiddleware()
+	return func(c *gin.Context) {
+		if c.GetHeader(HeaderAPIKey) != "" {
+			authenticateAPIKey(c, apiKeyService)
+			return
+		}
+		authMiddleware(c)
+	}
+}
+
+func authenticateAPIKey(c *gin.Context, apiKeyService *services.APIKeyService) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSignedBodySize+1))
+	if err != nil {
+		response.ErrorResponse(c, http.StatusBadRequest, "Invalid request body")
+		c.Abort()
+		return
+	}
+	if len(body) > maxSignedBodySize {
+		response.ErrorResponse(c, http.StatusRequestEntityTooLarge, "Request body too large")
+		c.Abort()
+		return
+	}
+	// Restore the body for the handler
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	apiKey, err := apiKeyService.AuthenticateRequest(c.Request.Context(), &services.SignedRequest{
+		PublicKey: c.GetHeader(HeaderAPIKey),
+		ClientIP:  c.ClientIP(),
+		Timestamp: c.GetHeader(HeaderTimestamp),
+		Nonce:     c.GetHeader(HeaderNonce),
+		Signature: c.GetHeader(HeaderSignature),
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.RequestURI(),
+		Body:      body,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidAPIKey),
+			errors.Is(err, services.ErrAPIKeyDisabled),
+			errors.Is(err, services.ErrInvalidSignature),
+			errors.Is(err, services.ErrRequestExpired),
+			errors.Is(err, services.ErrInvalidNonce),
+			errors.Is(err, services.ErrReplayedRequest):
+			response.ErrorResponse(c, http.StatusUnauthorized, err.Error())
+		case errors.Is(err, services.ErrIPNotAllowed):
+			response.ErrorResponse(c, http.StatusForbidden, err.Error())
+		default:
+			log.Printf("failed to authenticate API key request: %v", err)
+			response.ErrorResponse(c, http.StatusInternalServerError, "Unable to authenticate request")
+		}
+		c.Abort()
+		return
+	}
+
+	c.Set("user_id", apiKey.UserID)
+	c.Set("api_key_id", apiKey.ID)
+	c.Set("api_key", apiKey)
+	c.Next()
+}
+
+// RequireScope rejects API key requests whose key lacks the scope. Requests
+// authenticated with a user access token act with the user's full rights.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, exists := c.Get("api_key")
+		if !exists {
+			c.Next()
+			return
+		}
+
+		if apiKey, ok := value.(*models.APIKey); !ok || !apiKey.HasScope(scope) {
+			response.ErrorResponse(c, http.StatusForbidden, "API key is missing the "+scope+" scope")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
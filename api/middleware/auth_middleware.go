@@ -28,14 +28,15 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		token := parts[1]
-		userID, err := utils.ValidateJWT(token)
+		claims, err := utils.ValidateJWT(token)
 		if err != nil {
 			response.ErrorResponse(c, http.StatusUnauthorized, "Invalid token")
 			c.Abort()
 			return
 		}
 
-		c.Set("user_id", userID)
+		c.Set("user_id", claims.UserID)
+		c.Set("session_id", claims.SessionID)
 		c.Next()
 	}
 }
@@ -1,29 +1,47 @@
 package routes
 
 import (
+	"context"
 	"log"
 	"own-paynet/api/handlers"
 	"own-paynet/api/middleware"
 	"own-paynet/config"
 	"own-paynet/database"
+	"own-paynet/models"
 	"own-paynet/repository"
 	"own-paynet/services"
 	"own-paynet/services/bitcoin"
+	"own-paynet/services/identity"
+	"own-paynet/services/rates"
+	"own-paynet/utils"
 	"own-paynet/utils/email"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRoutes(router *gin.Engine) {
+// SetupRoutes wires up services and routes. Background workers run until ctx is cancelled.
+func SetupRoutes(ctx context.Context, router *gin.Engine) {
 	// Load config
 	cfg := config.LoadConfig()
 
+	// Only trust forwarding headers from our own proxies, API key allowlists depend on the client IP
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal("invalid TRUSTED_PROXIES:", err)
+	}
+
 	// Initialize database
 	db := database.InitDB(cfg)
 
 	// Initialize Redis
 	_ = database.InitRedis(cfg)
 
+	// Load JWT signing keys
+	if err := utils.LoadSigningKeys(); err != nil {
+		log.Fatal("failed to load JWT signing keys:", err)
+	}
+	go utils.WatchSigningKeys(ctx, time.Duration(cfg.JWTKeysReload)*time.Second)
+
 	// Initialize Bitcoin service
 	bitcoinService, err := bitcoin.NewBitcoinService(cfg)
 	if err != nil {
@@ -36,48 +54,110 @@ func SetupRoutes(router *gin.Engine) {
 	// Initialize repositories
 	userRepo := repository.NewUserRepository(db)
 	apiKeyRepo := repository.NewAPIKeyRepository(db)
-	apiKeyService := services.NewAPIKeyService(apiKeyRepo)
+	apiKeyService := services.NewAPIKeyService(apiKeyRepo, cfg)
 	payoutWalletRepo := repository.NewPayoutWalletRepository(db)
-	payoutWalletService := services.NewPayoutWalletService(payoutWalletRepo)
-	authService := services.NewAuthService(userRepo, emailService, apiKeyService, payoutWalletService)
+	payoutWalletService := services.NewPayoutWalletService(payoutWalletRepo, bitcoinService.NetParams())
+	sessionService := services.NewSessionService(cfg)
+	twoFactorService := services.NewTwoFactorService(userRepo, services.NewEmailService(cfg))
+	authService := services.NewAuthService(userRepo, emailService, apiKeyService, payoutWalletService, sessionService, twoFactorService)
 	authHandler := handlers.NewAuthHandler(authService)
 
+	// Initialize identity providers for external sign in
+	identityRegistry, err := identity.NewRegistry(cfg)
+	if err != nil {
+		log.Fatal("failed to initialize identity providers:", err)
+	}
+	userIdentityRepo := repository.NewUserIdentityRepository(db)
+	oauthService := services.NewOAuthService(identityRegistry, userIdentityRepo, userRepo, authService, emailService)
+	oauthHandler := handlers.NewOAuthHandler(oauthService, cfg)
+	sessionHandler := handlers.NewSessionHandler(sessionService)
+
 	paymentRepo := repository.NewPaymentRepository(db)
-	paymentService := services.NewPaymentService(paymentRepo, bitcoinService, cfg.BaseURL, cfg.BitcoinNetwork)
-	paymentHandler := handlers.NewPaymentHandler(paymentService, cfg)
+
+	// Watch the wallet for transactions paying open payments
+	checkpointRepo := repository.NewWatcherCheckpointRepository(db)
+	paymentTxRepo := repository.NewPaymentTransactionRepository(db)
+	paymentWatcher := services.NewPaymentWatcher(paymentRepo, checkpointRepo, paymentTxRepo, bitcoinService, cfg)
+	go paymentWatcher.Run(ctx)
+
+	// Close payments that were not paid in time
+	paymentExpirySweeper := services.NewPaymentExpirySweeper(paymentRepo)
+	go paymentExpirySweeper.Run(ctx)
+
+	// Exchange rates for payments priced in fiat
+	rateProvider, err := rates.NewProvider(cfg)
+	if err != nil {
+		log.Fatal("failed to initialize exchange rate provider:", err)
+	}
+
+	paymentEventRepo := repository.NewPaymentEventRepository(db)
+	paymentService := services.NewPaymentService(paymentRepo, paymentEventRepo, userRepo, payoutWalletRepo, bitcoinService, paymentWatcher, rateProvider, cfg)
+	paymentHandler := handlers.NewPaymentHandler(paymentService)
+
+	// Quote fiat priced payments again once their rate lock has lapsed
+	paymentRequoter := services.NewPaymentRequoter(paymentService)
+	go paymentRequoter.Run(ctx)
+
+	// Send merchants webhooks for payment and transaction events
+	webhookEndpointRepo := repository.NewWebhookEndpointRepository(db)
+	webhookDeliveryRepo := repository.NewWebhookDeliveryRepository(db)
+	webhookService := services.NewWebhookService(webhookEndpointRepo, webhookDeliveryRepo)
+	webhookWorker := services.NewWebhookWorker(webhookService, webhookEndpointRepo, webhookDeliveryRepo, paymentEventRepo, paymentRepo, cfg)
+	go webhookWorker.Run(ctx)
+	webhookEndpointHandler := handlers.NewWebhookEndpointHandler(webhookService)
 
 	// Initialize company service and handler
 	companyRepo := repository.NewCompanyRepository(db)
 	companyService := services.NewCompanyService(companyRepo)
 	companyHandler := handlers.NewCompanyHandler(companyService)
 
-	// Initialize payout wallet repository, service, and handler
-	payoutWalletRepo = repository.NewPayoutWalletRepository(db)
-	payoutWalletService = services.NewPayoutWalletService(payoutWalletRepo)
+	// Initialize payout wallet handler
 	payoutWalletHandler := handlers.NewPayoutWalletHandler(payoutWalletService)
 
+	// Keep wallet balances in a double-entry ledger and check it adds up
+	ledgerRepo := repository.NewLedgerRepository(db)
+	ledgerService := services.NewLedgerService(ledgerRepo)
+	ledgerReconciler := services.NewLedgerReconciler(ledgerService)
+	go ledgerReconciler.Run(ctx)
+
 	// Initialize transaction repository, service, and handler
 	transactionRepo := repository.NewTransactionRepository(db)
-	transactionService := services.NewTransactionService(transactionRepo, payoutWalletService, bitcoinService)
+	transactionService := services.NewTransactionService(transactionRepo, payoutWalletService, ledgerService, bitcoinService, webhookService)
 	userService := services.NewUserService(userRepo)
 	transactionHandler := handlers.NewTransactionHandler(transactionService, payoutWalletService, userService)
 
 	// Initialize API key handler
 	apiKeyHandler := handlers.NewAPIKeyHandler(apiKeyService)
 
-	// Initialize 2FA service and handler
-	twoFactorService := services.NewTwoFactorService(userRepo, services.NewEmailService(cfg))
+	// Disable expired API keys and warn owners ahead of expiry
+	apiKeyExpiryWorker := services.NewAPIKeyExpiryWorker(apiKeyRepo, userRepo, emailService, cfg)
+	go apiKeyExpiryWorker.Run(ctx)
+
+	// Initialize 2FA handler
 	twoFactorHandler := handlers.NewTwoFactorHandler(twoFactorService)
 
+	// Public verification keys for services that consume our tokens
+	jwksHandler := handlers.NewJWKSHandler()
+	router.GET("/.well-known/jwks.json", jwksHandler.GetJWKS)
+
+	// Hosted checkout that payment URLs point to, open to payers without an account
+	router.LoadHTMLGlob("api/templates/*.html")
+	checkoutHandler := handlers.NewCheckoutHandler(paymentService)
+	router.GET("/pay/:id", checkoutHandler.ShowCheckout)
+	router.GET("/pay/:id/status", checkoutHandler.GetCheckoutStatus)
+
 	// Setup routes
 	api := router.Group("/api/v1")
 	{
 		api.POST("/signup", authHandler.Signup)
 		api.POST("/signin", authHandler.Signin)
+		api.POST("/signin/2fa", authHandler.Signin2FA)
+		api.POST("/token/refresh", authHandler.RefreshToken)
 
-		// Google OAuth routes
-		api.GET("/auth/google", authHandler.GoogleLogin)
-		api.GET("/auth/google/callback", authHandler.GoogleCallback)
+		// External identity provider routes
+		api.GET("/auth/providers", oauthHandler.GetProviders)
+		api.GET("/auth/:provider", oauthHandler.Login)
+		api.GET("/auth/:provider/callback", oauthHandler.Callback)
 
 		// Password reset flow
 		api.POST("/request-password-reset", authHandler.RequestPasswordReset)
@@ -91,10 +171,58 @@ func SetupRoutes(router *gin.Engine) {
 		// Payment-related routes
 		api.POST("/webhook", paymentHandler.HandleWebhook)
 
+		// Routes merchants can call from their backend with a signed API key request
+		merchant := api.Group("/")
+		merchant.Use(middleware.AuthOrAPIKeyMiddleware(apiKeyService))
+		{
+			merchant.POST("/payments", middleware.RequireScope(models.ScopePaymentsWrite), paymentHandler.CreatePayment)
+			merchant.GET("/payments", middleware.RequireScope(models.ScopePaymentsRead), paymentHandler.ListPayments)
+			merchant.GET("/payments/:id", middleware.RequireScope(models.ScopePaymentsRead), paymentHandler.GetPayment)
+			merchant.GET("/payments/:id/qr.png", middleware.RequireScope(models.ScopePaymentsRead), paymentHandler.GetPaymentQRPNG)
+			merchant.GET("/payments/:id/qr.svg", middleware.RequireScope(models.ScopePaymentsRead), paymentHandler.GetPaymentQRSVG)
+			merchant.GET("/payments/:id/events", middleware.RequireScope(models.ScopePaymentsRead), paymentHandler.GetPaymentEvents)
+
+			// Payout wallet lookups
+			merchant.GET("/payout-wallets", middleware.RequireScope(models.ScopeWalletsRead), payoutWalletHandler.GetUserPayoutWallets)
+			merchant.GET("/payout-wallets/:id", middleware.RequireScope(models.ScopeWalletsRead), payoutWalletHandler.GetPayoutWallet)
+
+			// Transaction routes
+			merchant.POST("/transactions", middleware.RequireScope(models.ScopeTransactionsWrite), transactionHandler.CreateTransaction)
+			merchant.GET("/transactions/:id", middleware.RequireScope(models.ScopeTransactionsRead), transactionHandler.GetTransaction)
+			merchant.GET("/wallets/:wallet_id/transactions", middleware.RequireScope(models.ScopeTransactionsRead), transactionHandler.GetWalletTransactions)
+			merchant.GET("/wallets/:wallet_id/ledger", middleware.RequireScope(models.ScopeTransactionsRead), transactionHandler.GetWalletLedger)
+			merchant.GET("/transactions", middleware.RequireScope(models.ScopeTransactionsRead), transactionHandler.GetUserTransactions)
+
+			// Outbound webhook routes
+			webhooks := merchant.Group("/")
+			webhooks.Use(middleware.RequireScope(models.ScopeWebhooksManage))
+			{
+				webhooks.POST("/webhook-endpoints", webhookEndpointHandler.CreateEndpoint)
+				webhooks.GET("/webhook-endpoints", webhookEndpointHandler.GetEndpoints)
+				webhooks.GET("/webhook-endpoints/:id", webhookEndpointHandler.GetEndpoint)
+				webhooks.PATCH("/webhook-endpoints/:id", webhookEndpointHandler.UpdateEndpoint)
+				webhooks.DELETE("/webhook-endpoints/:id", webhookEndpointHandler.DeleteEndpoint)
+				webhooks.GET("/webhook-endpoints/:id/deliveries", webhookEndpointHandler.GetDeliveries)
+				webhooks.GET("/webhook-deliveries/:id", webhookEndpointHandler.GetDelivery)
+				webhooks.POST("/webhook-deliveries/:id/redeliver", webhookEndpointHandler.Redeliver)
+			}
+		}
+
 		protected := api.Group("/")
 		protected.Use(middleware.AuthMiddleware())
 		{
 			protected.POST("/logout", authHandler.Logout)
+
+			// Identity provider linking routes
+			protected.GET("/identities", oauthHandler.GetIdentities)
+			protected.POST("/auth/:provider/link", oauthHandler.Link)
+			protected.DELETE("/auth/:provider/link", oauthHandler.Unlink)
+
+			// Session management routes
+			protected.GET("/sessions", sessionHandler.GetSessions)
+			protected.DELETE("/sessions/:id", sessionHandler.RevokeSession)
+			protected.POST("/sessions/revoke-others", sessionHandler.RevokeOtherSessions)
+
 			// 2FA routes
 			// Enable 2FA flow
 			protected.POST("/2fa/enable/email", twoFactorHandler.EnableEmail2FA)
@@ -113,26 +241,22 @@ func SetupRoutes(router *gin.Engine) {
 			protected.POST("/2fa/send-otp", twoFactorHandler.SendOTP)
 			protected.GET("/2fa/authenticator-qr", twoFactorHandler.GetAuthenticatorQRCode)
 
-			protected.POST("/payments", paymentHandler.CreatePayment)
 			protected.PUT("/company/:id", companyHandler.UpdateCompany)
 
 			// Payout wallet routes
 			protected.POST("/payout-wallets", payoutWalletHandler.CreatePayoutWallet)
-			protected.GET("/payout-wallets", payoutWalletHandler.GetUserPayoutWallets)
-			protected.GET("/payout-wallets/:id", payoutWalletHandler.GetPayoutWallet)
 			protected.PUT("/payout-wallets/:id", payoutWalletHandler.UpdatePayoutWallet)
 			protected.DELETE("/payout-wallets/:id", payoutWalletHandler.DeletePayoutWallet)
 
-			// Transaction routes
-			protected.POST("/transactions", transactionHandler.CreateTransaction)
-			protected.GET("/transactions/:id", transactionHandler.GetTransaction)
-			protected.GET("/wallets/:wallet_id/transactions", transactionHandler.GetWalletTransactions)
-			protected.GET("/transactions", transactionHandler.GetUserTransactions)
-
 			// API Key routes
 			protected.POST("/api-keys", apiKeyHandler.GenerateAPIKey)
 			protected.GET("/api-keys", apiKeyHandler.GetUserAPIKeys)
 			protected.PUT("/api-keys/:id/default", apiKeyHandler.SetDefaultKey)
+			protected.POST("/api-keys/:id/rotate", apiKeyHandler.RotateAPIKey)
+			protected.GET("/api-keys/:id/allowed-ips", apiKeyHandler.GetAllowedIPs)
+			protected.PUT("/api-keys/:id/allowed-ips", apiKeyHandler.SetAllowedIPs)
+			protected.POST("/api-keys/:id/allowed-ips", apiKeyHandler.AddAllowedIP)
+			protected.DELETE("/api-keys/:id/allowed-ips", apiKeyHandler.RemoveAllowedIP)
 			protected.DELETE("/api-keys/:id", apiKeyHandler.DeleteAPIKey)
 
 		}
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -19,17 +22,46 @@ type Config struct {
 	BitcoinRPCUser string
 	BitcoinRPCPass string
 	ServerPort     string
+	TrustedProxies []string // Proxies allowed to set X-Forwarded-For, none if empty
 	WebhookSecret  string
 	BitcoinNetwork string
 	//JWT configuration
-	JWTSecret string
-	BaseURL   string
+	JWTKeys       JWTKeyConfig
+	JWTKeysReload int // Seconds between reloads of JWT_KEYS_DIR
+	BaseURL       string
 	// Redis configuration
 	RedisHost     string
 	RedisPort     string
 	RedisPassword string
 	RedisDB       int
-	TokenExpiry   int // Token expiry in hours
+	// Session configuration
+	AccessTokenExpiry  int // Access token expiry in minutes
+	RefreshTokenExpiry int // Refresh token expiry in hours
+	MFAChallengeExpiry int // Two-factor sign-in challenge expiry in minutes
+	// API key configuration
+	APIKeyRotationGrace    int // Hours a rotated secret keeps working
+	APIKeyExpiryNoticeDays int // Days before expiry the owner is emailed
+	// Payment monitoring configuration
+	RequiredConfirmations int    // Confirmations before a payment counts as confirmed
+	PaymentPollInterval   int    // Seconds between checks of the wallet for new payments
+	BitcoinZMQRawTx       string // zmqpubrawtx endpoint, e.g. tcp://127.0.0.1:28332
+	BitcoinZMQHashBlock   string // zmqpubhashblock endpoint, e.g. tcp://127.0.0.1:28333
+	UnderpaidToleranceBPS int    // Shortfall, in basis points of the amount, still accepted as paid
+	OverpaidToleranceBPS  int    // Excess, in basis points of the amount, still counted as paid
+	PaymentExpiry         int    // Default payment lifetime in minutes
+	LatePaymentGrace      int    // Hours expired payments are still watched for late funds
+	PendingTimeout        int    // Hours an unconfirmed output counts towards a payment
+	AddressGapLimit       int    // Unused derived addresses in a row after which no more are handed out
+	// Exchange rate configuration
+	ExchangeRateProvider     string // "static" or "http"
+	ExchangeRatesFile        string // JSON file of rates for the static provider
+	ExchangeRateURL          string // CoinGecko compatible simple price endpoint for the http provider
+	ExchangeRateCacheSeconds int    // Seconds the http provider reuses a fetched rate
+	RateLockMinutes          int    // Minutes the rate of a fiat priced payment is locked for
+	RateLockGraceMinutes     int    // Minutes after the lock ends before the payment is quoted again
+	// Outbound webhook configuration
+	WebhookMaxAttempts int // Attempts before a delivery is given up
+	WebhookTimeout     int // Seconds to wait for a merchant endpoint to answer
 	// Email configuration
 	SMTPHost     string
 	SMTPPort     string
@@ -37,10 +69,33 @@ type Config struct {
 	SMTPPassword string
 	SMTPFrom     string
 	SMTPFromName string
-	// Google OAuth configuration
-	GoogleClientID     string
-	GoogleClientSecret string
-	GoogleRedirectURL  string
+	// Identity provider configuration
+	IdentityProviders []IdentityProviderConfig
+}
+
+// Identity provider types
+const (
+	IdentityProviderOIDC   = "oidc"
+	IdentityProviderGitHub = "github"
+)
+
+// JWTKeyConfig configures the keys tokens are signed and verified with
+type JWTKeyConfig struct {
+	Secret      string // HS256 secret used when KeysDir is not set
+	KeysDir     string // Directory of PEM signing keys, named <kid>.pem
+	ActiveKeyID string // Key ID used to sign new tokens
+	Issuer      string
+}
+
+// IdentityProviderConfig configures one external sign-in provider
+type IdentityProviderConfig struct {
+	Name         string // Used in routes, e.g. /auth/{name}
+	Type         string // IdentityProviderOIDC or IdentityProviderGitHub
+	IssuerURL    string // OIDC issuer, endpoints are found through discovery
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
 }
 
 func LoadConfig() *Config {
@@ -58,17 +113,46 @@ func LoadConfig() *Config {
 		BitcoinRPCURL:  os.Getenv("BITCOIN_RPC_URL"),
 		BitcoinRPCUser: os.Getenv("BITCOIN_RPC_USER"),
 		BitcoinRPCPass: os.Getenv("BITCOIN_RPC_PASS"),
-		BitcoinNetwork: os.Getenv("BITCOIN_NETWORK"), // e.g., "mainnet", "testnet", "regtest"
+		BitcoinNetwork: getEnv("BITCOIN_NETWORK", "testnet"), // "mainnet", "testnet" or "regtest"
 		ServerPort:     os.Getenv("SERVER_PORT"),
+		TrustedProxies: strings.FieldsFunc(os.Getenv("TRUSTED_PROXIES"), func(r rune) bool { return r == ',' || r == ' ' }),
 		WebhookSecret:  os.Getenv("WEBHOOK_SECRET"),
-		JWTSecret:      os.Getenv("JWT_SECRET"),
+		JWTKeys:        LoadJWTKeyConfig(),
+		JWTKeysReload:  getEnvInt("JWT_KEYS_RELOAD_SECONDS", 60),
 		BaseURL:        os.Getenv("BASE_URL"),
 		// Redis configuration
 		RedisHost:     os.Getenv("REDIS_HOST"),
 		RedisPort:     os.Getenv("REDIS_PORT"),
 		RedisPassword: os.Getenv("REDIS_PASSWORD"),
-		RedisDB:       0,  // Default DB
-		TokenExpiry:   24, // Default 24 hours
+		RedisDB:       0, // Default DB
+		// Session configuration
+		AccessTokenExpiry:  getEnvInt("ACCESS_TOKEN_EXPIRY_MINUTES", 15),
+		RefreshTokenExpiry: getEnvInt("REFRESH_TOKEN_EXPIRY_HOURS", 720),
+		MFAChallengeExpiry: getEnvInt("MFA_CHALLENGE_EXPIRY_MINUTES", 5),
+		// API key configuration
+		APIKeyRotationGrace:    getEnvInt("API_KEY_ROTATION_GRACE_HOURS", 24),
+		APIKeyExpiryNoticeDays: getEnvInt("API_KEY_EXPIRY_NOTICE_DAYS", 7),
+		// Payment monitoring configuration
+		RequiredConfirmations: getEnvInt("BITCOIN_REQUIRED_CONFIRMATIONS", 6),
+		PaymentPollInterval:   getEnvInt("PAYMENT_POLL_INTERVAL_SECONDS", 30),
+		BitcoinZMQRawTx:       os.Getenv("BITCOIN_ZMQ_RAWTX"),
+		BitcoinZMQHashBlock:   os.Getenv("BITCOIN_ZMQ_HASHBLOCK"),
+		UnderpaidToleranceBPS: getEnvInt("PAYMENT_UNDERPAID_TOLERANCE_BPS", 0),
+		OverpaidToleranceBPS:  getEnvInt("PAYMENT_OVERPAID_TOLERANCE_BPS", 0),
+		PaymentExpiry:         getEnvInt("PAYMENT_EXPIRY_MINUTES", 60),
+		LatePaymentGrace:      getEnvInt("PAYMENT_LATE_GRACE_HOURS", 24),
+		PendingTimeout:        getEnvInt("PAYMENT_PENDING_TIMEOUT_HOURS", 72),
+		AddressGapLimit:       getEnvInt("HD_GAP_LIMIT", 20),
+		// Exchange rate configuration
+		ExchangeRateProvider:     getEnv("EXCHANGE_RATE_PROVIDER", "static"),
+		ExchangeRatesFile:        os.Getenv("EXCHANGE_RATES_FILE"),
+		ExchangeRateURL:          getEnv("EXCHANGE_RATE_URL", "https://api.coingecko.com/api/v3/simple/price"),
+		ExchangeRateCacheSeconds: getEnvInt("EXCHANGE_RATE_CACHE_SECONDS", 60),
+		RateLockMinutes:          getEnvInt("PAYMENT_RATE_LOCK_MINUTES", 15),
+		RateLockGraceMinutes:     getEnvInt("PAYMENT_RATE_LOCK_GRACE_MINUTES", 5),
+		// Outbound webhook configuration
+		WebhookMaxAttempts: getEnvInt("WEBHOOK_MAX_ATTEMPTS", 12),
+		WebhookTimeout:     getEnvInt("WEBHOOK_TIMEOUT_SECONDS", 10),
 		// Email configuration
 		SMTPHost:     os.Getenv("SMTP_HOST"),
 		SMTPPort:     os.Getenv("SMTP_PORT"),
@@ -76,9 +160,103 @@ func LoadConfig() *Config {
 		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
 		SMTPFrom:     os.Getenv("SMTP_FROM"),
 		SMTPFromName: os.Getenv("SMTP_FROM_NAME"),
-		// Google OAuth configuration
-		GoogleClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-		GoogleClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
-		GoogleRedirectURL:  os.Getenv("GOOGLE_REDIRECT_URL"),
+		// Identity provider configuration
+		IdentityProviders: loadIdentityProviders(os.Getenv("BASE_URL")),
+	}
+}
+
+// LoadJWTKeyConfig reads the JWT key settings from the environment. Unlike
+// LoadConfig it neither reads .env, which LoadConfig already loaded into the
+// environment at startup, nor exits, so keys can be reloaded while the
+// server runs.
+func LoadJWTKeyConfig() JWTKeyConfig {
+	return JWTKeyConfig{
+		Secret:      os.Getenv("JWT_SECRET"),
+		KeysDir:     os.Getenv("JWT_KEYS_DIR"),
+		ActiveKeyID: os.Getenv("JWT_ACTIVE_KID"),
+		Issuer:      getEnv("JWT_ISSUER", "own-paynet"),
+	}
+}
+
+// loadIdentityProviders builds the list of configured sign-in providers.
+// Google, GitHub and Microsoft have dedicated variables; any other OpenID
+// Connect issuer can be added by listing its name in OIDC_PROVIDERS and
+// setting OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID and OIDC_<NAME>_CLIENT_SECRET.
+// Providers without a client ID are skipped.
+func loadIdentityProviders(baseURL string) []IdentityProviderConfig {
+	redirectURL := func(name, envKey string) string {
+		return getEnv(envKey, fmt.Sprintf("%s/api/v1/auth/%s/callback", baseURL, name))
+	}
+
+	candidates := []IdentityProviderConfig{
+		{
+			Name:         "google",
+			Type:         IdentityProviderOIDC,
+			IssuerURL:    "https://accounts.google.com",
+			ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
+			ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+			RedirectURL:  redirectURL("google", "GOOGLE_REDIRECT_URL"),
+			Scopes:       []string{"openid", "email", "profile"},
+		},
+		{
+			Name:         "github",
+			Type:         IdentityProviderGitHub,
+			ClientID:     os.Getenv("GITHUB_CLIENT_ID"),
+			ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
+			RedirectURL:  redirectURL("github", "GITHUB_REDIRECT_URL"),
+			Scopes:       []string{"read:user", "user:email"},
+		},
+		{
+			Name:         "microsoft",
+			Type:         IdentityProviderOIDC,
+			IssuerURL:    fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0", getEnv("MICROSOFT_TENANT", "common")),
+			ClientID:     os.Getenv("MICROSOFT_CLIENT_ID"),
+			ClientSecret: os.Getenv("MICROSOFT_CLIENT_SECRET"),
+			RedirectURL:  redirectURL("microsoft", "MICROSOFT_REDIRECT_URL"),
+			Scopes:       []string{"openid", "email", "profile"},
+		},
+	}
+
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		candidates = append(candidates, IdentityProviderConfig{
+			Name:         name,
+			Type:         IdentityProviderOIDC,
+			IssuerURL:    os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  redirectURL(name, prefix+"REDIRECT_URL"),
+			Scopes:       strings.Fields(getEnv(prefix+"SCOPES", "openid email profile")),
+		})
+	}
+
+	providers := make([]IdentityProviderConfig, 0, len(candidates))
+	for _, provider := range candidates {
+		if provider.ClientID != "" {
+			providers = append(providers, provider)
+		}
+	}
+	return providers
+}
+
+// getEnv reads an environment variable, falling back to the given default when it is unset
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvInt reads an integer environment variable, falling back to the given
+// default when the variable is unset or malformed
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
 	}
+	return value
 }
@@ -25,7 +25,17 @@ func InitDB(cfg *config.Config) *gorm.DB {
 		log.Println("Database connected successfully")
 	}
 
-	db.AutoMigrate(&models.User{}, &models.Company{}, &models.Payment{}, &models.PayoutWallet{}, &models.Transaction{}, &models.APIKey{})
+	// Reshape existing data that AutoMigrate cannot convert on its own
+	if err := runPreMigrations(db); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+
+	db.AutoMigrate(&models.User{}, &models.Company{}, &models.Payment{}, &models.PayoutWallet{}, &models.Transaction{}, &models.APIKey{}, &models.UserIdentity{}, &models.WatcherCheckpoint{}, &models.PaymentTransaction{}, &models.PaymentEvent{}, &models.WebhookEndpoint{}, &models.WebhookDelivery{}, &models.WebhookAttempt{}, &models.LedgerAccount{}, &models.JournalEntry{}, &models.Posting{})
+
+	// Migrate existing data to the current schema
+	if err := runMigrations(db); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
 
 	// Set the global DB variable
 	DB = db
@@ -0,0 +1,300 @@
+package database
+
+import (
+	"fmt"
+	"own-paynet/models"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// runPreMigrations converts data that AutoMigrate would otherwise fail on,
+// and runMigrations moves data left behind by earlier schemas into its
+// current place once AutoMigrate has run. Every step must be safe to run on
+// each startup.
+func runPreMigrations(db *gorm.DB) error {
+	return migrateAPIKeySecrets(db)
+}
+
+func runMigrations(db *gorm.DB) error {
+	if err := migrateGoogleIDs(db); err != nil {
+		return err
+	}
+	if err := migrateAPIKeyScopes(db); err != nil {
+		return err
+	}
+	if err := migratePaymentStatuses(db); err != nil {
+		return err
+	}
+	if err := migratePaymentEvents(db); err != nil {
+		return err
+	}
+	if err := migratePaymentTransactionSeenAt(db); err != nil {
+		return err
+	}
+	if err := dropWebhookResponseBodies(db); err != nil {
+		return err
+	}
+	if err := migrateWalletAddressIndexes(db); err != nil {
+		return err
+	}
+	if err := migrateWalletBalances(db); err != nil {
+		return err
+	}
+	if err := migrateTransactionLedgerAmounts(db); err != nil {
+		return err
+	}
+	return protectLedger(db)
+}
+
+// migrateAPIKeySecrets replaces plaintext API secret keys with their hash and
+// visible prefix. It runs before AutoMigrate makes secret_hash NOT NULL.
+func migrateAPIKeySecrets(db *gorm.DB) error {
+	if !db.Migrator().HasTable("api_keys") || !db.Migrator().HasColumn("api_keys", "secret_key") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		statements := []string{
+			`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS secret_hash text`,
+			`ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS secret_prefix text`,
+			`UPDATE api_keys SET
+				secret_hash = encode(sha256(convert_to(secret_key, 'UTF8')), 'hex'),
+				secret_prefix = left(secret_key, 11)
+			WHERE secret_hash IS NULL OR secret_hash = ''`,
+			`ALTER TABLE api_keys DROP COLUMN secret_key`,
+		}
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// migrateGoogleIDs moves users.google_id into user_identities and drops the column
+func migrateGoogleIDs(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&models.User{}, "google_id") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`
+			INSERT INTO user_identities (created_at, updated_at, user_id, provider, subject, email)
+			SELECT NOW(), NOW(), id, 'google', google_id, email FROM users
+			WHERE google_id IS NOT NULL AND google_id <> ''
+			ON CONFLICT DO NOTHING`).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Migrator().DropColumn(&models.User{}, "google_id")
+	})
+}
+
+// migrateAPIKeyScopes grants every scope to keys created before keys had
+// scopes, so existing integrations keep working. New keys always get at
+// least one scope.
+func migrateAPIKeyScopes(db *gorm.DB) error {
+	return db.Model(&models.APIKey{}).
+		Where("scopes = ''").
+		Update("scopes", strings.Join(models.AllScopes, ",")).Error
+}
+
+// migratePaymentStatuses strips the confirmation count that used to be part
+// of the status, e.g. "pending_confirmation (3/6)", so the payment watcher
+// recognises these payments as open. It also fills in the amount due in
+// satoshis for BTC payments and renames "confirmed", which predates amount
+// checks, to "paid".
+func migratePaymentStatuses(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.Payment{}).
+			Where("status LIKE ?", string(models.PaymentStatusPendingConfirmation)+" (%").
+			Update("status", models.PaymentStatusPendingConfirmation).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&models.Payment{}).
+			Where("amount_sats = 0 AND UPPER(currency) = 'BTC'").
+			Update("amount_sats", gorm.Expr("ROUND(amount * 100000000)")).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Payment{}).
+			Where("status = ?", "confirmed").
+			Updates(map[string]interface{}{
+				"status":        models.PaymentStatusPaid,
+				"received_sats": gorm.Expr("amount_sats"),
+			}).Error
+	})
+}
+
+// migratePaymentEvents starts the history of payments created before status
+// changes were recorded with a single event for their current status. These
+// events are not real transitions, so no webhooks are sent for them.
+func migratePaymentEvents(db *gorm.DB) error {
+	return db.Exec(`INSERT INTO payment_events
+			(created_at, payment_id, from_status, to_status, source, confirmations, received_sats, transaction_id, dispatched_at)
+		SELECT p.updated_at, p.payment_id, '', p.status, ?, p.confirmations, p.received_sats, p.transaction_id, NOW()
+		FROM payments p
+		WHERE p.deleted_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM payment_events e WHERE e.payment_id = p.payment_id)`,
+		models.PaymentEventSourceMigration).Error
+}
+
+// migratePaymentTransactionSeenAt dates outputs recorded before the node's
+// receive time was kept by when the watcher recorded them
+func migratePaymentTransactionSeenAt(db *gorm.DB) error {
+	return db.Model(&models.PaymentTransaction{}).Where("seen_at IS NULL").
+		Update("seen_at", gorm.Expr("created_at")).Error
+}
+
+// dropWebhookResponseBodies removes the response bodies earlier versions kept
+// for each webhook attempt, which could hold whatever an endpoint returned
+func dropWebhookResponseBodies(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&models.WebhookAttempt{}, "response_body") {
+		return nil
+	}
+	return db.Migrator().DropColumn(&models.WebhookAttempt{}, "response_body")
+}
+
+// migrateWalletAddressIndexes moves wallets with an extended public key that
+// have not handed out an address yet past index 0, which is the wallet address
+func migrateWalletAddressIndexes(db *gorm.DB) error {
+	return db.Model(&models.PayoutWallet{}).
+		Where("extended_public_key <> '' AND next_address_index < ?", models.FirstPaymentAddressIndex).
+		Update("next_address_index", models.FirstPaymentAddressIndex).Error
+}
+
+// migrateWalletBalances carries the float balances of payout wallets into the
+// ledger, each as an entry against the opening balance account of its
+// currency, and drops payout_wallets.balance once they all are.
+func migrateWalletBalances(db *gorm.DB) error {
+	if !db.Migrator().HasColumn("payout_wallets", "balance") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var wallets []struct {
+			ID       uint
+			Currency string
+			Balance  float64
+		}
+		err := tx.Raw(`SELECT id, currency, balance FROM payout_wallets WHERE balance <> 0`).Scan(&wallets).Error
+		if err != nil {
+			return err
+		}
+
+		for _, wallet := range wallets {
+			amount, err := models.ToMinorUnits(wallet.Balance, wallet.Currency)
+			if err != nil {
+				return fmt.Errorf("payout wallet %d: %w", wallet.ID, err)
+			}
+			if amount == 0 {
+				continue
+			}
+
+			walletID := wallet.ID
+			account := models.LedgerAccount{Code: models.WalletAccountCode(wallet.ID)}
+			err = tx.Where(&account).Attrs(models.LedgerAccount{PayoutWalletID: &walletID, Currency: wallet.Currency}).
+				FirstOrCreate(&account).Error
+			if err != nil {
+				return err
+			}
+			opening := models.LedgerAccount{Code: models.SystemAccountCode(models.LedgerAccountOpeningBalance, wallet.Currency)}
+			err = tx.Where(&opening).Attrs(models.LedgerAccount{Currency: wallet.Currency, AllowNegative: true}).
+				FirstOrCreate(&opening).Error
+			if err != nil {
+				return err
+			}
+
+			entry := models.JournalEntry{
+				Reference:   models.LedgerAccountOpeningBalance + ":" + account.Code,
+				Description: "Balance carried over from before the ledger",
+				Postings: []models.Posting{
+					{AccountID: opening.ID, Amount: -amount},
+					{AccountID: account.ID, Amount: amount},
+				},
+			}
+			var count int64
+			if err := tx.Model(&models.JournalEntry{}).Where("reference = ?", entry.Reference).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+			if err := tx.Create(&entry).Error; err != nil {
+				return err
+			}
+			for _, posting := range entry.Postings {
+				err := tx.Model(&models.LedgerAccount{}).Where("id = ?", posting.AccountID).
+					Update("balance", gorm.Expr("balance + ?", posting.Amount)).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return tx.Migrator().DropColumn("payout_wallets", "balance")
+	})
+}
+
+// migrateTransactionLedgerAmounts fills in the minor unit amount of
+// transactions made before the ledger, from the currency of their wallet
+func migrateTransactionLedgerAmounts(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var transactions []struct {
+			ID       uint
+			Amount   float64
+			Currency string
+		}
+		err := tx.Raw(`SELECT t.id, t.amount, w.currency FROM transactions t
+			JOIN payout_wallets w ON w.id = t.payout_wallet_id
+			WHERE t.ledger_amount = 0 AND t.amount <> 0`).Scan(&transactions).Error
+		if err != nil {
+			return err
+		}
+
+		for _, transaction := range transactions {
+			amount, err := models.ToMinorUnits(transaction.Amount, transaction.Currency)
+			if err != nil {
+				return fmt.Errorf("transaction %d: %w", transaction.ID, err)
+			}
+			err = tx.Model(&models.Transaction{}).Unscoped().Where("id = ?", transaction.ID).
+				UpdateColumn("ledger_amount", amount).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// protectLedger makes journal entries and postings append-only. Mistakes are
+// corrected by posting a reversing entry, never by editing history.
+func protectLedger(db *gorm.DB) error {
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION ledger_immutable() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'ledger % are append-only', TG_TABLE_NAME;
+		END;
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS journal_entries_immutable ON journal_entries`,
+		`CREATE TRIGGER journal_entries_immutable BEFORE UPDATE OR DELETE ON journal_entries
+			FOR EACH ROW EXECUTE PROCEDURE ledger_immutable()`,
+		`DROP TRIGGER IF EXISTS postings_immutable ON postings`,
+		`CREATE TRIGGER postings_immutable BEFORE UPDATE OR DELETE ON postings
+			FOR EACH ROW EXECUTE PROCEDURE ledger_immutable()`,
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
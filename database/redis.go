@@ -2,8 +2,10 @@ package database
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"own-paynet/config"
+	"own-paynet/models"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -38,34 +40,6 @@ func GetRedisClient() *redis.Client {
 	return redisClient
 }
 
-// StoreToken stores a token in Redis with expiry
-func StoreToken(ctx context.Context, userID uint, token string, expiry time.Duration) error {
-	key := fmt.Sprintf("user:%d:token", userID)
-	return redisClient.Set(ctx, key, token, expiry).Err()
-}
-
-// GetToken retrieves a token from Redis
-func GetToken(ctx context.Context, userID uint) (string, error) {
-	key := fmt.Sprintf("user:%d:token", userID)
-	return redisClient.Get(ctx, key).Result()
-}
-
-// DeleteToken deletes a token from Redis
-func DeleteToken(ctx context.Context, userID uint) error {
-	key := fmt.Sprintf("user:%d:token", userID)
-	return redisClient.Del(ctx, key).Err()
-}
-
-// ValidateToken checks if a token exists and matches in Redis
-func ValidateToken(ctx context.Context, userID uint, token string) (bool, error) {
-	storedToken, err := GetToken(ctx, userID)
-	if err != nil {
-		return false, err
-	}
-
-	return storedToken == token, nil
-}
-
 // StorePasswordResetToken stores a password reset token in Redis with expiry
 func StorePasswordResetToken(ctx context.Context, email string, token string, expiry time.Duration) error {
 	key := fmt.Sprintf("password_reset:%s", email)
@@ -128,3 +102,88 @@ func ValidateEmailVerificationToken(ctx context.Context, email string, token str
 
 	return storedToken == token, nil
 }
+
+// StoreMFAChallenge records a pending two-factor sign-in challenge for a user
+func StoreMFAChallenge(ctx context.Context, challengeID string, userID uint, expiry time.Duration) error {
+	key := fmt.Sprintf("mfa_challenge:%s", challengeID)
+	pipe := redisClient.TxPipeline()
+	pipe.HSet(ctx, key, "user_id", userID, "attempts", 0)
+	pipe.Expire(ctx, key, expiry)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// IncrementMFAChallengeAttempts counts a verification attempt against a challenge and
+// returns the number of attempts so far, or redis.Nil if the challenge does not exist
+func IncrementMFAChallengeAttempts(ctx context.Context, challengeID string, userID uint) (int64, error) {
+	key := fmt.Sprintf("mfa_challenge:%s", challengeID)
+	storedUserID, err := redisClient.HGet(ctx, key, "user_id").Result()
+	if err != nil {
+		return 0, err
+	}
+	if storedUserID != fmt.Sprintf("%d", userID) {
+		return 0, redis.Nil
+	}
+	return redisClient.HIncrBy(ctx, key, "attempts", 1).Result()
+}
+
+// DeleteMFAChallenge deletes a two-factor sign-in challenge, reporting false
+// if it no longer existed, e.g. because a concurrent request consumed it
+func DeleteMFAChallenge(ctx context.Context, challengeID string) (bool, error) {
+	key := fmt.Sprintf("mfa_challenge:%s", challengeID)
+	deleted, err := redisClient.Del(ctx, key).Result()
+	return deleted == 1, err
+}
+
+// ReserveTOTPStep records that a user signed in with the authenticator code
+// of a time step, reporting false if that step's code was already used
+func ReserveTOTPStep(ctx context.Context, userID uint, step int64, expiry time.Duration) (bool, error) {
+	key := fmt.Sprintf("totp_used:%d:%d", userID, step)
+	return redisClient.SetNX(ctx, key, 1, expiry).Result()
+}
+
+// StoreOAuthState stores the PKCE verifier and purpose of an OAuth flow under its state parameter
+func StoreOAuthState(ctx context.Context, state string, data *models.OAuthState, expiry time.Duration) error {
+	key := fmt.Sprintf("oauth_state:%s", state)
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return redisClient.Set(ctx, key, value, expiry).Err()
+}
+
+// ConsumeOAuthState retrieves and deletes an OAuth state so it can only be used once
+func ConsumeOAuthState(ctx context.Context, state string) (*models.OAuthState, error) {
+	key := fmt.Sprintf("oauth_state:%s", state)
+	value, err := redisClient.GetDel(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var data models.OAuthState
+	if err := json.Unmarshal([]byte(value), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// ReserveRequestNonce records a nonce used to sign an API request, reporting
+// false if the API key already used it within the expiry window
+func ReserveRequestNonce(ctx context.Context, publicKey, nonce string, expiry time.Duration) (bool, error) {
+	key := fmt.Sprintf("api_nonce:%s:%s", publicKey, nonce)
+	return redisClient.SetNX(ctx, key, 1, expiry).Result()
+}
+
+// ReserveWebhookEvent records the ID of an inbound webhook event, reporting
+// false if it was already processed within the expiry window
+func ReserveWebhookEvent(ctx context.Context, eventID string, expiry time.Duration) (bool, error) {
+	key := fmt.Sprintf("webhook_event:%s", eventID)
+	return redisClient.SetNX(ctx, key, 1, expiry).Result()
+}
+
+// ReleaseWebhookEvent forgets an inbound webhook event that could not be
+// processed, so the sender's retry is accepted
+func ReleaseWebhookEvent(ctx context.Context, eventID string) error {
+	key := fmt.Sprintf("webhook_event:%s", eventID)
+	return redisClient.Del(ctx, key).Err()
+}
@@ -0,0 +1,200 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"own-paynet/models"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Results returned by RotateRefreshToken
+const (
+	RefreshTokenInvalid = 0
+	RefreshTokenRotated = 1
+	RefreshTokenReused  = 2
+)
+
+// rotateRefreshTokenScript swaps the current refresh token hash of a session
+// for a new one and extends the session and the user's session index, adding
+// the session back to the index in case the index expired. Each rotated-out
+// hash is remembered under its own key, expiring when the token would have,
+// so that a replayed token can be told apart from a token that never existed
+// without the session growing on every rotation.
+var rotateRefreshTokenScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'refresh_hash')
+if not current then
+	return 0
+end
+if current == ARGV[1] then
+	redis.call('HSET', KEYS[1], 'refresh_hash', ARGV[2], 'last_seen_at', ARGV[3], 'ip_address', ARGV[4], 'expires_at', ARGV[5])
+	redis.call('EXPIRE', KEYS[1], ARGV[6])
+	redis.call('SET', KEYS[3], ARGV[7], 'EX', ARGV[6])
+	redis.call('SADD', KEYS[2], ARGV[7])
+	if redis.call('TTL', KEYS[2]) < tonumber(ARGV[6]) then
+		redis.call('EXPIRE', KEYS[2], ARGV[6])
+	end
+	return 1
+end
+if redis.call('GET', KEYS[3]) == ARGV[7] then
+	return 2
+end
+return 0
+`)
+
+// touchSessionScript updates the last seen time of a session if it belongs to the given user
+var touchSessionScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'user_id') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'last_seen_at', ARGV[2])
+return 1
+`)
+
+func sessionKey(sessionID string) string {
+	return fmt.Sprintf("session:%s", sessionID)
+}
+
+func userSessionsKey(userID uint) string {
+	return fmt.Sprintf("user:%d:sessions", userID)
+}
+
+// usedRefreshTokenKey holds the ID of the session a rotated-out refresh token belonged to
+func usedRefreshTokenKey(refreshHash string) string {
+	return fmt.Sprintf("refresh_used:%s", refreshHash)
+}
+
+// StoreSession stores a new session together with the hash of its first refresh token
+func StoreSession(ctx context.Context, session *models.Session, refreshHash string, expiry time.Duration) error {
+	key := sessionKey(session.ID)
+	pipe := redisClient.TxPipeline()
+	pipe.HSet(ctx, key,
+		"user_id", session.UserID,
+		"device_name", session.DeviceName,
+		"ip_address", session.IPAddress,
+		"user_agent", session.UserAgent,
+		"created_at", session.CreatedAt.Unix(),
+		"last_seen_at", session.LastSeenAt.Unix(),
+		"expires_at", session.ExpiresAt.Unix(),
+		"refresh_hash", refreshHash,
+	)
+	pipe.Expire(ctx, key, expiry)
+	pipe.SAdd(ctx, userSessionsKey(session.UserID), session.ID)
+	pipe.Expire(ctx, userSessionsKey(session.UserID), expiry)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetSession retrieves a session from Redis, returning redis.Nil if it does not exist
+func GetSession(ctx context.Context, sessionID string) (*models.Session, error) {
+	fields, err := redisClient.HGetAll(ctx, sessionKey(sessionID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, redis.Nil
+	}
+
+	userID, err := strconv.ParseUint(fields["user_id"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt session %s: %v", sessionID, err)
+	}
+
+	return &models.Session{
+		ID:         sessionID,
+		UserID:     uint(userID),
+		DeviceName: fields["device_name"],
+		IPAddress:  fields["ip_address"],
+		UserAgent:  fields["user_agent"],
+		CreatedAt:  parseUnixField(fields["created_at"]),
+		LastSeenAt: parseUnixField(fields["last_seen_at"]),
+		ExpiresAt:  parseUnixField(fields["expires_at"]),
+	}, nil
+}
+
+// RotateRefreshToken atomically replaces the refresh token hash of a session.
+// It returns RefreshTokenRotated on success, RefreshTokenReused if oldHash was
+// already rotated out, and RefreshTokenInvalid otherwise.
+func RotateRefreshToken(ctx context.Context, userID uint, sessionID, oldHash, newHash, ipAddress string, expiry time.Duration) (int, error) {
+	now := time.Now()
+	keys := []string{sessionKey(sessionID), userSessionsKey(userID), usedRefreshTokenKey(oldHash)}
+	return rotateRefreshTokenScript.Run(ctx, redisClient, keys,
+		oldHash,
+		newHash,
+		now.Unix(),
+		ipAddress,
+		now.Add(expiry).Unix(),
+		int64(expiry.Seconds()),
+		sessionID,
+	).Int()
+}
+
+// TouchSession checks that a session exists for the user and records it as seen
+func TouchSession(ctx context.Context, userID uint, sessionID string) (bool, error) {
+	result, err := touchSessionScript.Run(ctx, redisClient, []string{sessionKey(sessionID)},
+		strconv.FormatUint(uint64(userID), 10),
+		time.Now().Unix(),
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	return result == 1, nil
+}
+
+// ListUserSessions returns all live sessions of a user, pruning expired ones from the index
+func ListUserSessions(ctx context.Context, userID uint) ([]models.Session, error) {
+	sessionIDs, err := redisClient.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]models.Session, 0, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		session, err := GetSession(ctx, sessionID)
+		if err == redis.Nil {
+			redisClient.SRem(ctx, userSessionsKey(userID), sessionID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+
+	return sessions, nil
+}
+
+// DeleteSession removes a single session
+func DeleteSession(ctx context.Context, userID uint, sessionID string) error {
+	pipe := redisClient.TxPipeline()
+	pipe.Del(ctx, sessionKey(sessionID))
+	pipe.SRem(ctx, userSessionsKey(userID), sessionID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// DeleteUserSessions removes every session of a user
+func DeleteUserSessions(ctx context.Context, userID uint) error {
+	sessionIDs, err := redisClient.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := redisClient.TxPipeline()
+	for _, sessionID := range sessionIDs {
+		pipe.Del(ctx, sessionKey(sessionID))
+	}
+	pipe.Del(ctx, userSessionsKey(userID))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func parseUnixField(value string) time.Time {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
@@ -1,21 +1,32 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"own-paynet/api/routes"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	// Stop background workers and the server on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Setup router
 	router := gin.Default()
 
 	// Add CORS middleware
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"}, // Allow all origins; adjust as needed
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
@@ -23,12 +34,27 @@ func main() {
 	}))
 
 	// Setup all routes
-	routes.SetupRoutes(router)
+	routes.SetupRoutes(ctx, router)
 
 	// Start server
-	log.Printf("Server running on port %s", "8080")
-	err := router.Run(":8080")
-	if err != nil {
-		log.Fatal("Failed to start server:", err)
+	server := &http.Server{
+		Addr:    ":8080",
+		Handler: router,
+	}
+	go func() {
+		log.Printf("Server running on port %s", "8080")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Failed to start server:", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down server")
+
+	// Give in-flight requests a chance to finish
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Fatal("Failed to shut down server:", err)
 	}
 }
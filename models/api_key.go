@@ -1,18 +1,103 @@
 package models
 
 import (
+	"net/netip"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+// API key scopes
+const (
+	ScopePaymentsRead      = "payments:read"
+	ScopePaymentsWrite     = "payments:write"
+	ScopeWalletsRead       = "wallets:read"
+	ScopeTransactionsRead  = "transactions:read"
+	ScopeTransactionsWrite = "transactions:write"
+	ScopeWebhooksManage    = "webhooks:manage"
+)
+
+// AllScopes lists every scope an API key can be granted
+var AllScopes = []string{
+	ScopePaymentsRead,
+	ScopePaymentsWrite,
+	ScopeWalletsRead,
+	ScopeTransactionsRead,
+	ScopeTransactionsWrite,
+	ScopeWebhooksManage,
+}
+
 type APIKey struct {
 	gorm.Model
-	ID          uint      `json:"id" gorm:"primaryKey"`
-	UserID      uint      `json:"user_id" gorm:"not null"`
-	PublicKey   string    `json:"public_key" gorm:"uniqueIndex;not null"`
-	SecretKey   string    `json:"secret_key" gorm:"uniqueIndex;not null"`
-	IsDefault   bool      `json:"is_default" gorm:"default:false"`
-	LastUsedAt  time.Time `json:"last_used_at"`
-	Description string    `json:"description"`
+	ID        uint   `json:"id" gorm:"primaryKey"`
+	UserID    uint   `json:"user_id" gorm:"not null"`
+	PublicKey string `json:"public_key" gorm:"uniqueIndex;not null"`
+	// Only the SHA-256 hash of the secret key is stored. The key itself is
+	// returned once, when it is generated.
+	SecretKey    string    `json:"secret_key,omitempty" gorm:"-"`
+	SecretHash   string    `json:"-" gorm:"uniqueIndex;not null"`
+	SecretPrefix string    `json:"secret_prefix" gorm:"not null"`
+	IsDefault    bool      `json:"is_default" gorm:"default:false"`
+	LastUsedAt   time.Time `json:"last_used_at"`
+	Description  string    `json:"description"`
+	Scopes       string    `json:"scopes" gorm:"not null;default:''"` // Comma separated
+	// After a rotation the previous secret keeps working until PreviousSecretExpiresAt
+	PreviousSecretHash      string     `json:"-"`
+	PreviousSecretExpiresAt *time.Time `json:"previous_secret_expires_at,omitempty"`
+	ExpiresAt               *time.Time `json:"expires_at,omitempty"`
+	DisabledAt              *time.Time `json:"disabled_at,omitempty"`
+	ExpiryNotifiedAt        *time.Time `json:"-"`
+	// Requests are only accepted from these networks, or from anywhere if empty
+	AllowedCIDRs string `json:"allowed_cidrs" gorm:"not null;default:''"` // Comma separated
+}
+
+// IsActive reports whether the key can still authenticate requests
+func (k *APIKey) IsActive(now time.Time) bool {
+	if k.DisabledAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// CIDRList returns the networks the key may be used from
+func (k *APIKey) CIDRList() []string {
+	if k.AllowedCIDRs == "" {
+		return nil
+	}
+	return strings.Split(k.AllowedCIDRs, ",")
+}
+
+// AllowsIP reports whether the key may be used from an address
+func (k *APIKey) AllowsIP(ip netip.Addr) bool {
+	cidrs := k.CIDRList()
+	if len(cidrs) == 0 {
+		return true
+	}
+	ip = ip.Unmap()
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopeList returns the scopes granted to the key
+func (k *APIKey) ScopeList() []string {
+	if k.Scopes == "" {
+		return nil
+	}
+	return strings.Split(k.Scopes, ",")
+}
+
+// HasScope reports whether the key has been granted a scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, granted := range k.ScopeList() {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
 }
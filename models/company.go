@@ -8,4 +8,6 @@ type Company struct {
 	gorm.Model
 	CompanyName    string `json:"company_name"`
 	CompanyDetails string `json:"company_details"`
+	// Lifetime of new payments in minutes, the global default applies if 0
+	PaymentExpiryMinutes int `json:"payment_expiry_minutes"`
 }
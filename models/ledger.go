@@ -0,0 +1,117 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Ledger errors
+var (
+	ErrUnbalancedEntry   = errors.New("journal entry postings do not balance")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrCurrencyMismatch  = errors.New("journal entry mixes currencies")
+)
+
+// LedgerAccount holds money in one currency. Every payout wallet has one,
+// and system accounts are the other side of money entering the ledger.
+// Balance caches the sum of the account's postings and is only changed
+// together with them.
+type LedgerAccount struct {
+	ID             uint      `json:"id" gorm:"primarykey"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	Code           string    `json:"code" gorm:"uniqueIndex;not null"` // e.g. wallet:12 or opening_balance:BTC
+	PayoutWalletID *uint     `json:"payout_wallet_id" gorm:"uniqueIndex"`
+	Currency       string    `json:"currency" gorm:"not null"`
+	Balance        int64     `json:"balance"`        // In minor units of Currency, satoshis for BTC
+	AllowNegative  bool      `json:"allow_negative"` // System accounts may go below zero
+}
+
+// WalletAccountCode names the ledger account of a payout wallet
+func WalletAccountCode(walletID uint) string {
+	return fmt.Sprintf("wallet:%d", walletID)
+}
+
+// LedgerAccountOpeningBalance is the system account, suffixed with the
+// currency, that balances carried over from before the ledger came from
+const LedgerAccountOpeningBalance = "opening_balance"
+
+// SystemAccountCode names a system ledger account for a currency, e.g. opening_balance:BTC
+func SystemAccountCode(name, currency string) string {
+	return name + ":" + strings.ToUpper(currency)
+}
+
+// JournalEntry is one immutable movement of money. Its postings sum to zero,
+// so money is only ever moved between accounts, never created or lost.
+type JournalEntry struct {
+	ID            uint      `json:"id" gorm:"primarykey"`
+	CreatedAt     time.Time `json:"created_at"`
+	Reference     string    `json:"reference" gorm:"uniqueIndex;not null"` // Makes posting idempotent, e.g. transaction:42
+	Description   string    `json:"description"`
+	TransactionID *uint     `json:"transaction_id" gorm:"index"` // Transaction the entry settles, if any
+	Postings      []Posting `json:"postings"`
+}
+
+// Posting changes the balance of one account as part of a journal entry.
+// Positive amounts credit the account and negative amounts debit it.
+type Posting struct {
+	ID             uint      `json:"id" gorm:"primarykey"`
+	CreatedAt      time.Time `json:"created_at"`
+	JournalEntryID uint      `json:"journal_entry_id" gorm:"index;not null"`
+	AccountID      uint      `json:"account_id" gorm:"index;not null"`
+	Amount         int64     `json:"amount"` // In minor units of the account's currency
+}
+
+// CheckBalanced returns ErrUnbalancedEntry unless the entry has at least two
+// non-zero postings summing to zero
+func (e *JournalEntry) CheckBalanced() error {
+	if len(e.Postings) < 2 {
+		return fmt.Errorf("%w: at least two postings are needed", ErrUnbalancedEntry)
+	}
+	var sum int64
+	for _, posting := range e.Postings {
+		if posting.Amount == 0 {
+			return fmt.Errorf("%w: postings cannot be zero", ErrUnbalancedEntry)
+		}
+		sum += posting.Amount
+	}
+	if sum != 0 {
+		return fmt.Errorf("%w: postings sum to %d", ErrUnbalancedEntry, sum)
+	}
+	return nil
+}
+
+// currencyScales lists the currencies whose minor unit is not a hundredth,
+// with their number of minor units per unit. Fiat currencies follow ISO 4217.
+var currencyScales = map[string]int64{
+	"BTC":  100_000_000,
+	"SAT":  1,
+	"SATS": 1,
+	// No minor unit
+	"BIF": 1, "CLP": 1, "DJF": 1, "GNF": 1, "ISK": 1, "JPY": 1, "KMF": 1, "KRW": 1,
+	"PYG": 1, "RWF": 1, "UGX": 1, "UYI": 1, "VND": 1, "VUV": 1, "XAF": 1, "XOF": 1, "XPF": 1,
+	// Three decimal places
+	"BHD": 1000, "IQD": 1000, "JOD": 1000, "KWD": 1000, "LYD": 1000, "OMR": 1000, "TND": 1000,
+}
+
+// CurrencyScale is the number of minor units in one unit of currency:
+// satoshis for BTC, and the ISO 4217 minor unit for fiat currencies, which
+// is a hundredth for most of them
+func CurrencyScale(currency string) int64 {
+	if scale, ok := currencyScales[strings.ToUpper(currency)]; ok {
+		return scale
+	}
+	return 100
+}
+
+// ToMinorUnits converts an amount in currency to minor units, rounding to the nearest one
+func ToMinorUnits(amount float64, currency string) (int64, error) {
+	minor := math.Round(amount * float64(CurrencyScale(currency)))
+	if math.IsNaN(minor) || math.Abs(minor) > math.MaxInt64/2 {
+		return 0, fmt.Errorf("amount %v is out of range", amount)
+	}
+	return int64(minor), nil
+}
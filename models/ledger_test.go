@@ -0,0 +1,75 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestJournalEntryCheckBalanced(t *testing.T) {
+	tests := []struct {
+		name     string
+		amounts  []int64
+		balanced bool
+	}{
+		{"two postings", []int64{-500, 500}, true},
+		{"split across accounts", []int64{-1000, 600, 400}, true},
+		{"no postings", nil, false},
+		{"one posting", []int64{500}, false},
+		{"does not sum to zero", []int64{-500, 499}, false},
+		{"zero posting", []int64{-500, 500, 0}, false},
+		{"all zero", []int64{0, 0}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := JournalEntry{}
+			for _, amount := range tt.amounts {
+				entry.Postings = append(entry.Postings, Posting{Amount: amount})
+			}
+			err := entry.CheckBalanced()
+			if tt.balanced && err != nil {
+				t.Fatalf("CheckBalanced() = %v, want nil", err)
+			}
+			if !tt.balanced && !errors.Is(err, ErrUnbalancedEntry) {
+				t.Fatalf("CheckBalanced() = %v, want ErrUnbalancedEntry", err)
+			}
+		})
+	}
+}
+
+func TestToMinorUnits(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   float64
+		currency string
+		want     int64
+		wantErr  bool
+	}{
+		{"one bitcoin", 1, "BTC", 100_000_000, false},
+		{"float error rounds away", 0.1 + 0.2, "BTC", 30_000_000, false},
+		{"lower case currency", 0.00000001, "btc", 1, false},
+		{"negative", -0.5, "BTC", -50_000_000, false},
+		{"sats", 1234, "SATS", 1234, false},
+		{"fractional sat rounds", 1234.4, "SAT", 1234, false},
+		{"cents", 19.99, "USD", 1999, false},
+		{"half cent rounds up", 0.015, "EUR", 2, false},
+		{"no minor unit", 1500, "JPY", 1500, false},
+		{"three decimals", 1.234, "KWD", 1234, false},
+		{"NaN", math.NaN(), "USD", 0, true},
+		{"infinity", math.Inf(1), "USD", 0, true},
+		{"out of range", 1e300, "BTC", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ToMinorUnits(tt.amount, tt.currency)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ToMinorUnits(%v, %s) error = %v, want error %v", tt.amount, tt.currency, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ToMinorUnits(%v, %s) = %d, want %d", tt.amount, tt.currency, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package models
+
+// OAuth flow modes
+const (
+	OAuthModeLogin = "login"
+	OAuthModeLink  = "link"
+)
+
+// OAuthState is kept in Redis between redirecting a user to an identity
+// provider and handling the callback
+type OAuthState struct {
+	Provider     string `json:"provider"`
+	CodeVerifier string `json:"code_verifier"`
+	Nonce        string `json:"nonce"`
+	Mode         string `json:"mode"`
+	UserID       uint   `json:"user_id,omitempty"`
+}
@@ -1,20 +1,143 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"gorm.io/gorm"
 )
 
+// PaymentStatus is a state in the lifecycle of a payment
+type PaymentStatus string
+
+// Payment statuses
+const (
+	PaymentStatusWaiting             PaymentStatus = "waiting"              // Nothing received yet
+	PaymentStatusPartiallyPaid       PaymentStatus = "partially_paid"       // Less than the amount received so far
+	PaymentStatusPending             PaymentStatus = "pending"              // Amount received, but some of it is still in the mempool
+	PaymentStatusPendingConfirmation PaymentStatus = "pending_confirmation" // Amount received and mined, but not yet deep enough
+	PaymentStatusPaid                PaymentStatus = "paid"                 // Amount received and confirmed
+	PaymentStatusOverpaid            PaymentStatus = "overpaid"             // More than the amount received and confirmed
+	PaymentStatusUnderpaid           PaymentStatus = "underpaid"            // Expired with less than the amount received
+	PaymentStatusExpired             PaymentStatus = "expired"              // Expired with nothing received
+	PaymentStatusPaidLate            PaymentStatus = "paid_late"            // The amount was completed after expiry
+	PaymentStatusNeedsReview         PaymentStatus = "needs_review"         // Funds arrived after expiry without completing the amount
+)
+
+// OpenPaymentStatuses are the statuses of payments that are still being watched
+var OpenPaymentStatuses = []PaymentStatus{
+	PaymentStatusWaiting,
+	PaymentStatusPartiallyPaid,
+	PaymentStatusPending,
+	PaymentStatusPendingConfirmation,
+}
+
+// ExpiredPaymentStatuses are the statuses of payments that expired before
+// being paid. They are still watched for a grace period to catch late payments.
+var ExpiredPaymentStatuses = []PaymentStatus{
+	PaymentStatusExpired,
+	PaymentStatusUnderpaid,
+}
+
+// paymentTransitions lists the statuses each status can move to. Statuses
+// without an entry are final. Confirmations can go back down when a block is
+// reorganised away, hence the moves back to pending. Unconfirmed funds stop
+// counting when their transaction is replaced, double-spent or never
+// confirms, hence the moves from pending back to waiting, partially_paid,
+// expired and underpaid. Funds the node saw before expiry may only be
+// noticed after it, when a notification was missed or the watcher was down,
+// hence the moves from waiting to underpaid and from expired and underpaid
+// to the statuses of payments paid in time.
+var paymentTransitions = map[PaymentStatus][]PaymentStatus{
+	PaymentStatusWaiting: {
+		PaymentStatusPartiallyPaid, PaymentStatusPending, PaymentStatusPendingConfirmation,
+		PaymentStatusPaid, PaymentStatusOverpaid, PaymentStatusExpired,
+		PaymentStatusUnderpaid, PaymentStatusPaidLate, PaymentStatusNeedsReview,
+	},
+	PaymentStatusPartiallyPaid: {
+		PaymentStatusPending, PaymentStatusPendingConfirmation, PaymentStatusPaid,
+		PaymentStatusOverpaid, PaymentStatusExpired, PaymentStatusUnderpaid,
+		PaymentStatusPaidLate, PaymentStatusNeedsReview,
+	},
+	PaymentStatusPending: {
+		PaymentStatusPendingConfirmation, PaymentStatusPaid, PaymentStatusOverpaid,
+		PaymentStatusWaiting, PaymentStatusPartiallyPaid, PaymentStatusExpired,
+		PaymentStatusUnderpaid, PaymentStatusPaidLate, PaymentStatusNeedsReview,
+	},
+	PaymentStatusPendingConfirmation: {
+		PaymentStatusPending, PaymentStatusPaid, PaymentStatusOverpaid,
+		PaymentStatusWaiting, PaymentStatusPartiallyPaid, PaymentStatusExpired,
+		PaymentStatusUnderpaid, PaymentStatusPaidLate, PaymentStatusNeedsReview,
+	},
+	PaymentStatusExpired: {
+		PaymentStatusPending, PaymentStatusPendingConfirmation, PaymentStatusPaid,
+		PaymentStatusOverpaid, PaymentStatusUnderpaid, PaymentStatusPaidLate,
+		PaymentStatusNeedsReview,
+	},
+	PaymentStatusUnderpaid: {
+		PaymentStatusPending, PaymentStatusPendingConfirmation, PaymentStatusPaid,
+		PaymentStatusOverpaid, PaymentStatusExpired, PaymentStatusPaidLate,
+		PaymentStatusNeedsReview,
+	},
+}
+
+// ErrInvalidPaymentTransition is returned when a payment is moved to a
+// status its current status cannot lead to
+var ErrInvalidPaymentTransition = errors.New("invalid payment status transition")
+
+// Valid reports whether s is a known payment status
+func (s PaymentStatus) Valid() bool {
+	switch s {
+	case PaymentStatusWaiting, PaymentStatusPartiallyPaid, PaymentStatusPending,
+		PaymentStatusPendingConfirmation, PaymentStatusPaid, PaymentStatusOverpaid,
+		PaymentStatusUnderpaid, PaymentStatusExpired, PaymentStatusPaidLate,
+		PaymentStatusNeedsReview:
+		return true
+	}
+	return false
+}
+
+// IsFinal reports whether no further transitions are possible from s
+func (s PaymentStatus) IsFinal() bool {
+	return len(paymentTransitions[s]) == 0
+}
+
+// CheckTransition returns ErrInvalidPaymentTransition unless a payment in
+// status s may move to next
+func (s PaymentStatus) CheckTransition(next PaymentStatus) error {
+	for _, allowed := range paymentTransitions[s] {
+		if allowed == next {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w from %s to %s", ErrInvalidPaymentTransition, s, next)
+}
+
 type Payment struct {
 	gorm.Model
-	PaymentID      string  `json:"payment_id" gorm:"unique"`
-	UserID         uint    `json:"user_id"`
-	User           User    `json:"user" gorm:"foreignKey:UserID"`
-	Amount         float64 `json:"amount"`
-	Currency       string  `json:"currency"`
-	Status         string  `json:"status"`
-	PaymentURL     string  `json:"payment_url"`
-	BitcoinAddress string  `json:"bitcoin_address"`
-	MerchantWallet string  `json:"merchant_wallet"`
-	TransactionID  string  `json:"transaction_id" gorm:"index"`
-	Confirmations  int64   `json:"confirmations"`
+	PaymentID      string        `json:"payment_id" gorm:"unique"`
+	UserID         uint          `json:"user_id" gorm:"index"`
+	User           User          `json:"user" gorm:"foreignKey:UserID"`
+	Amount         float64       `json:"amount"`
+	Currency       string        `json:"currency"`
+	AmountSats     int64         `json:"amount_sats"`   // Amount due in satoshis
+	ReceivedSats   int64         `json:"received_sats"` // Sum of all outputs paying the address
+	Status         PaymentStatus `json:"status" gorm:"index"`
+	PaymentURL     string        `json:"payment_url"`
+	BitcoinAddress string        `json:"bitcoin_address" gorm:"index"`
+	MerchantWallet string        `json:"merchant_wallet"`
+	Label          string        `json:"label"`                       // Merchant name shown to payers, from the company at creation
+	Description    string        `json:"description"`                 // Shown to payers as the BIP21 message
+	ExpiresAt      *time.Time    `json:"expires_at" gorm:"index"`     // Never expires if nil
+	TransactionID  string        `json:"transaction_id" gorm:"index"` // Most recent transaction paying the address
+	Confirmations  int64         `json:"confirmations"`               // Confirmations of the least confirmed transaction
+	// Exchange rate of payments priced in fiat, unset for BTC and SATS
+	ExchangeRate    float64    `json:"exchange_rate"`     // Price of one bitcoin in Currency that AmountSats was quoted at
+	RateSource      string     `json:"rate_source"`       // Provider the rate came from
+	RateLockedUntil *time.Time `json:"rate_locked_until"` // AmountSats is quoted again after this, plus a grace period, if nothing was sent
+	// Set when BitcoinAddress was derived from a payout wallet's extended public key
+	PayoutWalletID  *uint   `json:"payout_wallet_id" gorm:"index"`
+	DerivationIndex *uint32 `json:"derivation_index"`
+	AddressReused   bool    `json:"address_reused"` // Set by earlier versions when the address was handed to a later payment
 }
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// Sources of payment status changes
+const (
+	PaymentEventSourceAPI       = "api"       // The payment was created through the API
+	PaymentEventSourceWatcher   = "watcher"   // The payment watcher saw funds or confirmations
+	PaymentEventSourceSweeper   = "sweeper"   // The expiry sweeper closed the payment
+	PaymentEventSourceWebhook   = "webhook"   // An inbound webhook set the status
+	PaymentEventSourceMigration = "migration" // The payment predates status history
+)
+
+// PaymentEvent records one status change of a payment
+type PaymentEvent struct {
+	ID            uint          `json:"id" gorm:"primarykey"`
+	CreatedAt     time.Time     `json:"created_at"`
+	PaymentID     string        `json:"payment_id" gorm:"index"`
+	FromStatus    PaymentStatus `json:"from_status"` // Empty for the first event of a payment
+	ToStatus      PaymentStatus `json:"to_status"`
+	Source        string        `json:"source"`
+	Confirmations int64         `json:"confirmations"`
+	ReceivedSats  int64         `json:"received_sats"`
+	TransactionID string        `json:"transaction_id,omitempty"`
+	DispatchedAt  *time.Time    `json:"-" gorm:"index"` // When webhooks were queued for the event
+}
@@ -0,0 +1,80 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPaymentStatusCheckTransition(t *testing.T) {
+	tests := []struct {
+		from, to PaymentStatus
+		allowed  bool
+	}{
+		{PaymentStatusWaiting, PaymentStatusPartiallyPaid, true},
+		{PaymentStatusWaiting, PaymentStatusPending, true},
+		{PaymentStatusWaiting, PaymentStatusPaid, true},
+		{PaymentStatusWaiting, PaymentStatusExpired, true},
+		{PaymentStatusWaiting, PaymentStatusUnderpaid, true}, // Funds from before expiry noticed after it
+		{PaymentStatusWaiting, PaymentStatusWaiting, false},
+		{PaymentStatusPartiallyPaid, PaymentStatusUnderpaid, true},
+		{PaymentStatusPartiallyPaid, PaymentStatusExpired, true}, // The partial payment was dropped after expiry
+		{PaymentStatusPartiallyPaid, PaymentStatusWaiting, false},
+		{PaymentStatusPending, PaymentStatusPaid, true},
+		{PaymentStatusPending, PaymentStatusWaiting, true}, // The unconfirmed transaction was dropped
+		{PaymentStatusPendingConfirmation, PaymentStatusPending, true},
+		{PaymentStatusPendingConfirmation, PaymentStatusUnderpaid, true},
+		{PaymentStatusExpired, PaymentStatusPaidLate, true},
+		{PaymentStatusExpired, PaymentStatusNeedsReview, true},
+		{PaymentStatusExpired, PaymentStatusPaid, true}, // Paid in time, noticed after the sweeper closed it
+		{PaymentStatusExpired, PaymentStatusWaiting, false},
+		{PaymentStatusExpired, PaymentStatusPartiallyPaid, false},
+		{PaymentStatusUnderpaid, PaymentStatusPaidLate, true},
+		{PaymentStatusUnderpaid, PaymentStatusWaiting, false},
+		{PaymentStatusPaid, PaymentStatusPending, false},
+		{PaymentStatusOverpaid, PaymentStatusPaid, false},
+		{PaymentStatusPaidLate, PaymentStatusExpired, false},
+		{PaymentStatusNeedsReview, PaymentStatusPaidLate, false},
+		{PaymentStatus("unknown"), PaymentStatusPaid, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from)+" to "+string(tt.to), func(t *testing.T) {
+			err := tt.from.CheckTransition(tt.to)
+			if tt.allowed && err != nil {
+				t.Fatalf("CheckTransition() = %v, want nil", err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrInvalidPaymentTransition) {
+				t.Fatalf("CheckTransition() = %v, want ErrInvalidPaymentTransition", err)
+			}
+		})
+	}
+}
+
+func TestPaymentStatusIsFinal(t *testing.T) {
+	tests := []struct {
+		status PaymentStatus
+		final  bool
+	}{
+		{PaymentStatusWaiting, false},
+		{PaymentStatusPartiallyPaid, false},
+		{PaymentStatusPending, false},
+		{PaymentStatusPendingConfirmation, false},
+		{PaymentStatusExpired, false},
+		{PaymentStatusUnderpaid, false},
+		{PaymentStatusPaid, true},
+		{PaymentStatusOverpaid, true},
+		{PaymentStatusPaidLate, true},
+		{PaymentStatusNeedsReview, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.status), func(t *testing.T) {
+			if !tt.status.Valid() {
+				t.Fatalf("Valid() = false for %s", tt.status)
+			}
+			if got := tt.status.IsFinal(); got != tt.final {
+				t.Fatalf("IsFinal() = %v, want %v", got, tt.final)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// PaymentTransaction is a transaction output paying a payment's address. A
+// payment can be paid through several transactions.
+type PaymentTransaction struct {
+	ID            uint      `json:"-" gorm:"primaryKey"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	PaymentID     string    `json:"payment_id" gorm:"index;not null"`
+	TxID          string    `json:"txid" gorm:"uniqueIndex:idx_payment_transactions_output;not null"`
+	Vout          uint32    `json:"vout" gorm:"uniqueIndex:idx_payment_transactions_output"`
+	AmountSats    int64     `json:"amount_sats"`
+	Confirmations int64     `json:"confirmations"`
+	SeenAt        time.Time `json:"seen_at"` // When the node first saw the transaction, or its block time if earlier
+	// Set when the transaction was replaced, double-spent or dropped from the
+	// mempool. Dropped outputs do not count towards the payment.
+	Dropped bool `json:"dropped" gorm:"not null;default:false"`
+}
@@ -4,12 +4,20 @@ import (
 	"gorm.io/gorm"
 )
 
+// FirstPaymentAddressIndex is the first index payment addresses are derived
+// at. Index 0 is the wallet address.
+const FirstPaymentAddressIndex = 1
+
 type PayoutWallet struct {
 	gorm.Model
-	UserID        uint    `json:"user_id"`
-	User          User    `json:"user" gorm:"foreignKey:UserID"`
-	Currency      string  `json:"currency"`
-	WalletAddress string  `json:"wallet_address" gorm:"uniqueIndex"`
-	Balance       float64 `json:"balance"`
-	IsDefault     bool    `json:"is_default" gorm:"default:false"`
+	UserID        uint   `json:"user_id"`
+	User          User   `json:"user" gorm:"foreignKey:UserID"`
+	Currency      string `json:"currency"`
+	WalletAddress string `json:"wallet_address" gorm:"uniqueIndex"`
+	Balance       int64  `json:"balance" gorm:"-"` // From the wallet's ledger account, in minor units
+	IsDefault     bool   `json:"is_default" gorm:"default:false"`
+	// Account key payment addresses are derived from, in which case WalletAddress is its first address
+	ExtendedPublicKey string `json:"extended_public_key,omitempty"`
+	AddressType       string `json:"address_type,omitempty"` // Type of the derived addresses, e.g. p2wpkh
+	NextAddressIndex  uint32 `json:"next_address_index"`     // Index of the next address to derive
 }
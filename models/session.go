@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// Session represents a single signed-in device. Sessions are kept in Redis
+// rather than the database and expire together with their refresh token.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     uint      `json:"user_id"`
+	DeviceName string    `json:"device_name"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
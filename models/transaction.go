@@ -17,6 +17,7 @@ type Transaction struct {
 	PayoutWallet   PayoutWallet    `json:"payout_wallet" gorm:"foreignKey:PayoutWalletID"`
 	Type           TransactionType `json:"type"`
 	Amount         float64         `json:"amount"`
+	LedgerAmount   int64           `json:"ledger_amount"` // Amount in minor units of the wallet currency, as posted to the ledger
 	PriceCurrency  string          `json:"price_currency"`
 	PayCurrency    string          `json:"pay_currency"`
 	Comment        string          `json:"comment"`
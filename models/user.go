@@ -23,9 +23,8 @@ type User struct {
 	LastOTPSentAt           *time.Time `json:"last_otp_sent_at"`
 	OTPSecret               string     `json:"-"`
 
-	// OAuth fields
-	GoogleID string `json:"google_id" gorm:"unique"`
-	Name     string `json:"name"`
-	Avatar   string `json:"avatar"`
-	Locale   string `json:"locale"`
+	// Profile fields, filled in from identity providers
+	Name   string `json:"name"`
+	Avatar string `json:"avatar"`
+	Locale string `json:"locale"`
 }
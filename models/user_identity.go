@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// UserIdentity links a user to an account at an external identity provider.
+// A user can link at most one account per provider.
+type UserIdentity struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UserID    uint      `json:"user_id" gorm:"not null;uniqueIndex:idx_user_identities_user_provider"`
+	User      User      `json:"-" gorm:"foreignKey:UserID"`
+	Provider  string    `json:"provider" gorm:"not null;uniqueIndex:idx_user_identities_user_provider;uniqueIndex:idx_user_identities_provider_subject"`
+	Subject   string    `json:"-" gorm:"not null;uniqueIndex:idx_user_identities_provider_subject"`
+	Email     string    `json:"email"`
+}
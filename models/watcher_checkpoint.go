@@ -0,0 +1,14 @@
+package models
+
+import (
+	"time"
+)
+
+// WatcherCheckpoint records how far a chain watcher has processed, so it can
+// resume where it left off after a restart
+type WatcherCheckpoint struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Name      string    `json:"name" gorm:"uniqueIndex;not null"`
+	BlockHash string    `json:"block_hash"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
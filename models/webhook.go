@@ -0,0 +1,117 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Webhook event types
+const (
+	WebhookEventPaymentCreated       = "payment.created"
+	WebhookEventPaymentPartiallyPaid = "payment.partially_paid"
+	WebhookEventPaymentPending       = "payment.pending"
+	WebhookEventPaymentConfirming    = "payment.confirming"
+	WebhookEventPaymentConfirmed     = "payment.confirmed"
+	WebhookEventPaymentExpired       = "payment.expired"
+	WebhookEventPaymentPaidLate      = "payment.paid_late"
+	WebhookEventPaymentNeedsReview   = "payment.needs_review"
+	WebhookEventPaymentReverted      = "payment.reverted" // Unconfirmed funds stopped counting and nothing is left
+	WebhookEventTransactionCompleted = "transaction.completed"
+	WebhookEventTransactionFailed    = "transaction.failed"
+)
+
+// AllWebhookEvents lists every event type an endpoint can subscribe to
+var AllWebhookEvents = []string{
+	WebhookEventPaymentCreated,
+	WebhookEventPaymentPartiallyPaid,
+	WebhookEventPaymentPending,
+	WebhookEventPaymentConfirming,
+	WebhookEventPaymentConfirmed,
+	WebhookEventPaymentExpired,
+	WebhookEventPaymentPaidLate,
+	WebhookEventPaymentNeedsReview,
+	WebhookEventPaymentReverted,
+	WebhookEventTransactionCompleted,
+	WebhookEventTransactionFailed,
+}
+
+// WebhookEventForPaymentStatus maps the status a payment moved to onto the
+// event sent to merchants
+var WebhookEventForPaymentStatus = map[PaymentStatus]string{
+	PaymentStatusWaiting:             WebhookEventPaymentCreated,
+	PaymentStatusPartiallyPaid:       WebhookEventPaymentPartiallyPaid,
+	PaymentStatusPending:             WebhookEventPaymentPending,
+	PaymentStatusPendingConfirmation: WebhookEventPaymentConfirming,
+	PaymentStatusPaid:                WebhookEventPaymentConfirmed,
+	PaymentStatusOverpaid:            WebhookEventPaymentConfirmed,
+	PaymentStatusExpired:             WebhookEventPaymentExpired,
+	PaymentStatusUnderpaid:           WebhookEventPaymentExpired,
+	PaymentStatusPaidLate:            WebhookEventPaymentPaidLate,
+	PaymentStatusNeedsReview:         WebhookEventPaymentNeedsReview,
+}
+
+// WebhookEndpoint is a merchant URL that events are posted to
+type WebhookEndpoint struct {
+	gorm.Model
+	UserID      uint   `json:"user_id" gorm:"index;not null"`
+	URL         string `json:"url" gorm:"not null"`
+	Description string `json:"description"`
+	// Signs deliveries. It is returned once, when the endpoint is created.
+	Secret   string `json:"secret,omitempty" gorm:"not null"`
+	Events   string `json:"events" gorm:"not null;default:''"` // Comma separated
+	IsActive bool   `json:"is_active" gorm:"not null;default:true"`
+}
+
+// EventList returns the event types the endpoint subscribes to
+func (e *WebhookEndpoint) EventList() []string {
+	if e.Events == "" {
+		return nil
+	}
+	return strings.Split(e.Events, ",")
+}
+
+// Subscribes reports whether the endpoint receives events of the given type
+func (e *WebhookEndpoint) Subscribes(eventType string) bool {
+	for _, subscribed := range e.EventList() {
+		if subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook delivery statuses
+const (
+	WebhookDeliveryPending   = "pending"   // Waiting for its next attempt
+	WebhookDeliverySucceeded = "succeeded" // The endpoint answered with a 2xx
+	WebhookDeliveryFailed    = "failed"    // Every attempt failed
+)
+
+// WebhookDelivery queues one event for one endpoint. Each event is delivered
+// at most once per endpoint; retries and manual redeliveries reuse the row
+// and are logged as WebhookAttempts.
+type WebhookDelivery struct {
+	ID            uint       `json:"id" gorm:"primarykey"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	EndpointID    uint       `json:"endpoint_id" gorm:"uniqueIndex:idx_webhook_deliveries_endpoint_event;not null"`
+	EventID       string     `json:"event_id" gorm:"uniqueIndex:idx_webhook_deliveries_endpoint_event;not null"`
+	EventType     string     `json:"event_type" gorm:"not null"`
+	Payload       string     `json:"payload" gorm:"type:text;not null"`
+	Status        string     `json:"status" gorm:"index;not null"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at" gorm:"index"` // Nil once the delivery succeeded or gave up
+	LastAttemptAt *time.Time `json:"last_attempt_at"`
+}
+
+// WebhookAttempt logs one attempt to deliver a webhook
+type WebhookAttempt struct {
+	ID             uint      `json:"id" gorm:"primarykey"`
+	CreatedAt      time.Time `json:"created_at"`
+	DeliveryID     uint      `json:"delivery_id" gorm:"index;not null"`
+	ResponseStatus int       `json:"response_status"` // 0 if no response was received
+	Error          string    `json:"error,omitempty"`
+	DurationMs     int64     `json:"duration_ms"`
+}
@@ -2,6 +2,7 @@ package repository
 
 import (
 	"own-paynet/models"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -81,3 +82,49 @@ func (r *APIKeyRepository) SetDefault(userID uint, apiKeyID uint) error {
 func (r *APIKeyRepository) UpdateLastUsed(id uint) error {
 	return r.db.Model(&models.APIKey{}).Where("id = ?", id).Update("last_used_at", gorm.Expr("NOW()")).Error
 }
+
+// Rotate replaces the secret of a key, keeping the previous one valid until graceUntil
+func (r *APIKeyRepository) Rotate(id uint, secretHash, secretPrefix string, graceUntil time.Time) error {
+	return r.db.Model(&models.APIKey{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"previous_secret_hash":       gorm.Expr("secret_hash"),
+		"previous_secret_expires_at": graceUntil,
+		"secret_hash":                secretHash,
+		"secret_prefix":              secretPrefix,
+	}).Error
+}
+
+// DisableExpired disables keys whose expiry has passed and returns how many were disabled
+func (r *APIKeyRepository) DisableExpired(now time.Time) (int64, error) {
+	result := r.db.Model(&models.APIKey{}).
+		Where("expires_at <= ? AND disabled_at IS NULL", now).
+		Update("disabled_at", now)
+	return result.RowsAffected, result.Error
+}
+
+// ClearExpiredPreviousSecrets forgets rotated-out secrets once their grace window has passed
+func (r *APIKeyRepository) ClearExpiredPreviousSecrets(now time.Time) error {
+	return r.db.Model(&models.APIKey{}).
+		Where("previous_secret_expires_at <= ?", now).
+		Updates(map[string]interface{}{
+			"previous_secret_hash":       "",
+			"previous_secret_expires_at": nil,
+		}).Error
+}
+
+// GetExpiringUnnotified retrieves active keys expiring before the given time whose owner has not been warned yet
+func (r *APIKeyRepository) GetExpiringUnnotified(before time.Time) ([]models.APIKey, error) {
+	var apiKeys []models.APIKey
+	err := r.db.Where("expires_at <= ? AND disabled_at IS NULL AND expiry_notified_at IS NULL", before).
+		Find(&apiKeys).Error
+	return apiKeys, err
+}
+
+// MarkExpiryNotified records that the owner has been warned about the key's expiry
+func (r *APIKeyRepository) MarkExpiryNotified(id uint, now time.Time) error {
+	return r.db.Model(&models.APIKey{}).Where("id = ?", id).Update("expiry_notified_at", now).Error
+}
+
+// UpdateAllowedCIDRs replaces the networks a key may be used from
+func (r *APIKeyRepository) UpdateAllowedCIDRs(id uint, allowedCIDRs string) error {
+	return r.db.Model(&models.APIKey{}).Where("id = ?", id).Update("allowed_cidrs", allowedCIDRs).Error
+}
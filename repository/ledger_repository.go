@@ -0,0 +1,190 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"own-paynet/models"
+	"sort"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LedgerRepository records journal entries and keeps account balances in
+// step with them. Entries and postings are never updated or deleted.
+type LedgerRepository struct {
+	db *gorm.DB
+}
+
+func NewLedgerRepository(db *gorm.DB) *LedgerRepository {
+	return &LedgerRepository{db: db}
+}
+
+// FindOrCreateAccount returns the account with the given code, creating it
+// if it does not exist yet
+func (r *LedgerRepository) FindOrCreateAccount(account *models.LedgerAccount) (*models.LedgerAccount, error) {
+	err := r.db.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "code"}}, DoNothing: true}).Create(account).Error
+	if err != nil {
+		return nil, err
+	}
+	var existing models.LedgerAccount
+	if err := r.db.Where("code = ?", account.Code).First(&existing).Error; err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+// FindAccountByWalletID returns the ledger account of a payout wallet
+func (r *LedgerRepository) FindAccountByWalletID(walletID uint) (*models.LedgerAccount, error) {
+	var account models.LedgerAccount
+	err := r.db.Where("payout_wallet_id = ?", walletID).First(&account).Error
+	return &account, err
+}
+
+// UpdateEmptyAccountCurrency changes the currency of an account with a zero
+// balance, for a payout wallet that switched currency. Its past postings net
+// to zero, so the totals per currency are unaffected.
+func (r *LedgerRepository) UpdateEmptyAccountCurrency(account *models.LedgerAccount, currency string) error {
+	result := r.db.Model(&models.LedgerAccount{}).Where("id = ? AND balance = 0", account.ID).Update("currency", currency)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: account %s still holds %s", models.ErrCurrencyMismatch, account.Code, account.Currency)
+	}
+	account.Currency = currency
+	return nil
+}
+
+// Post records a journal entry and applies its postings to the account
+// balances in one transaction. The postings must balance and share the
+// accounts' currency, and accounts that do not allow it cannot go negative.
+// Posting an entry whose reference was already used does nothing, so
+// retries are safe; existing is then true.
+func (r *LedgerRepository) Post(entry *models.JournalEntry) (existing bool, err error) {
+	if err := entry.CheckBalanced(); err != nil {
+		return false, err
+	}
+
+	err = r.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the accounts in ID order so concurrent entries cannot deadlock
+		accountIDs := make([]uint, 0, len(entry.Postings))
+		for _, posting := range entry.Postings {
+			accountIDs = append(accountIDs, posting.AccountID)
+		}
+		sort.Slice(accountIDs, func(i, j int) bool { return accountIDs[i] < accountIDs[j] })
+		var accounts []models.LedgerAccount
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id IN ?", accountIDs).Order("id").Find(&accounts).Error
+		if err != nil {
+			return err
+		}
+
+		// Checked under the locks, so a concurrent retry waits and then finds the entry
+		var previous models.JournalEntry
+		err = tx.Where("reference = ?", entry.Reference).First(&previous).Error
+		if err == nil {
+			existing = true
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		byID := make(map[uint]*models.LedgerAccount, len(accounts))
+		for i := range accounts {
+			byID[accounts[i].ID] = &accounts[i]
+		}
+
+		currency := ""
+		for _, posting := range entry.Postings {
+			account, ok := byID[posting.AccountID]
+			if !ok {
+				return fmt.Errorf("ledger account %d not found", posting.AccountID)
+			}
+			if currency != "" && account.Currency != currency {
+				return models.ErrCurrencyMismatch
+			}
+			currency = account.Currency
+			account.Balance += posting.Amount
+		}
+		for _, account := range byID {
+			if account.Balance < 0 && !account.AllowNegative {
+				return fmt.Errorf("%w in %s", models.ErrInsufficientFunds, account.Code)
+			}
+		}
+
+		if err := tx.Create(entry).Error; err != nil {
+			return err
+		}
+		for _, account := range byID {
+			if err := tx.Model(account).Update("balance", account.Balance).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return existing, err
+}
+
+// FindEntriesByAccountID returns the latest journal entries touching an
+// account, with all their postings, newest first
+func (r *LedgerRepository) FindEntriesByAccountID(accountID uint, limit int) ([]models.JournalEntry, error) {
+	var entries []models.JournalEntry
+	err := r.db.Preload("Postings").
+		Where("id IN (?)", r.db.Model(&models.Posting{}).Select("journal_entry_id").Where("account_id = ?", accountID)).
+		Order("id DESC").Limit(limit).Find(&entries).Error
+	return entries, err
+}
+
+// UnbalancedEntry is a journal entry whose postings do not sum to zero
+type UnbalancedEntry struct {
+	JournalEntryID uint
+	Sum            int64
+}
+
+// BalanceMismatch is an account whose cached balance differs from the sum of its postings
+type BalanceMismatch struct {
+	AccountID uint
+	Code      string
+	Balance   int64
+	Postings  int64
+}
+
+// CurrencyTotal is the sum of all postings in one currency, which must be zero
+type CurrencyTotal struct {
+	Currency string
+	Sum      int64
+}
+
+// FindUnbalancedEntries returns the journal entries whose postings do not sum to zero
+func (r *LedgerRepository) FindUnbalancedEntries() ([]UnbalancedEntry, error) {
+	var entries []UnbalancedEntry
+	err := r.db.Raw(`
+		SELECT e.id AS journal_entry_id, COALESCE(SUM(p.amount), 0) AS sum
+		FROM journal_entries e LEFT JOIN postings p ON p.journal_entry_id = e.id
+		GROUP BY e.id
+		HAVING COALESCE(SUM(p.amount), 0) <> 0 OR COUNT(p.id) < 2`).Scan(&entries).Error
+	return entries, err
+}
+
+// FindBalanceMismatches returns the accounts whose cached balance differs
+// from the sum of their postings
+func (r *LedgerRepository) FindBalanceMismatches() ([]BalanceMismatch, error) {
+	var mismatches []BalanceMismatch
+	err := r.db.Raw(`
+		SELECT a.id AS account_id, a.code, a.balance, COALESCE(SUM(p.amount), 0) AS postings
+		FROM ledger_accounts a LEFT JOIN postings p ON p.account_id = a.id
+		GROUP BY a.id
+		HAVING a.balance <> COALESCE(SUM(p.amount), 0)`).Scan(&mismatches).Error
+	return mismatches, err
+}
+
+// CurrencyTotals returns the sum of all postings per currency
+func (r *LedgerRepository) CurrencyTotals() ([]CurrencyTotal, error) {
+	var totals []CurrencyTotal
+	err := r.db.Raw(`
+		SELECT a.currency, SUM(p.amount) AS sum
+		FROM postings p JOIN ledger_accounts a ON a.id = p.account_id
+		GROUP BY a.currency
+		ORDER BY a.currency`).Scan(&totals).Error
+	return totals, err
+}
@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"own-paynet/models"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PaymentEventRepository reads the status history of payments and tracks
+// which events webhooks were sent for. Events are written by
+// PaymentRepository in the same transaction as the status change.
+type PaymentEventRepository struct {
+	db *gorm.DB
+}
+
+func NewPaymentEventRepository(db *gorm.DB) *PaymentEventRepository {
+	return &PaymentEventRepository{db: db}
+}
+
+// FindByPaymentID retrieves the events of a payment, oldest first
+func (r *PaymentEventRepository) FindByPaymentID(paymentID string) ([]models.PaymentEvent, error) {
+	var events []models.PaymentEvent
+	err := r.db.Where("payment_id = ?", paymentID).Order("created_at, id").Find(&events).Error
+	return events, err
+}
+
+// FindUndispatched retrieves up to limit events that no webhooks were queued for yet, oldest first
+func (r *PaymentEventRepository) FindUndispatched(limit int) ([]models.PaymentEvent, error) {
+	var events []models.PaymentEvent
+	err := r.db.Where("dispatched_at IS NULL").Order("id").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// MarkDispatched records that webhooks were queued for the events
+func (r *PaymentEventRepository) MarkDispatched(ids []uint, now time.Time) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return r.db.Model(&models.PaymentEvent{}).Where("id IN ?", ids).Update("dispatched_at", now).Error
+}
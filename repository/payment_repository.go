@@ -1,9 +1,12 @@
 package repository
 
 import (
+	"fmt"
 	"own-paynet/models"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type PaymentRepository struct {
@@ -14,12 +17,42 @@ func NewPaymentRepository(db *gorm.DB) *PaymentRepository {
 	return &PaymentRepository{db: db}
 }
 
+// Create saves a new payment along with the event recording its initial status
 func (r *PaymentRepository) Create(payment *models.Payment) error {
-	return r.db.Create(payment).Error
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(payment).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.PaymentEvent{
+			PaymentID: payment.PaymentID,
+			ToStatus:  payment.Status,
+			Source:    models.PaymentEventSourceAPI,
+		}).Error
+	})
 }
 
-func (r *PaymentRepository) UpdateStatus(paymentID, status string) error {
-	return r.db.Model(&models.Payment{}).Where("payment_id = ?", paymentID).Update("status", status).Error
+// UpdateStatus moves a payment to a new status. The move must be allowed by
+// the payment state machine and is recorded in payment_events.
+func (r *PaymentRepository) UpdateStatus(paymentID string, status models.PaymentStatus, source string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		current, err := lockPayment(tx, paymentID)
+		if err != nil {
+			return err
+		}
+		if current.Status == status {
+			return nil
+		}
+		if err := current.Status.CheckTransition(status); err != nil {
+			return err
+		}
+
+		if err := tx.Model(&models.Payment{}).Where("payment_id = ?", paymentID).Update("status", status).Error; err != nil {
+			return err
+		}
+		from := current.Status
+		current.Status = status
+		return recordTransition(tx, current, from, source)
+	})
 }
 
 func (r *PaymentRepository) UpdateTransaction(paymentID, txID string, confirmations int64) error {
@@ -40,3 +73,195 @@ func (r *PaymentRepository) FindByTransactionID(txID string) (*models.Payment, e
 	err := r.db.Where("transaction_id = ?", txID).First(&payment).Error
 	return &payment, err
 }
+
+// watched limits a query to payments the watcher still follows: open
+// payments, and expired ones until lateCutoff or while late funds they
+// received are still confirming
+func (r *PaymentRepository) watched(lateCutoff time.Time, requiredConfirmations int64) *gorm.DB {
+	return r.db.Where("status IN ?", models.OpenPaymentStatuses).
+		Or("status IN ? AND (expires_at > ? OR (received_sats > 0 AND confirmations < ?))",
+			models.ExpiredPaymentStatuses, lateCutoff, requiredConfirmations)
+}
+
+// FindWatchedByAddresses retrieves the watched payments that pay to any of the addresses
+func (r *PaymentRepository) FindWatchedByAddresses(addresses []string, lateCutoff time.Time, requiredConfirmations int64) ([]models.Payment, error) {
+	var payments []models.Payment
+	err := r.db.Where(r.watched(lateCutoff, requiredConfirmations)).Where("bitcoin_address IN ?", addresses).Find(&payments).Error
+	return payments, err
+}
+
+// FindWatched retrieves the IDs and addresses of watched payments
+func (r *PaymentRepository) FindWatched(lateCutoff time.Time, requiredConfirmations int64) ([]models.Payment, error) {
+	var payments []models.Payment
+	err := r.db.Select("id", "payment_id", "bitcoin_address").Where(r.watched(lateCutoff, requiredConfirmations)).Find(&payments).Error
+	return payments, err
+}
+
+// CountWatched returns the number of watched payments
+func (r *PaymentRepository) CountWatched(lateCutoff time.Time, requiredConfirmations int64) (int64, error) {
+	var count int64
+	err := r.db.Model(&models.Payment{}).Where(r.watched(lateCutoff, requiredConfirmations)).Count(&count).Error
+	return count, err
+}
+
+// FindOverdue retrieves the IDs and statuses of payments in the given status whose expiry has passed
+func (r *PaymentRepository) FindOverdue(status models.PaymentStatus, now time.Time) ([]models.Payment, error) {
+	var payments []models.Payment
+	err := r.db.Select("id", "payment_id", "status").Where("status = ? AND expires_at <= ?", status, now).Find(&payments).Error
+	return payments, err
+}
+
+// UpdateReceived records the amount received for a payment along with its
+// latest transaction, confirmations and status. A status change must be
+// allowed by the payment state machine and is recorded in payment_events.
+func (r *PaymentRepository) UpdateReceived(payment *models.Payment, source string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		current, err := lockPayment(tx, payment.PaymentID)
+		if err != nil {
+			return err
+		}
+		if current.Status != payment.Status {
+			if err := current.Status.CheckTransition(payment.Status); err != nil {
+				return err
+			}
+		}
+
+		err = tx.Model(&models.Payment{}).Where("payment_id = ?", payment.PaymentID).Updates(map[string]interface{}{
+			"received_sats":  payment.ReceivedSats,
+			"transaction_id": payment.TransactionID,
+			"confirmations":  payment.Confirmations,
+			"status":         payment.Status,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		if current.Status == payment.Status {
+			return nil
+		}
+		return recordTransition(tx, payment, current.Status, source)
+	})
+}
+
+// noKnownOutputs matches payments none of whose outputs the watcher has
+// seen, counting unconfirmed and dropped ones
+const noKnownOutputs = "NOT EXISTS (SELECT 1 FROM payment_transactions pt WHERE pt.payment_id = payments.payment_id)"
+
+// FindLapsedQuotes retrieves unexpired payments still waiting for their first
+// funds whose rate lock ended before cutoff, leaving out any with an output
+// to their address, even one only in the mempool
+func (r *PaymentRepository) FindLapsedQuotes(cutoff, now time.Time) ([]models.Payment, error) {
+	var payments []models.Payment
+	err := r.db.Where("status = ? AND received_sats = 0 AND rate_locked_until <= ? AND (expires_at IS NULL OR expires_at > ?)",
+		models.PaymentStatusWaiting, cutoff, now).
+		Where(noKnownOutputs).
+		Find(&payments).Error
+	return payments, err
+}
+
+// UpdateQuote stores a new amount and exchange rate for a payment that is
+// still waiting for its first funds. It reports whether the payment was
+// updated, which it is not once anything has been received or an output to
+// its address has been seen.
+func (r *PaymentRepository) UpdateQuote(paymentID string, amountSats int64, rate float64, source string, lockedUntil time.Time) (bool, error) {
+	result := r.db.Model(&models.Payment{}).
+		Where("payment_id = ? AND status = ? AND received_sats = 0", paymentID, models.PaymentStatusWaiting).
+		Where(noKnownOutputs).
+		Updates(map[string]interface{}{
+			"amount_sats":       amountSats,
+			"exchange_rate":     rate,
+			"rate_source":       source,
+			"rate_locked_until": lockedUntil,
+		})
+	return result.RowsAffected > 0, result.Error
+}
+
+// lockPayment loads a payment and locks its row until the transaction ends,
+// so concurrent status changes are checked against the latest status
+func lockPayment(tx *gorm.DB, paymentID string) (*models.Payment, error) {
+	var payment models.Payment
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("payment_id = ?", paymentID).First(&payment).Error
+	return &payment, err
+}
+
+// recordTransition adds the event for a payment that moved from status from
+// to its current status
+func recordTransition(tx *gorm.DB, payment *models.Payment, from models.PaymentStatus, source string) error {
+	return tx.Create(&models.PaymentEvent{
+		PaymentID:     payment.PaymentID,
+		FromStatus:    from,
+		ToStatus:      payment.Status,
+		Source:        source,
+		Confirmations: payment.Confirmations,
+		ReceivedSats:  payment.ReceivedSats,
+		TransactionID: payment.TransactionID,
+	}).Error
+}
+
+// Columns payments can be listed by
+const (
+	PaymentSortCreatedAt  = "created_at"
+	PaymentSortAmountSats = "amount_sats"
+)
+
+// PaymentFilter selects a page of a user's payments. Pages are keyset
+// paginated: After holds the last payment of the previous page, and the next
+// page continues from its position in the sort order.
+type PaymentFilter struct {
+	UserID        uint
+	Statuses      []models.PaymentStatus
+	Currency      string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	MinAmountSats *int64
+	MaxAmountSats *int64
+	SortBy        string // PaymentSortCreatedAt or PaymentSortAmountSats
+	Descending    bool
+	After         *models.Payment
+	Limit         int
+}
+
+// FindByFilter retrieves the payments matching the filter in sort order
+func (r *PaymentRepository) FindByFilter(filter PaymentFilter) ([]models.Payment, error) {
+	query := r.db.Where("user_id = ?", filter.UserID)
+	if len(filter.Statuses) > 0 {
+		query = query.Where("status IN ?", filter.Statuses)
+	}
+	if filter.Currency != "" {
+		query = query.Where("UPPER(currency) = UPPER(?)", filter.Currency)
+	}
+	if filter.CreatedAfter != nil {
+		query = query.Where("created_at >= ?", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		query = query.Where("created_at < ?", *filter.CreatedBefore)
+	}
+	if filter.MinAmountSats != nil {
+		query = query.Where("amount_sats >= ?", *filter.MinAmountSats)
+	}
+	if filter.MaxAmountSats != nil {
+		query = query.Where("amount_sats <= ?", *filter.MaxAmountSats)
+	}
+
+	column := PaymentSortCreatedAt
+	if filter.SortBy == PaymentSortAmountSats {
+		column = PaymentSortAmountSats
+	}
+	direction, comparison := "ASC", ">"
+	if filter.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	// The ID breaks ties so payments sharing a value are neither skipped nor repeated
+	if filter.After != nil {
+		var value interface{} = filter.After.CreatedAt
+		if column == PaymentSortAmountSats {
+			value = filter.After.AmountSats
+		}
+		query = query.Where(fmt.Sprintf("(%s, id) %s (?, ?)", column, comparison), value, filter.After.ID)
+	}
+
+	var payments []models.Payment
+	err := query.Order(fmt.Sprintf("%s %s, id %s", column, direction, direction)).Limit(filter.Limit).Find(&payments).Error
+	return payments, err
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"own-paynet/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type PaymentTransactionRepository struct {
+	db *gorm.DB
+}
+
+func NewPaymentTransactionRepository(db *gorm.DB) *PaymentTransactionRepository {
+	return &PaymentTransactionRepository{db: db}
+}
+
+// Upsert records an output paying a payment, updating its confirmations if
+// it is already known and keeping the earliest time it was seen. A confirmed
+// output counts again even if it was dropped,
+// and a conflicted one (negative confirmations) is dropped. Otherwise the
+// dropped flag is left to the reconciliation against the node.
+func (r *PaymentTransactionRepository) Upsert(paymentTx *models.PaymentTransaction) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "tx_id"}, {Name: "vout"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"confirmations": gorm.Expr("excluded.confirmations"),
+			"updated_at":    gorm.Expr("excluded.updated_at"),
+			"seen_at":       gorm.Expr("LEAST(payment_transactions.seen_at, excluded.seen_at)"),
+			"dropped": gorm.Expr(`CASE WHEN excluded.confirmations > 0 THEN false
+				WHEN excluded.confirmations < 0 THEN true
+				ELSE payment_transactions.dropped END`),
+		}),
+	}).Create(paymentTx).Error
+}
+
+// CreateIfMissing records an output paying a payment unless it is already known
+func (r *PaymentTransactionRepository) CreateIfMissing(paymentTx *models.PaymentTransaction) error {
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(paymentTx).Error
+}
+
+// FindUnconfirmed retrieves the outputs of the given payments that are not
+// dropped and have fewer than requiredConfirmations
+func (r *PaymentTransactionRepository) FindUnconfirmed(paymentIDs []string, requiredConfirmations int64) ([]models.PaymentTransaction, error) {
+	var paymentTxs []models.PaymentTransaction
+	err := r.db.Where("payment_id IN ? AND NOT dropped AND confirmations < ?", paymentIDs, requiredConfirmations).
+		Find(&paymentTxs).Error
+	return paymentTxs, err
+}
+
+// UpdateState records the confirmations of an output and whether it was dropped
+func (r *PaymentTransactionRepository) UpdateState(id uint, confirmations int64, dropped bool) error {
+	return r.db.Model(&models.PaymentTransaction{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"confirmations": confirmations,
+		"dropped":       dropped,
+	}).Error
+}
+
+// FindByPaymentID retrieves all outputs paying a payment
+func (r *PaymentTransactionRepository) FindByPaymentID(paymentID string) ([]models.PaymentTransaction, error) {
+	var paymentTxs []models.PaymentTransaction
+	err := r.db.Where("payment_id = ?", paymentID).Order("created_at").Find(&paymentTxs).Error
+	return paymentTxs, err
+}
@@ -1,9 +1,11 @@
 package repository
 
 import (
+	"database/sql"
 	"own-paynet/models"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type PayoutWalletRepository struct {
@@ -27,7 +29,7 @@ func (r *PayoutWalletRepository) FindByID(id uint) (*models.PayoutWallet, error)
 		return nil, err
 	}
 	wallet.User.Password = ""
-	return &wallet, nil
+	return &wallet, r.fillBalances(&wallet)
 }
 
 // FindByUserID retrieves all payout wallets for a specific user
@@ -39,11 +41,13 @@ func (r *PayoutWalletRepository) FindByUserID(userID uint) ([]models.PayoutWalle
 	}
 
 	// Clear sensitive data from all wallets
+	pointers := make([]*models.PayoutWallet, len(wallets))
 	for i := range wallets {
 		wallets[i].User.Password = ""
+		pointers[i] = &wallets[i]
 	}
 
-	return wallets, nil
+	return wallets, r.fillBalances(pointers...)
 }
 
 // Update updates a payout wallet
@@ -53,7 +57,7 @@ func (r *PayoutWalletRepository) Update(wallet *models.PayoutWallet) error {
 		return err
 	}
 	wallet.User.Password = ""
-	return nil
+	return r.fillBalances(wallet)
 }
 
 // Delete deletes a payout wallet
@@ -61,20 +65,26 @@ func (r *PayoutWalletRepository) Delete(id uint) error {
 	return r.db.Delete(&models.PayoutWallet{}, id).Error
 }
 
-// UpdateBalance updates the balance of a payout wallet
-func (r *PayoutWalletRepository) UpdateBalance(id uint, amount float64) error {
-	var wallet models.PayoutWallet
-	err := r.db.Model(&models.PayoutWallet{}).Where("id = ?", id).Update("balance", amount).Error
-	if err != nil {
-		return err
+// fillBalances sets the balances of wallets from their ledger accounts
+func (r *PayoutWalletRepository) fillBalances(wallets ...*models.PayoutWallet) error {
+	if len(wallets) == 0 {
+		return nil
 	}
-
-	err = r.db.Preload("User").Preload("User.Company").First(&wallet, id).Error
-	if err != nil {
+	ids := make([]uint, len(wallets))
+	for i, wallet := range wallets {
+		ids[i] = wallet.ID
+	}
+	var accounts []models.LedgerAccount
+	if err := r.db.Select("payout_wallet_id", "balance").Where("payout_wallet_id IN ?", ids).Find(&accounts).Error; err != nil {
 		return err
 	}
-
-	wallet.User.Password = ""
+	balances := make(map[uint]int64, len(accounts))
+	for _, account := range accounts {
+		balances[*account.PayoutWalletID] = account.Balance
+	}
+	for _, wallet := range wallets {
+		wallet.Balance = balances[wallet.ID]
+	}
 	return nil
 }
 
@@ -85,7 +95,7 @@ func (r *PayoutWalletRepository) FindByWalletAddress(walletAddress string) (*mod
 	if err != nil {
 		return nil, err
 	}
-	return &wallet, nil
+	return &wallet, r.fillBalances(&wallet)
 }
 
 // FindDefaultWallet finds the default wallet for a user and currency
@@ -95,7 +105,7 @@ func (r *PayoutWalletRepository) FindDefaultWallet(userID uint, currency string)
 	if err != nil {
 		return nil, err
 	}
-	return &wallet, nil
+	return &wallet, r.fillBalances(&wallet)
 }
 
 // UnsetDefaultWallet unsets the default wallet for a user and currency
@@ -128,3 +138,41 @@ func (r *PayoutWalletRepository) SetDefaultWallet(userID uint, walletID uint, cu
 
 	return tx.Commit().Error
 }
+
+// ReserveAddressIndex hands out the next derivation index of a wallet with an
+// extended public key. Indexes are never handed out twice, so late payments
+// cannot be credited to the wrong payment and unrelated payers are never
+// linked through a shared address. Wallets stop scanning after gapLimit
+// unused addresses in a row, so ok is false and nothing is reserved when the
+// next index would fall past that many unused indexes since the last one
+// that received funds.
+func (r *PayoutWalletRepository) ReserveAddressIndex(walletID uint, gapLimit uint32) (index uint32, ok bool, err error) {
+	err = r.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the wallet so concurrent payments get different indexes
+		var wallet models.PayoutWallet
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&wallet, walletID).Error; err != nil {
+			return err
+		}
+
+		var lastUsed sql.NullInt64
+		err := tx.Model(&models.Payment{}).Unscoped().
+			Where("payout_wallet_id = ? AND received_sats > 0", walletID).
+			Select("MAX(derivation_index)").Scan(&lastUsed).Error
+		if err != nil {
+			return err
+		}
+		// Index 0 is the wallet address, which is in use from the start
+		firstUnused := uint32(models.FirstPaymentAddressIndex)
+		if lastUsed.Valid && uint32(lastUsed.Int64) >= firstUnused {
+			firstUnused = uint32(lastUsed.Int64) + 1
+		}
+
+		index = wallet.NextAddressIndex
+		if index >= firstUnused && index-firstUnused >= gapLimit {
+			return nil
+		}
+		ok = true
+		return tx.Model(&wallet).Update("next_address_index", index+1).Error
+	})
+	return index, ok, err
+}
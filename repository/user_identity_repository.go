@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"own-paynet/models"
+
+	"gorm.io/gorm"
+)
+
+type UserIdentityRepository struct {
+	db *gorm.DB
+}
+
+func NewUserIdentityRepository(db *gorm.DB) *UserIdentityRepository {
+	return &UserIdentityRepository{db: db}
+}
+
+// Create links a new external identity to a user
+func (r *UserIdentityRepository) Create(identity *models.UserIdentity) error {
+	return r.db.Create(identity).Error
+}
+
+// FindByProviderSubject retrieves the identity for an account at a provider
+func (r *UserIdentityRepository) FindByProviderSubject(provider, subject string) (*models.UserIdentity, error) {
+	var identity models.UserIdentity
+	err := r.db.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// FindByUserAndProvider retrieves the identity a user has linked at a provider
+func (r *UserIdentityRepository) FindByUserAndProvider(userID uint, provider string) (*models.UserIdentity, error) {
+	var identity models.UserIdentity
+	err := r.db.Where("user_id = ? AND provider = ?", userID, provider).First(&identity).Error
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// FindByUserID retrieves all identities linked to a user
+func (r *UserIdentityRepository) FindByUserID(userID uint) ([]models.UserIdentity, error) {
+	var identities []models.UserIdentity
+	err := r.db.Where("user_id = ?", userID).Order("provider").Find(&identities).Error
+	return identities, err
+}
+
+// Update updates an identity
+func (r *UserIdentityRepository) Update(identity *models.UserIdentity) error {
+	return r.db.Save(identity).Error
+}
+
+// Delete unlinks an identity
+func (r *UserIdentityRepository) Delete(id uint) error {
+	return r.db.Delete(&models.UserIdentity{}, id).Error
+}
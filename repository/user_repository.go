@@ -25,12 +25,14 @@ func (r *UserRepository) Create(user *models.User) error {
 		return fmt.Errorf("error checking email existence: %w", err)
 	}
 
-	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-	if err != nil {
-		return fmt.Errorf("failed to hash password: %w", err)
+	// Hash the password, accounts created through an identity provider have none
+	if user.Password != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %w", err)
+		}
+		user.Password = string(hashedPassword)
 	}
-	user.Password = string(hashedPassword)
 
 	// Create the user
 	if err := r.db.Create(user).Error; err != nil {
@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"errors"
+	"own-paynet/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type WatcherCheckpointRepository struct {
+	db *gorm.DB
+}
+
+func NewWatcherCheckpointRepository(db *gorm.DB) *WatcherCheckpointRepository {
+	return &WatcherCheckpointRepository{db: db}
+}
+
+// Get returns the block hash a watcher last processed, or an empty string if it has not run yet
+func (r *WatcherCheckpointRepository) Get(name string) (string, error) {
+	var checkpoint models.WatcherCheckpoint
+	err := r.db.Where("name = ?", name).First(&checkpoint).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return checkpoint.BlockHash, nil
+}
+
+// Save records the block hash a watcher has processed up to
+func (r *WatcherCheckpointRepository) Save(name, blockHash string) error {
+	checkpoint := models.WatcherCheckpoint{Name: name, BlockHash: blockHash}
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"block_hash", "updated_at"}),
+	}).Create(&checkpoint).Error
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"own-paynet/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// WebhookDeliveryRepository is the durable queue of outgoing webhooks and
+// the log of attempts to send them
+type WebhookDeliveryRepository struct {
+	db *gorm.DB
+}
+
+func NewWebhookDeliveryRepository(db *gorm.DB) *WebhookDeliveryRepository {
+	return &WebhookDeliveryRepository{db: db}
+}
+
+// CreateIfMissing queues deliveries, skipping events already queued for an endpoint
+func (r *WebhookDeliveryRepository) CreateIfMissing(deliveries []models.WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "endpoint_id"}, {Name: "event_id"}},
+		DoNothing: true,
+	}).Create(&deliveries).Error
+}
+
+// ClaimDue takes up to limit pending deliveries whose next attempt is due and
+// pushes their next attempt back by lease, so other workers skip them while
+// they are being sent. A worker that dies mid-send leaves the delivery to be
+// retried once the lease runs out.
+func (r *WebhookDeliveryRepository) ClaimDue(now time.Time, lease time.Duration, limit int) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+	err := r.db.Raw(`UPDATE webhook_deliveries SET next_attempt_at = ?, updated_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		now.Add(lease), now, models.WebhookDeliveryPending, now, limit).Scan(&deliveries).Error
+	return deliveries, err
+}
+
+// RecordAttempt logs an attempt and saves the delivery's resulting status and schedule
+func (r *WebhookDeliveryRepository) RecordAttempt(delivery *models.WebhookDelivery, attempt *models.WebhookAttempt) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(attempt).Error; err != nil {
+			return err
+		}
+		return tx.Model(delivery).Updates(map[string]interface{}{
+			"status":          delivery.Status,
+			"attempts":        delivery.Attempts,
+			"next_attempt_at": delivery.NextAttemptAt,
+			"last_attempt_at": delivery.LastAttemptAt,
+		}).Error
+	})
+}
+
+// Requeue schedules a delivery to be sent again right away with a fresh set of retries
+func (r *WebhookDeliveryRepository) Requeue(id uint, now time.Time) error {
+	return r.db.Model(&models.WebhookDelivery{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":          models.WebhookDeliveryPending,
+		"attempts":        0,
+		"next_attempt_at": now,
+	}).Error
+}
+
+func (r *WebhookDeliveryRepository) FindByID(id uint) (*models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	err := r.db.First(&delivery, id).Error
+	return &delivery, err
+}
+
+// FindByEndpointID retrieves the most recent deliveries to an endpoint
+func (r *WebhookDeliveryRepository) FindByEndpointID(endpointID uint, limit int) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+	err := r.db.Where("endpoint_id = ?", endpointID).Order("id DESC").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+// FindAttempts retrieves the attempts made for a delivery, oldest first
+func (r *WebhookDeliveryRepository) FindAttempts(deliveryID uint) ([]models.WebhookAttempt, error) {
+	var attempts []models.WebhookAttempt
+	err := r.db.Where("delivery_id = ?", deliveryID).Order("id").Find(&attempts).Error
+	return attempts, err
+}
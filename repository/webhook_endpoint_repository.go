@@ -0,0 +1,53 @@
+package repository
+
+import (
+	"own-paynet/models"
+
+	"gorm.io/gorm"
+)
+
+type WebhookEndpointRepository struct {
+	db *gorm.DB
+}
+
+func NewWebhookEndpointRepository(db *gorm.DB) *WebhookEndpointRepository {
+	return &WebhookEndpointRepository{db: db}
+}
+
+func (r *WebhookEndpointRepository) Create(endpoint *models.WebhookEndpoint) error {
+	return r.db.Create(endpoint).Error
+}
+
+func (r *WebhookEndpointRepository) FindByID(id uint) (*models.WebhookEndpoint, error) {
+	var endpoint models.WebhookEndpoint
+	err := r.db.First(&endpoint, id).Error
+	return &endpoint, err
+}
+
+// FindByUserID retrieves all webhook endpoints of a user
+func (r *WebhookEndpointRepository) FindByUserID(userID uint) ([]models.WebhookEndpoint, error) {
+	var endpoints []models.WebhookEndpoint
+	err := r.db.Where("user_id = ?", userID).Order("id").Find(&endpoints).Error
+	return endpoints, err
+}
+
+// FindActiveByUserID retrieves the endpoints of a user that receive events
+func (r *WebhookEndpointRepository) FindActiveByUserID(userID uint) ([]models.WebhookEndpoint, error) {
+	var endpoints []models.WebhookEndpoint
+	err := r.db.Where("user_id = ? AND is_active = ?", userID, true).Find(&endpoints).Error
+	return endpoints, err
+}
+
+// Update saves the editable fields of an endpoint
+func (r *WebhookEndpointRepository) Update(endpoint *models.WebhookEndpoint) error {
+	return r.db.Model(endpoint).Updates(map[string]interface{}{
+		"url":         endpoint.URL,
+		"description": endpoint.Description,
+		"events":      endpoint.Events,
+		"is_active":   endpoint.IsActive,
+	}).Error
+}
+
+func (r *WebhookEndpointRepository) Delete(id uint) error {
+	return r.db.Delete(&models.WebhookEndpoint{}, id).Error
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"own-paynet/database"
+	"own-paynet/models"
+	"strconv"
+	"time"
+)
+
+const (
+	// signatureTolerance is how far a request timestamp may drift from server time
+	signatureTolerance = 5 * time.Minute
+	// maxNonceLength keeps client supplied nonces from bloating Redis keys
+	maxNonceLength = 128
+)
+
+var (
+	ErrInvalidAPIKey    = errors.New("invalid API key")
+	ErrInvalidSignature = errors.New("invalid request signature")
+	ErrRequestExpired   = errors.New("request timestamp is outside the allowed window")
+	ErrInvalidNonce     = errors.New("request nonce is missing or too long")
+	ErrReplayedRequest  = errors.New("request nonce has already been used")
+	ErrIPNotAllowed     = errors.New("API key is not allowed from this IP address")
+)
+
+// SignedRequest is a server-to-server request signed with an API key. The
+// signature is the hex encoded HMAC-SHA256, keyed with the signing key, of
+//
+//	METHOD\nPATH\nTIMESTAMP\nNONCE\nhex(sha256(BODY))
+//
+// where PATH includes the query string and TIMESTAMP is in Unix seconds.
+// The signing key is hex(sha256(secret key)), which lets the server verify
+// signatures while storing only the hash of the secret.
+type SignedRequest struct {
+	PublicKey string
+	ClientIP  string
+	Timestamp string
+	Nonce     string
+	Signature string
+	Method    string
+	Path      string
+	Body      []byte
+}
+
+// StringToSign returns the canonical form of the request that gets signed
+func (r *SignedRequest) StringToSign() string {
+	bodyHash := sha256.Sum256(r.Body)
+	return fmt.Sprintf("%s\n%s\n%s\n%s\n%s", r.Method, r.Path, r.Timestamp, r.Nonce, hex.EncodeToString(bodyHash[:]))
+}
+
+// AuthenticateRequest verifies the signature, freshness and nonce of a signed
+// request and returns the API key it was signed with
+func (s *APIKeyService) AuthenticateRequest(ctx context.Context, req *SignedRequest) (*models.APIKey, error) {
+	apiKey, err := s.apiKeyRepo.GetByPublicKey(req.PublicKey)
+	if err != nil {
+		return nil, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if !apiKey.IsActive(now) {
+		return nil, ErrAPIKeyDisabled
+	}
+
+	timestamp, err := strconv.ParseInt(req.Timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrRequestExpired
+	}
+	if drift := now.Sub(time.Unix(timestamp, 0)); drift > signatureTolerance || drift < -signatureTolerance {
+		return nil, ErrRequestExpired
+	}
+
+	if req.Nonce == "" || len(req.Nonce) > maxNonceLength {
+		return nil, ErrInvalidNonce
+	}
+
+	if !s.verifySignature(apiKey, []byte(req.StringToSign()), req.Signature, now) {
+		return nil, ErrInvalidSignature
+	}
+
+	// Checked after the signature so that the log only records requests
+	// made by someone holding the secret
+	clientIP, err := netip.ParseAddr(req.ClientIP)
+	if err != nil || !apiKey.AllowsIP(clientIP) {
+		log.Printf("rejected API key %d request from disallowed address %s", apiKey.ID, req.ClientIP)
+		return nil, ErrIPNotAllowed
+	}
+
+	// Only reserve the nonce once the signature is valid, so unsigned
+	// requests cannot burn nonces of legitimate clients. The nonce must
+	// outlive the timestamp window on both sides.
+	fresh, err := database.ReserveRequestNonce(ctx, apiKey.PublicKey, req.Nonce, 2*signatureTolerance)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, ErrReplayedRequest
+	}
+
+	if err := s.apiKeyRepo.UpdateLastUsed(apiKey.ID); err != nil {
+		log.Printf("failed to update last use of API key %d: %v", apiKey.ID, err)
+	}
+
+	return apiKey, nil
+}
@@ -0,0 +1,41 @@
+package services
+
+import "testing"
+
+func TestSignedRequestStringToSign(t *testing.T) {
+	tests := []struct {
+		name string
+		req  SignedRequest
+		want string
+	}{
+		{
+			name: "empty body",
+			req:  SignedRequest{Method: "GET", Path: "/api/v1/payments", Timestamp: "1700000000", Nonce: "n1"},
+			want: "GET\n/api/v1/payments\n1700000000\nn1\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{
+			name: "body and query string",
+			req: SignedRequest{
+				Method: "POST", Path: "/api/v1/payments?expand=wallet", Timestamp: "1700000001", Nonce: "n2",
+				Body: []byte("abc"),
+			},
+			want: "POST\n/api/v1/payments?expand=wallet\n1700000001\nn2\nba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		},
+		{
+			name: "key and client are not signed",
+			req: SignedRequest{
+				PublicKey: "pk_test", ClientIP: "203.0.113.7", Signature: "ignored",
+				Method: "GET", Path: "/", Timestamp: "1", Nonce: "n3",
+			},
+			want: "GET\n/\n1\nn3\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.StringToSign(); got != tt.want {
+				t.Fatalf("StringToSign() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"log"
+	"own-paynet/config"
+	"own-paynet/repository"
+	"own-paynet/utils/email"
+	"time"
+)
+
+// apiKeyExpiryInterval is how often the worker checks for expiring keys
+const apiKeyExpiryInterval = time.Hour
+
+// APIKeyExpiryWorker disables expired API keys, forgets rotated-out secrets
+// after their grace period and warns owners before their keys expire
+type APIKeyExpiryWorker struct {
+	apiKeyRepo   *repository.APIKeyRepository
+	userRepo     *repository.UserRepository
+	emailService *email.EmailService
+	noticePeriod time.Duration
+}
+
+func NewAPIKeyExpiryWorker(apiKeyRepo *repository.APIKeyRepository, userRepo *repository.UserRepository, emailService *email.EmailService, cfg *config.Config) *APIKeyExpiryWorker {
+	return &APIKeyExpiryWorker{
+		apiKeyRepo:   apiKeyRepo,
+		userRepo:     userRepo,
+		emailService: emailService,
+		noticePeriod: time.Duration(cfg.APIKeyExpiryNoticeDays) * 24 * time.Hour,
+	}
+}
+
+// Run checks API keys until the context is cancelled
+func (w *APIKeyExpiryWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(apiKeyExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		w.runOnce()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *APIKeyExpiryWorker) runOnce() {
+	now := time.Now()
+
+	disabled, err := w.apiKeyRepo.DisableExpired(now)
+	if err != nil {
+		log.Printf("failed to disable expired API keys: %v", err)
+	} else if disabled > 0 {
+		log.Printf("disabled %d expired API keys", disabled)
+	}
+
+	if err := w.apiKeyRepo.ClearExpiredPreviousSecrets(now); err != nil {
+		log.Printf("failed to clear rotated API key secrets: %v", err)
+	}
+
+	expiring, err := w.apiKeyRepo.GetExpiringUnnotified(now.Add(w.noticePeriod))
+	if err != nil {
+		log.Printf("failed to find expiring API keys: %v", err)
+		return
+	}
+	for _, apiKey := range expiring {
+		user, err := w.userRepo.FindByID(apiKey.UserID)
+		if err != nil {
+			log.Printf("failed to find owner of API key %d: %v", apiKey.ID, err)
+			continue
+		}
+		if err := w.emailService.SendAPIKeyExpiryEmail(user.Email, apiKey.Description, apiKey.PublicKey, *apiKey.ExpiresAt); err != nil {
+			log.Printf("failed to send expiry notice for API key %d: %v", apiKey.ID, err)
+			continue
+		}
+		if err := w.apiKeyRepo.MarkExpiryNotified(apiKey.ID, now); err != nil {
+			log.Printf("failed to record expiry notice for API key %d: %v", apiKey.ID, err)
+		}
+	}
+}
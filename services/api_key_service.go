@@ -1,24 +1,32 @@
 package services
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/netip"
+	"own-paynet/config"
 	"own-paynet/models"
 	"own-paynet/repository"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type APIKeyService struct {
-	apiKeyRepo *repository.APIKeyRepository
+	apiKeyRepo    *repository.APIKeyRepository
+	rotationGrace time.Duration
 }
 
-func NewAPIKeyService(apiKeyRepo *repository.APIKeyRepository) *APIKeyService {
+func NewAPIKeyService(apiKeyRepo *repository.APIKeyRepository, cfg *config.Config) *APIKeyService {
 	return &APIKeyService{
-		apiKeyRepo: apiKeyRepo,
+		apiKeyRepo:    apiKeyRepo,
+		rotationGrace: time.Duration(cfg.APIKeyRotationGrace) * time.Hour,
 	}
 }
 
@@ -69,12 +77,32 @@ func (s *APIKeyService) ensureUniqueKeys(publicKey, _ string) error {
 		return errors.New("public key collision detected")
 	}
 
-	// Check if secret key exists (you might need to add this method to your repository)
-	// For now, we'll rely on the database unique constraint
+	// Secret keys are only stored hashed, so rely on the unique index on the hash
 	return nil
 }
 
-func (s *APIKeyService) GenerateAPIKey(userID uint, description string) (*models.APIKey, error) {
+var (
+	ErrInvalidScope     = errors.New("invalid API key scope")
+	ErrInvalidKeyExpiry = errors.New("API key expiry must be in the future")
+	ErrAPIKeyNotFound   = errors.New("API key not found")
+	ErrAPIKeyDisabled   = errors.New("API key is disabled or expired")
+	ErrInvalidCIDR      = errors.New("invalid IP address or CIDR range")
+)
+
+// maxAllowedCIDRs caps the size of a key's IP allowlist
+const maxAllowedCIDRs = 50
+
+// GenerateAPIKey creates an API key with the given scopes, or every scope if
+// none are given. Keys without an expiry never expire.
+func (s *APIKeyService) GenerateAPIKey(userID uint, description string, scopes []string, expiresAt *time.Time) (*models.APIKey, error) {
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, ErrInvalidKeyExpiry
+	}
+
 	// Generate unique public and secret keys
 	publicKey, err := s.generateUniquePublicKey()
 	if err != nil {
@@ -100,20 +128,98 @@ func (s *APIKeyService) GenerateAPIKey(userID uint, description string) (*models
 	isDefault := len(existingKeys) == 0
 
 	apiKey := &models.APIKey{
-		UserID:      userID,
-		PublicKey:   publicKey,
-		SecretKey:   secretKey,
-		IsDefault:   isDefault,
-		Description: description,
+		UserID:       userID,
+		PublicKey:    publicKey,
+		SecretHash:   hashSecretKey(secretKey),
+		SecretPrefix: secretKeyPrefix(secretKey),
+		IsDefault:    isDefault,
+		Description:  description,
+		Scopes:       strings.Join(scopes, ","),
+		ExpiresAt:    expiresAt,
 	}
 
 	if err := s.apiKeyRepo.Create(apiKey); err != nil {
 		return nil, fmt.Errorf("failed to create API key: %v", err)
 	}
 
+	// Hand the secret back to the caller once, it cannot be recovered later
+	apiKey.SecretKey = secretKey
+
 	return apiKey, nil
 }
 
+// normalizeScopes validates requested scopes, removing duplicates
+func normalizeScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return models.AllScopes, nil
+	}
+
+	for _, requested := range scopes {
+		if !containsString(models.AllScopes, requested) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidScope, requested)
+		}
+	}
+
+	var normalized []string
+	for _, scope := range models.AllScopes {
+		if containsString(scopes, scope) {
+			normalized = append(normalized, scope)
+		}
+	}
+	return normalized, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySignature reports whether signature is the HMAC of stringToSign keyed
+// with one of the secret hashes the key currently accepts: its current one,
+// or its previous one while the rotation grace period lasts. Clients derive
+// the same signing key from their secret, so the secret itself never has to
+// be stored.
+func (s *APIKeyService) verifySignature(apiKey *models.APIKey, stringToSign []byte, signature string, now time.Time) bool {
+	for _, signingKey := range validSecretHashes(apiKey, now) {
+		mac := hmac.New(sha256.New, []byte(signingKey))
+		mac.Write(stringToSign)
+		expected := hex.EncodeToString(mac.Sum(nil))
+		if hmac.Equal([]byte(expected), []byte(signature)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validSecretHashes returns the secret hashes a key currently accepts
+func validSecretHashes(apiKey *models.APIKey, now time.Time) []string {
+	hashes := []string{apiKey.SecretHash}
+	if apiKey.PreviousSecretHash != "" && apiKey.PreviousSecretExpiresAt != nil && now.Before(*apiKey.PreviousSecretExpiresAt) {
+		hashes = append(hashes, apiKey.PreviousSecretHash)
+	}
+	return hashes
+}
+
+// hashSecretKey returns the hex encoded SHA-256 of a secret key. Secret keys
+// are random, so a fast unsalted hash is enough to protect them at rest.
+func hashSecretKey(secretKey string) string {
+	sum := sha256.Sum256([]byte(secretKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// secretKeyPrefix returns the part of a secret key that is kept visible so
+// users can tell their keys apart
+func secretKeyPrefix(secretKey string) string {
+	if len(secretKey) <= 11 {
+		return secretKey
+	}
+	return secretKey[:11]
+}
+
 func (s *APIKeyService) GetUserAPIKeys(userID uint) ([]models.APIKey, error) {
 	return s.apiKeyRepo.GetByUserID(userID)
 }
@@ -143,6 +249,128 @@ func (s *APIKeyService) DeleteAPIKey(userID uint, apiKeyID uint) error {
 	return s.apiKeyRepo.Delete(apiKeyID)
 }
 
+// RotateAPIKey issues a new secret for a key. The previous secret keeps
+// working for the configured grace period so clients can be updated without
+// downtime. The new secret is only returned here.
+func (s *APIKeyService) RotateAPIKey(userID uint, apiKeyID uint) (*models.APIKey, error) {
+	apiKey, err := s.getOwnedKey(userID, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+	if !apiKey.IsActive(time.Now()) {
+		return nil, ErrAPIKeyDisabled
+	}
+
+	secretKey, err := s.generateUniqueSecretKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate secret key: %v", err)
+	}
+
+	graceUntil := time.Now().Add(s.rotationGrace)
+	if err := s.apiKeyRepo.Rotate(apiKey.ID, hashSecretKey(secretKey), secretKeyPrefix(secretKey), graceUntil); err != nil {
+		return nil, fmt.Errorf("failed to rotate API key: %v", err)
+	}
+
+	apiKey.PreviousSecretHash = apiKey.SecretHash
+	apiKey.PreviousSecretExpiresAt = &graceUntil
+	apiKey.SecretHash = hashSecretKey(secretKey)
+	apiKey.SecretPrefix = secretKeyPrefix(secretKey)
+	apiKey.SecretKey = secretKey
+
+	return apiKey, nil
+}
+
+// GetAllowedCIDRs returns the networks a key may be used from
+func (s *APIKeyService) GetAllowedCIDRs(userID uint, apiKeyID uint) ([]string, error) {
+	apiKey, err := s.getOwnedKey(userID, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return apiKey.CIDRList(), nil
+}
+
+// SetAllowedCIDRs replaces the networks a key may be used from. An empty
+// list lets the key be used from anywhere.
+func (s *APIKeyService) SetAllowedCIDRs(userID uint, apiKeyID uint, cidrs []string) ([]string, error) {
+	apiKey, err := s.getOwnedKey(userID, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return s.saveAllowedCIDRs(apiKey, cidrs)
+}
+
+// AddAllowedCIDR adds a network to a key's allowlist
+func (s *APIKeyService) AddAllowedCIDR(userID uint, apiKeyID uint, cidr string) ([]string, error) {
+	apiKey, err := s.getOwnedKey(userID, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return s.saveAllowedCIDRs(apiKey, append(apiKey.CIDRList(), cidr))
+}
+
+// RemoveAllowedCIDR removes a network from a key's allowlist
+func (s *APIKeyService) RemoveAllowedCIDR(userID uint, apiKeyID uint, cidr string) ([]string, error) {
+	apiKey, err := s.getOwnedKey(userID, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := parseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	var remaining []string
+	for _, existing := range apiKey.CIDRList() {
+		if existing != prefix.String() {
+			remaining = append(remaining, existing)
+		}
+	}
+	return s.saveAllowedCIDRs(apiKey, remaining)
+}
+
+func (s *APIKeyService) saveAllowedCIDRs(apiKey *models.APIKey, cidrs []string) ([]string, error) {
+	normalized := []string{}
+	for _, cidr := range cidrs {
+		prefix, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if !containsString(normalized, prefix.String()) {
+			normalized = append(normalized, prefix.String())
+		}
+	}
+	if len(normalized) > maxAllowedCIDRs {
+		return nil, fmt.Errorf("%w: at most %d ranges are allowed", ErrInvalidCIDR, maxAllowedCIDRs)
+	}
+
+	if err := s.apiKeyRepo.UpdateAllowedCIDRs(apiKey.ID, strings.Join(normalized, ",")); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+// parseCIDR parses a CIDR range, treating a bare address as a single host
+func parseCIDR(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if addr, err := netip.ParseAddr(value); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%w: %s", ErrInvalidCIDR, value)
+	}
+	return prefix.Masked(), nil
+}
+
+func (s *APIKeyService) getOwnedKey(userID uint, apiKeyID uint) (*models.APIKey, error) {
+	apiKey, err := s.apiKeyRepo.GetByID(apiKeyID)
+	if err != nil || apiKey.UserID != userID {
+		return nil, ErrAPIKeyNotFound
+	}
+	return apiKey, nil
+}
+
 func (s *APIKeyService) UpdateLastUsed(apiKeyID uint) error {
 	return s.apiKeyRepo.UpdateLastUsed(apiKeyID)
 }
@@ -3,6 +3,7 @@ package services
 import (
 	"context"
 	"errors"
+	"log"
 	"own-paynet/database"
 	"own-paynet/models"
 	"own-paynet/repository"
@@ -19,37 +20,87 @@ type AuthService struct {
 	emailService        *email.EmailService
 	apiKeyService       *APIKeyService
 	payoutWalletService *PayoutWalletService
+	sessionService      *SessionService
+	twoFactorService    *TwoFactorService
 }
 
-func NewAuthService(repo *repository.UserRepository, emailService *email.EmailService, apiKeyService *APIKeyService, payoutWalletService *PayoutWalletService) *AuthService {
+// SigninResult is the outcome of a successful credential check. Either Tokens
+// is set, or the account has 2FA enabled and ChallengeToken has to be
+// exchanged through VerifySignin2FA to obtain a session.
+type SigninResult struct {
+	Tokens         *TokenPair
+	MFARequired    bool
+	ChallengeToken string
+	MFAMethods     []string
+}
+
+var ErrInvalid2FACode = errors.New("invalid 2FA code")
+
+func NewAuthService(repo *repository.UserRepository, emailService *email.EmailService, apiKeyService *APIKeyService, payoutWalletService *PayoutWalletService, sessionService *SessionService, twoFactorService *TwoFactorService) *AuthService {
 	return &AuthService{
 		repo:                repo,
 		emailService:        emailService,
 		apiKeyService:       apiKeyService,
 		payoutWalletService: payoutWalletService,
+		sessionService:      sessionService,
+		twoFactorService:    twoFactorService,
 	}
 }
 
-func (s *AuthService) Signup(email, password string) error {
+// Signup creates an account. When an account extended public key is given,
+// the default BTC payout wallet is created from it; otherwise the merchant
+// adds a payout wallet later.
+func (s *AuthService) Signup(email, password, extendedPublicKey string) error {
 	// Check if user already exists
 	existingUser, err := s.repo.FindByEmail(email)
 	if err == nil && existingUser != nil {
 		return errors.New("an account with this email already exists")
 	}
+	if extendedPublicKey != "" {
+		if err := s.payoutWalletService.ValidateExtendedPublicKey(extendedPublicKey); err != nil {
+			return err
+		}
+	}
+
+	user := &models.User{
+		Email:    email,
+		Password: password,
+	}
+	if err := s.createAccount(user, extendedPublicKey); err != nil {
+		return err
+	}
+
+	// Generate verification token
+	token := utils.GenerateRandomToken(32)
+
+	// Store token in Redis with 24 hours expiry
+	ctx := context.Background()
+	err = database.StoreEmailVerificationToken(ctx, email, token, 24*time.Hour)
+	if err != nil {
+		return errors.New("unable to generate verification token, please try again later")
+	}
+
+	// Send verification email
+	err = s.emailService.SendVerificationEmail(email, token)
+	if err != nil {
+		return errors.New("account created but unable to send verification email, please request a new verification email")
+	}
 
+	return nil
+}
+
+// createAccount creates a user together with their company, default API key
+// and, given an extended public key, default BTC wallet
+func (s *AuthService) createAccount(user *models.User, extendedPublicKey string) error {
 	// Create company first
 	company := &models.Company{}
-	err = database.DB.Create(company).Error
+	err := database.DB.Create(company).Error
 	if err != nil {
 		return errors.New("unable to create company at this time, please try again later")
 	}
 
 	// Create user with company relationship
-	user := &models.User{
-		Email:     email,
-		Password:  password,
-		CompanyID: company.ID,
-	}
+	user.CompanyID = company.ID
 	err = s.repo.Create(user)
 	if err != nil {
 		// Handle database-specific errors with user-friendly messages
@@ -60,58 +111,43 @@ func (s *AuthService) Signup(email, password string) error {
 	}
 
 	// Generate default API key for the new user
-	_, err = s.apiKeyService.GenerateAPIKey(user.ID, "Default API Key")
+	_, err = s.apiKeyService.GenerateAPIKey(user.ID, "Default API Key", nil, nil)
 	if err != nil {
-		// Log the error but don't fail the signup process
-		// The user can generate a new API key later
-		// TODO: Add proper logging here
+		// Don't fail the signup process, the user can generate a new API key later
+		log.Printf("failed to create default API key for user %d: %v", user.ID, err)
 	}
 
 	// Create default BTC wallet for the new user
-	_, err = s.payoutWalletService.CreateDefaultBTCWallet(user.ID)
-	if err != nil {
-		// Log the error but don't fail the signup process
-		// The user can create a new wallet later
-		// TODO: Add proper logging here
-	}
-
-	// Generate verification token
-	token := utils.GenerateRandomToken(32)
-
-	// Store token in Redis with 24 hours expiry
-	ctx := context.Background()
-	err = database.StoreEmailVerificationToken(ctx, email, token, 24*time.Hour)
-	if err != nil {
-		return errors.New("unable to generate verification token, please try again later")
-	}
-
-	// Send verification email
-	err = s.emailService.SendVerificationEmail(email, token)
-	if err != nil {
-		return errors.New("account created but unable to send verification email, please request a new verification email")
+	if extendedPublicKey != "" {
+		_, err = s.payoutWalletService.CreateDefaultBTCWallet(user.ID, extendedPublicKey)
+		if err != nil {
+			// Don't fail the signup process, the user can create a new wallet later
+			log.Printf("failed to create default BTC wallet for user %d: %v", user.ID, err)
+		}
 	}
 
 	return nil
 }
-func (s *AuthService) Signin(email, password string) (string, *models.User, error) {
+
+func (s *AuthService) Signin(email, password string, meta SessionMetadata) (*SigninResult, *models.User, error) {
 	// Check if user exists
 	user, err := s.repo.FindByEmail(email)
 	if err != nil {
 		if err == gorm.ErrRecordNotFound {
-			return "", nil, errors.New("user not found")
+			return nil, nil, errors.New("user not found")
 		}
-		return "", nil, errors.New("failed to find user")
+		return nil, nil, errors.New("failed to find user")
 	}
 
 	// Verify password
 	if errCompare := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); errCompare != nil {
-		return "", nil, errors.New("invalid credentials")
+		return nil, nil, errors.New("invalid credentials")
 	}
 
 	// Check if email is verified
 	verified, err := s.repo.IsEmailVerified(email)
 	if err != nil {
-		return "", nil, errors.New("failed to check email verification status")
+		return nil, nil, errors.New("failed to check email verification status")
 	}
 
 	if !verified {
@@ -122,34 +158,103 @@ func (s *AuthService) Signin(email, password string) (string, *models.User, erro
 		ctx := context.Background()
 		err = database.StoreEmailVerificationToken(ctx, email, token, 24*time.Hour)
 		if err != nil {
-			return "", nil, errors.New("failed to generate verification token")
+			return nil, nil, errors.New("failed to generate verification token")
 		}
 
 		// Send verification email
 		err = s.emailService.SendVerificationEmail(email, token)
 		if err != nil {
-			return "", nil, errors.New("failed to send verification email")
+			return nil, nil, errors.New("failed to send verification email")
+		}
+
+		return nil, nil, errors.New("email not verified - please check your inbox for a new verification email and follow the instructions to verify your account")
+	}
+
+	result, err := s.completeSignin(user, meta)
+	if err != nil {
+		return nil, nil, errors.New("failed to generate authentication token")
+	}
+
+	return result, user, nil
+}
+
+// completeSignin starts a session for a user who has proven who they are, or
+// issues a 2FA challenge first if the account has 2FA enabled
+func (s *AuthService) completeSignin(user *models.User, meta SessionMetadata) (*SigninResult, error) {
+	if !user.Email2FAEnabled && !user.Authenticator2FAEnabled {
+		tokens, err := s.sessionService.CreateSession(user.ID, meta)
+		if err != nil {
+			return nil, err
+		}
+		return &SigninResult{Tokens: tokens}, nil
+	}
+
+	challengeToken, err := s.sessionService.CreateMFAChallenge(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SigninResult{MFARequired: true, ChallengeToken: challengeToken}
+	if user.Authenticator2FAEnabled {
+		result.MFAMethods = append(result.MFAMethods, "authenticator")
+	}
+	if user.Email2FAEnabled {
+		result.MFAMethods = append(result.MFAMethods, "email")
+		// A recently sent code is still valid, so being rate limited here is not an error
+		if err := s.twoFactorService.SendOTP(user.ID); err != nil {
+			log.Printf("failed to send sign-in OTP to user %d: %v", user.ID, err)
 		}
+	}
+	result.MFAMethods = append(result.MFAMethods, "backup_code")
+
+	return result, nil
+}
+
+// VerifySignin2FA exchanges a 2FA challenge token and a TOTP, email OTP or
+// backup code for a session
+func (s *AuthService) VerifySignin2FA(challengeToken, code string, meta SessionMetadata) (*TokenPair, *models.User, error) {
+	userID, challengeID, err := s.sessionService.CheckMFAChallenge(challengeToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	valid, err := s.twoFactorService.Verify2FA(userID, code)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !valid {
+		return nil, nil, ErrInvalid2FACode
+	}
+
+	if err := s.sessionService.CompleteMFAChallenge(challengeID); err != nil {
+		return nil, nil, err
+	}
 
-		return "", nil, errors.New("email not verified - please check your inbox for a new verification email and follow the instructions to verify your account")
+	user, err := s.repo.FindByID(userID)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Generate JWT token
-	token, err := utils.GenerateJWT(user.ID)
+	tokens, err := s.sessionService.CreateSession(userID, meta)
 	if err != nil {
-		return "", nil, errors.New("failed to generate authentication token")
+		return nil, nil, err
 	}
 
-	return token, user, nil
+	return tokens, user, nil
 }
 
 func (s *AuthService) ResetPassword(email, newPassword string) error {
 	return s.repo.UpdatePassword(email, newPassword)
 }
 
-// Logout invalidates a user's token
-func (s *AuthService) Logout(userID uint) error {
-	return utils.InvalidateToken(userID)
+// RefreshSession exchanges a refresh token for a new token pair
+func (s *AuthService) RefreshSession(refreshToken string, meta SessionMetadata) (*TokenPair, error) {
+	return s.sessionService.Refresh(refreshToken, meta)
+}
+
+// Logout ends the session the request was made from
+func (s *AuthService) Logout(userID uint, sessionID string) error {
+	return s.sessionService.Revoke(userID, sessionID)
 }
 
 // RequestPasswordReset generates a reset token and stores it in Redis
@@ -203,6 +308,15 @@ func (s *AuthService) ResetPasswordWithToken(email, token, newPassword string) e
 		return err
 	}
 
+	// Sign out every device, the old password may have been compromised
+	user, err := s.repo.FindByEmail(email)
+	if err != nil {
+		return err
+	}
+	if err := s.sessionService.RevokeAll(user.ID); err != nil {
+		return err
+	}
+
 	// Delete token after successful password reset
 	ctx := context.Background()
 	return database.DeletePasswordResetToken(ctx, email)
@@ -268,42 +382,3 @@ func (s *AuthService) ResendVerificationEmail(email string) error {
 	// Send verification email
 	return s.emailService.SendVerificationEmail(email, token)
 }
-
-// HandleGoogleUser handles authentication for Google OAuth users
-func (s *AuthService) HandleGoogleUser(email, name, googleID, avatar, locale string) (string, *models.User, error) {
-	// Check if user exists
-	user, err := s.repo.FindByEmail(email)
-	if err != nil {
-		// If user doesn't exist, create new user
-		user = &models.User{
-			Email:         email,
-			Name:          name,
-			GoogleID:      googleID,
-			Avatar:        avatar,
-			Locale:        locale,
-			EmailVerified: true, // Google emails are pre-verified
-		}
-		if err := s.repo.Create(user); err != nil {
-			return "", nil, err
-		}
-	} else {
-		// Update Google info if not set
-		if user.GoogleID == "" {
-			user.GoogleID = googleID
-			user.Name = name
-			user.Avatar = avatar
-			user.Locale = locale
-			if err := s.repo.Update(user); err != nil {
-				return "", nil, err
-			}
-		}
-	}
-
-	// Generate JWT token
-	token, err := utils.GenerateJWT(user.ID)
-	if err != nil {
-		return "", nil, err
-	}
-
-	return token, user, nil
-}
@@ -0,0 +1,45 @@
+package bitcoin
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// Address errors
+var (
+	ErrInvalidAddress = errors.New("invalid bitcoin address")
+	ErrAddressNetwork = errors.New("bitcoin address is for a different network")
+)
+
+// ValidateAddress checks that address is a P2PKH, P2SH, P2WPKH, P2WSH or
+// P2TR address for net. Testnet and regtest share legacy address prefixes,
+// so only their bech32 addresses tell the two apart.
+func ValidateAddress(address string, net *chaincfg.Params) error {
+	decoded, err := btcutil.DecodeAddress(address, net)
+	if err != nil {
+		// Name the network if the address is valid elsewhere
+		for _, other := range []*chaincfg.Params{&chaincfg.MainNetParams, &chaincfg.TestNet3Params, &chaincfg.RegressionNetParams} {
+			if other.Net == net.Net {
+				continue
+			}
+			if _, otherErr := btcutil.DecodeAddress(address, other); otherErr == nil {
+				return fmt.Errorf("%w: expected a %s address", ErrAddressNetwork, net.Name)
+			}
+		}
+		return fmt.Errorf("%w: %v", ErrInvalidAddress, err)
+	}
+	if !decoded.IsForNet(net) {
+		return fmt.Errorf("%w: expected a %s address", ErrAddressNetwork, net.Name)
+	}
+	// DecodeAddress also accepts hex encoded public keys
+	switch decoded.(type) {
+	case *btcutil.AddressPubKeyHash, *btcutil.AddressScriptHash, *btcutil.AddressWitnessPubKeyHash,
+		*btcutil.AddressWitnessScriptHash, *btcutil.AddressTaproot:
+		return nil
+	default:
+		return fmt.Errorf("%w: unsupported address type", ErrInvalidAddress)
+	}
+}
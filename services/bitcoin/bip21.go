@@ -0,0 +1,43 @@
+package bitcoin
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// PaymentRequest holds the fields of a BIP21 payment URI
+type PaymentRequest struct {
+	Address    string
+	AmountSats int64  // Left out of the URI if 0
+	Label      string // Name of the recipient
+	Message    string // Describes the payment
+}
+
+// URI encodes the request as bitcoin:<address>?amount=...&label=...&message=...
+func (r PaymentRequest) URI() string {
+	var params []string
+	if r.AmountSats > 0 {
+		params = append(params, "amount="+strconv.FormatFloat(btcutil.Amount(r.AmountSats).ToBTC(), 'f', -1, 64))
+	}
+	if r.Label != "" {
+		params = append(params, "label="+escapeBIP21(r.Label))
+	}
+	if r.Message != "" {
+		params = append(params, "message="+escapeBIP21(r.Message))
+	}
+
+	uri := "bitcoin:" + r.Address
+	if len(params) > 0 {
+		uri += "?" + strings.Join(params, "&")
+	}
+	return uri
+}
+
+// escapeBIP21 percent-encodes a value. Spaces become %20 rather than "+",
+// which BIP21 does not treat as a space.
+func escapeBIP21(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
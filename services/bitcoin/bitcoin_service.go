@@ -1,21 +1,29 @@
 package bitcoin
 
 import (
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"own-paynet/config"
 	"time"
 
-	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/rpcclient"
 )
 
 type BitcoinService struct {
-	client *rpcclient.Client
+	client    *rpcclient.Client
+	netParams *chaincfg.Params
 }
 
 func NewBitcoinService(cfg *config.Config) (*BitcoinService, error) {
+	netParams, err := NetParams(cfg.BitcoinNetwork)
+	if err != nil {
+		return nil, err
+	}
+
 	connCfg := &rpcclient.ConnConfig{
 		Host:         cfg.BitcoinRPCURL,
 		User:         cfg.BitcoinRPCUser,
@@ -29,7 +37,12 @@ func NewBitcoinService(cfg *config.Config) (*BitcoinService, error) {
 		return nil, err
 	}
 
-	return &BitcoinService{client: client}, nil
+	return &BitcoinService{client: client, netParams: netParams}, nil
+}
+
+// NetParams returns the parameters of the network set in BITCOIN_NETWORK
+func (s *BitcoinService) NetParams() *chaincfg.Params {
+	return s.netParams
 }
 
 func (s *BitcoinService) GenerateAddress() (string, error) {
@@ -40,60 +53,167 @@ func (s *BitcoinService) GenerateAddress() (string, error) {
 	return address.EncodeAddress(), nil
 }
 
-// MonitorAddress polls transactions and calls the callback when transactions are found.
-func (s *BitcoinService) MonitorAddress(address string, callback func(txID string, status string, confirmations int64), netParams *chaincfg.Params) error {
-	go func() {
-		for {
-			addr, err := btcutil.DecodeAddress(address, netParams)
-			if err != nil {
-				log.Printf("failed to decode address: %v", err)
-				time.Sleep(10 * time.Second)
-				continue
-			}
+// WatchAddress adds an address the node's wallet holds no key for as
+// watch-only, so payments to it show up in ListReceivedSince. Nothing is
+// rescanned, as the address has not been handed out before. Descriptor
+// wallets are tried first, then legacy ones.
+func (s *BitcoinService) WatchAddress(address string) error {
+	descriptor, err := json.Marshal("addr(" + address + ")")
+	if err != nil {
+		return err
+	}
+	rawInfo, err := s.client.RawRequest("getdescriptorinfo", []json.RawMessage{descriptor})
+	if err != nil {
+		return fmt.Errorf("failed to check descriptor: %w", err)
+	}
+	var info struct {
+		Checksum string `json:"checksum"`
+	}
+	if err := json.Unmarshal(rawInfo, &info); err != nil {
+		return err
+	}
 
-			txs, err := s.client.SearchRawTransactions(addr, 0, 10, true, nil)
-			if err != nil {
-				log.Printf("failed to search transactions: %v", err)
-				time.Sleep(10 * time.Second)
-				continue
-			}
+	request, err := json.Marshal([]map[string]interface{}{{
+		"desc":      "addr(" + address + ")#" + info.Checksum,
+		"timestamp": "now",
+	}})
+	if err != nil {
+		return err
+	}
+	rawResults, err := s.client.RawRequest("importdescriptors", []json.RawMessage{request})
+	if err != nil {
+		// Legacy wallets do not support descriptors
+		if legacyErr := s.client.ImportAddressRescan(address, "", false); legacyErr != nil {
+			return fmt.Errorf("failed to import address: %w", err)
+		}
+		return nil
+	}
 
-			for _, tx := range txs {
-				txID := tx.TxID()
-				status := "pending"
-				confirmations := int64(0)
-
-				txHash, err := chainhash.NewHashFromStr(txID)
-				if err != nil {
-					log.Printf("invalid tx hash: %v", err)
-					continue
-				}
-
-				txDetails, err := s.client.GetTransaction(txHash)
-				if err != nil {
-					log.Printf("failed to get transaction details: %v", err)
-					continue
-				}
-
-				confirmations = txDetails.Confirmations
-
-				// Update status based on confirmations
-				if confirmations >= 6 {
-					status = "confirmed" // 6 confirmations is considered secure for most transactions
-				} else if confirmations > 0 {
-					status = "pending_confirmation"
-				}
-
-				// Execute user-defined callback with confirmation count
-				callback(txID, status, confirmations)
+	var results []struct {
+		Success bool `json:"success"`
+		Error   *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rawResults, &results); err != nil {
+		return err
+	}
+	for _, result := range results {
+		if !result.Success {
+			if result.Error != nil {
+				return fmt.Errorf("failed to import address: %s", result.Error.Message)
 			}
+			return errors.New("failed to import address")
+		}
+	}
+	return nil
+}
 
-			// Sleep to avoid excessive polling
-			time.Sleep(60 * time.Second)
+// ReceivedTransaction is a wallet transaction output paying one of our addresses
+type ReceivedTransaction struct {
+	TxID          string
+	Vout          uint32
+	Address       string
+	Amount        float64 // BTC
+	Confirmations int64
+	BlockHash     string
+	SeenAt        time.Time // When the node received the transaction, or its block time if earlier
+}
+
+// ListReceivedSince returns the outputs received by the wallet in blocks after
+// blockHash, or all of them if blockHash is empty, together with the checkpoint
+// to pass on the next call. The checkpoint trails the chain tip by
+// targetConfirmations-1 blocks so that transactions which have not reached the
+// target yet are returned again, with their updated confirmations.
+func (s *BitcoinService) ListReceivedSince(blockHash string, targetConfirmations int) ([]ReceivedTransaction, string, error) {
+	var hash *chainhash.Hash
+	if blockHash != "" {
+		var err error
+		hash, err = chainhash.NewHashFromStr(blockHash)
+		if err != nil {
+			return nil, "", err
 		}
-	}()
+	}
 
-	return nil
+	// Include watch-only addresses derived from merchants' extended public keys
+	result, err := s.client.ListSinceBlockMinConfWatchOnly(hash, targetConfirmations, true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var received []ReceivedTransaction
+	for _, tx := range result.Transactions {
+		if tx.Category != "receive" || tx.Abandoned {
+			continue
+		}
+		received = append(received, ReceivedTransaction{
+			TxID:          tx.TxID,
+			Vout:          tx.Vout,
+			Address:       tx.Address,
+			Amount:        tx.Amount,
+			Confirmations: tx.Confirmations,
+			BlockHash:     tx.BlockHash,
+			SeenAt:        seenAt(tx.TimeReceived, tx.BlockTime),
+		})
+	}
+
+	return received, result.LastBlock, nil
+}
+
+// TransactionStatus is what the node knows about a wallet transaction
+type TransactionStatus struct {
+	Known         bool  // The wallet has the transaction
+	Confirmations int64 // Negative if it conflicts with a transaction in the chain
+	InMempool     bool  // Unconfirmed and still in the node's mempool
+}
+
+// GetTransactionStatus looks up a transaction paying one of the wallet's
+// addresses, including watch-only ones. Transactions that were replaced or
+// double-spent show negative confirmations, and ones evicted from the mempool
+// are unconfirmed but no longer in it.
+func (s *BitcoinService) GetTransactionStatus(txID string) (*TransactionStatus, error) {
+	txHash, err := chainhash.NewHashFromStr(txID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.client.GetTransactionWatchOnly(txHash, true)
+	if isNotFound(err) {
+		return &TransactionStatus{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status := &TransactionStatus{Known: true, Confirmations: tx.Confirmations}
+	if tx.Confirmations == 0 {
+		_, err := s.client.GetMempoolEntry(txID)
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+		status.InMempool = err == nil
+	}
+	return status, nil
+}
+
+// isNotFound reports whether an RPC failed because the transaction is unknown
+func isNotFound(err error) bool {
+	var rpcErr *btcjson.RPCError
+	return errors.As(err, &rpcErr) && rpcErr.Code == btcjson.ErrRPCInvalidAddressOrKey
+}
+
+// seenAt returns the earlier of the time the node received a transaction and
+// the time of the block it was mined in, both in Unix seconds, or now if the
+// node reported neither
+func seenAt(timeReceived, blockTime int64) time.Time {
+	seen := timeReceived
+	if blockTime > 0 && (seen <= 0 || blockTime < seen) {
+		seen = blockTime
+	}
+	if seen <= 0 {
+		return time.Now()
+	}
+	return time.Unix(seen, 0)
 }
 
 // GetTransactionConfirmations returns the number of confirmations for a transaction
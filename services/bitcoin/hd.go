@@ -0,0 +1,125 @@
+package bitcoin
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// Address types of extended public keys
+const (
+	AddressTypeP2PKH      = "p2pkh"       // BIP44, legacy 1... addresses
+	AddressTypeP2SHP2WPKH = "p2sh-p2wpkh" // BIP49, nested SegWit 3... addresses
+	AddressTypeP2WPKH     = "p2wpkh"      // BIP84, native SegWit bc1q... addresses
+)
+
+// accountDepth is the depth of account keys, m/purpose'/coin_type'/account'
+const accountDepth = 3
+
+// Extended public key errors
+var (
+	ErrInvalidExtendedKey = errors.New("invalid extended public key")
+	ErrExtendedKeyNetwork = errors.New("extended public key is for a different network")
+)
+
+// extendedKeyVersion describes the version prefix of a serialized extended public key
+type extendedKeyVersion struct {
+	addressType string
+	mainnet     bool
+}
+
+// extendedKeyVersions maps the SLIP-132 version bytes of public keys to the
+// address type they derive and their network
+var extendedKeyVersions = map[string]extendedKeyVersion{
+	"0488b21e": {AddressTypeP2PKH, true},       // xpub
+	"049d7cb2": {AddressTypeP2SHP2WPKH, true},  // ypub
+	"04b24746": {AddressTypeP2WPKH, true},      // zpub
+	"043587cf": {AddressTypeP2PKH, false},      // tpub
+	"044a5262": {AddressTypeP2SHP2WPKH, false}, // upub
+	"045f1cf6": {AddressTypeP2WPKH, false},     // vpub
+}
+
+// ExtendedPublicKey is a merchant's BIP32 account key. Receiving addresses
+// are derived from its external chain, m/.../account'/0/index, without any
+// private key leaving the merchant's wallet.
+type ExtendedPublicKey struct {
+	key         *hdkeychain.ExtendedKey
+	external    *hdkeychain.ExtendedKey
+	addressType string
+	net         *chaincfg.Params
+}
+
+// ParseExtendedPublicKey parses an xpub, ypub or zpub (tpub, upub or vpub
+// outside mainnet) exported from an account of a BIP44, BIP49 or BIP84 wallet
+func ParseExtendedPublicKey(serialized string, net *chaincfg.Params) (*ExtendedPublicKey, error) {
+	key, err := hdkeychain.NewKeyFromString(serialized)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidExtendedKey, err)
+	}
+	if key.IsPrivate() {
+		return nil, fmt.Errorf("%w: a private key was given, export the public key instead", ErrInvalidExtendedKey)
+	}
+	version, ok := extendedKeyVersions[hex.EncodeToString(key.Version())]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown version", ErrInvalidExtendedKey)
+	}
+	if version.mainnet != (net.Net == chaincfg.MainNetParams.Net) {
+		return nil, ErrExtendedKeyNetwork
+	}
+	if key.Depth() != accountDepth {
+		return nil, fmt.Errorf("%w: expected an account key at depth %d, got depth %d", ErrInvalidExtendedKey, accountDepth, key.Depth())
+	}
+
+	external, err := key.Derive(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidExtendedKey, err)
+	}
+	return &ExtendedPublicKey{key: key, external: external, addressType: version.addressType, net: net}, nil
+}
+
+// AddressType returns the type of the addresses derived from the key
+func (k *ExtendedPublicKey) AddressType() string {
+	return k.addressType
+}
+
+// Address derives the receiving address at index
+func (k *ExtendedPublicKey) Address(index uint32) (string, error) {
+	child, err := k.external.Derive(index)
+	if err != nil {
+		return "", err // Invalid child keys are astronomically unlikely
+	}
+	pubKey, err := child.ECPubKey()
+	if err != nil {
+		return "", err
+	}
+	pubKeyHash := btcutil.Hash160(pubKey.SerializeCompressed())
+
+	var address btcutil.Address
+	switch k.addressType {
+	case AddressTypeP2PKH:
+		address, err = btcutil.NewAddressPubKeyHash(pubKeyHash, k.net)
+	case AddressTypeP2WPKH:
+		address, err = btcutil.NewAddressWitnessPubKeyHash(pubKeyHash, k.net)
+	case AddressTypeP2SHP2WPKH:
+		var witness *btcutil.AddressWitnessPubKeyHash
+		witness, err = btcutil.NewAddressWitnessPubKeyHash(pubKeyHash, k.net)
+		if err != nil {
+			return "", err
+		}
+		var redeemScript []byte
+		redeemScript, err = txscript.PayToAddrScript(witness)
+		if err != nil {
+			return "", err
+		}
+		address, err = btcutil.NewAddressScriptHash(redeemScript, k.net)
+	}
+	if err != nil {
+		return "", err
+	}
+	return address.EncodeAddress(), nil
+}
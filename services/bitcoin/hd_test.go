@@ -0,0 +1,85 @@
+package bitcoin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// Account keys of the mnemonic "abandon abandon ... about" from the BIP44,
+// BIP49 and BIP84 test vectors
+const (
+	bip44XPub = "xpub6BosfCnifzxcFwrSzQiqu2DBVTshkCXacvNsWGYJVVhhawA7d4R5WSWGFNbi8Aw6ZRc1brxMyWMzG3DSSSSoekkudhUd9yLb6qx39T9nMdj"
+	bip49UPub = "upub5EFU65HtV5TeiSHmZZm7FUffBGy8UKeqp7vw43jYbvZPpoVsgU93oac7Wk3u6moKegAEWtGNF8DehrnHtv21XXEMYRUocHqguyjknFHYfgY"
+	bip84ZPub = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+)
+
+func TestExtendedPublicKeyAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		key         string
+		net         *chaincfg.Params
+		addressType string
+		index       uint32
+		want        string
+	}{
+		{"BIP84 first address", bip84ZPub, &chaincfg.MainNetParams, AddressTypeP2WPKH, 0, "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"},
+		{"BIP84 second address", bip84ZPub, &chaincfg.MainNetParams, AddressTypeP2WPKH, 1, "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"},
+		{"BIP49 first address", bip49UPub, &chaincfg.TestNet3Params, AddressTypeP2SHP2WPKH, 0, "2Mww8dCYPUpKHofjgcXcBCEGmniw9CoaiD2"},
+		{"BIP44 first address", bip44XPub, &chaincfg.MainNetParams, AddressTypeP2PKH, 0, "1LqBGSKuX5yYUonjxT5qGfpUsXKYYWeabA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ParseExtendedPublicKey(tt.key, tt.net)
+			if err != nil {
+				t.Fatalf("ParseExtendedPublicKey() error = %v", err)
+			}
+			if got := key.AddressType(); got != tt.addressType {
+				t.Fatalf("AddressType() = %s, want %s", got, tt.addressType)
+			}
+			got, err := key.Address(tt.index)
+			if err != nil {
+				t.Fatalf("Address(%d) error = %v", tt.index, err)
+			}
+			if got != tt.want {
+				t.Fatalf("Address(%d) = %s, want %s", tt.index, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExtendedPublicKeyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		net  *chaincfg.Params
+		want error
+	}{
+		{"mainnet key on testnet", bip84ZPub, &chaincfg.TestNet3Params, ErrExtendedKeyNetwork},
+		{"testnet key on mainnet", bip49UPub, &chaincfg.MainNetParams, ErrExtendedKeyNetwork},
+		{"not a key", "zpub-not-a-key", &chaincfg.MainNetParams, ErrInvalidExtendedKey},
+		{"bad checksum", bip84ZPub[:len(bip84ZPub)-1] + "c", &chaincfg.MainNetParams, ErrInvalidExtendedKey},
+		{
+			// BIP32 test vector 1 master private key
+			"private key",
+			"xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi",
+			&chaincfg.MainNetParams, ErrInvalidExtendedKey,
+		},
+		{
+			// BIP32 test vector 1 master public key, at depth 0
+			"not an account key",
+			"xpub661MyMwAqRbcFtXgS5sYJABqqG9YLmC4Q1Rdap9gSE8NqtwybGhePY2gZ29ESFjqJoCu1Rupje8YtGqsefD265TMg7usUDFdp6W1EGMcet8",
+			&chaincfg.MainNetParams, ErrInvalidExtendedKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseExtendedPublicKey(tt.key, tt.net); !errors.Is(err, tt.want) {
+				t.Fatalf("ParseExtendedPublicKey() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
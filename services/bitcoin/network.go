@@ -0,0 +1,28 @@
+package bitcoin
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// ErrUnknownNetwork is returned for BITCOIN_NETWORK values other than
+// mainnet, testnet and regtest
+var ErrUnknownNetwork = errors.New("unknown bitcoin network")
+
+// NetParams selects the chain parameters for a BITCOIN_NETWORK value. Unknown
+// names are an error rather than a fallback, since addresses and extended
+// keys are validated against the network chosen here.
+func NetParams(network string) (*chaincfg.Params, error) {
+	switch network {
+	case "mainnet":
+		return &chaincfg.MainNetParams, nil
+	case "testnet":
+		return &chaincfg.TestNet3Params, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	default:
+		return nil, fmt.Errorf("%w %q, use mainnet, testnet or regtest", ErrUnknownNetwork, network)
+	}
+}
@@ -0,0 +1,171 @@
+package bitcoin
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"own-paynet/config"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/go-zeromq/zmq4"
+)
+
+// ZMQ topics published by Bitcoin Core
+const (
+	TopicRawTx     = "rawtx"
+	TopicHashBlock = "hashblock"
+)
+
+// zmqReconnectDelay is how long to wait before reconnecting to a lost ZMQ endpoint
+const zmqReconnectDelay = 5 * time.Second
+
+// Notification is a message published by Bitcoin Core over ZMQ
+type Notification struct {
+	Topic string
+	Body  []byte
+	// Gap is set when messages on this topic were missed, e.g. after a
+	// reconnect, so the receiver should fall back to a full check
+	Gap bool
+}
+
+// NotificationListener subscribes to Bitcoin Core's zmqpubrawtx and
+// zmqpubhashblock endpoints
+type NotificationListener struct {
+	endpoints map[string]string // Topic to endpoint
+}
+
+// NewNotificationListener creates a listener for the configured ZMQ endpoints.
+// Topics without an endpoint are not subscribed to.
+func NewNotificationListener(cfg *config.Config) *NotificationListener {
+	endpoints := make(map[string]string)
+	if cfg.BitcoinZMQRawTx != "" {
+		endpoints[TopicRawTx] = cfg.BitcoinZMQRawTx
+	}
+	if cfg.BitcoinZMQHashBlock != "" {
+		endpoints[TopicHashBlock] = cfg.BitcoinZMQHashBlock
+	}
+	return &NotificationListener{endpoints: endpoints}
+}
+
+// Enabled reports whether any ZMQ endpoint is configured
+func (l *NotificationListener) Enabled() bool {
+	return len(l.endpoints) > 0
+}
+
+// Run delivers notifications to out until the context is cancelled,
+// reconnecting to endpoints that go away
+func (l *NotificationListener) Run(ctx context.Context, out chan<- Notification) {
+	// Bitcoin Core can publish several topics on one endpoint
+	topicsByEndpoint := make(map[string][]string)
+	for topic, endpoint := range l.endpoints {
+		topicsByEndpoint[endpoint] = append(topicsByEndpoint[endpoint], topic)
+	}
+
+	for endpoint, topics := range topicsByEndpoint {
+		go l.subscribe(ctx, endpoint, topics, out)
+	}
+	<-ctx.Done()
+}
+
+func (l *NotificationListener) subscribe(ctx context.Context, endpoint string, topics []string, out chan<- Notification) {
+	for {
+		if err := l.receive(ctx, endpoint, topics, out); err != nil && ctx.Err() == nil {
+			log.Printf("ZMQ subscription to %s failed: %v", endpoint, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(zmqReconnectDelay):
+		}
+	}
+}
+
+func (l *NotificationListener) receive(ctx context.Context, endpoint string, topics []string, out chan<- Notification) error {
+	sub := zmq4.NewSub(ctx)
+	defer sub.Close()
+
+	if err := sub.Dial(endpoint); err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if err := sub.SetOption(zmq4.OptionSubscribe, topic); err != nil {
+			return err
+		}
+	}
+	log.Printf("subscribed to %v notifications on %s", topics, endpoint)
+
+	// Anything may have happened while we were disconnected
+	for _, topic := range topics {
+		if !deliver(ctx, out, Notification{Topic: topic, Gap: true}) {
+			return nil
+		}
+	}
+
+	sequences := make(map[string]uint32)
+	for {
+		msg, err := sub.Recv()
+		if err != nil {
+			return err
+		}
+		// Messages are [topic, body, little-endian sequence number]
+		if len(msg.Frames) < 3 || len(msg.Frames[2]) != 4 {
+			continue
+		}
+
+		notification := Notification{Topic: string(msg.Frames[0]), Body: msg.Frames[1]}
+		sequence := binary.LittleEndian.Uint32(msg.Frames[2])
+		if last, ok := sequences[notification.Topic]; ok && sequence != last+1 {
+			notification.Gap = true
+		}
+		sequences[notification.Topic] = sequence
+
+		if !deliver(ctx, out, notification) {
+			return nil
+		}
+	}
+}
+
+func deliver(ctx context.Context, out chan<- Notification, notification Notification) bool {
+	select {
+	case out <- notification:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// TxOutput is an output of a transaction paying an address
+type TxOutput struct {
+	Vout    uint32
+	Address string
+	Amount  int64 // Satoshis
+}
+
+// DecodeTxOutputs parses a serialized transaction and returns its ID and the
+// addresses its outputs pay to
+func DecodeTxOutputs(rawTx []byte, netParams *chaincfg.Params) (string, []TxOutput, error) {
+	var tx wire.MsgTx
+	if err := tx.Deserialize(bytes.NewReader(rawTx)); err != nil {
+		return "", nil, err
+	}
+
+	var outputs []TxOutput
+	for vout, txOut := range tx.TxOut {
+		_, addresses, _, err := txscript.ExtractPkScriptAddrs(txOut.PkScript, netParams)
+		if err != nil || len(addresses) != 1 {
+			continue // Not a standard single-address output
+		}
+		outputs = append(outputs, TxOutput{
+			Vout:    uint32(vout),
+			Address: addresses[0].EncodeAddress(),
+			Amount:  txOut.Value,
+		})
+	}
+
+	return tx.TxHash().String(), outputs, nil
+}
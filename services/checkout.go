@@ -0,0 +1,65 @@
+package services
+
+import (
+	"errors"
+	"own-paynet/models"
+	"strconv"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"gorm.io/gorm"
+)
+
+// Checkout is the public view of a payment shown to payers. Of the merchant
+// it only shows the name the payment was labelled with.
+type Checkout struct {
+	PaymentID             string               `json:"payment_id"`
+	Status                models.PaymentStatus `json:"status"`
+	Final                 bool                 `json:"final"` // The status will not change again
+	Label                 string               `json:"label"`
+	Description           string               `json:"description"`
+	Address               string               `json:"bitcoin_address"`
+	AmountBTC             string               `json:"amount_btc"`
+	AmountSats            int64                `json:"amount_sats"`
+	Amount                float64              `json:"amount"` // Price in Currency, which may be fiat
+	Currency              string               `json:"currency"`
+	ExchangeRate          float64              `json:"exchange_rate,omitempty"`
+	RateLockedUntil       *time.Time           `json:"rate_locked_until,omitempty"`
+	ReceivedSats          int64                `json:"received_sats"`
+	Confirmations         int64                `json:"confirmations"`
+	RequiredConfirmations int64                `json:"required_confirmations"`
+	PaymentURI            string               `json:"payment_uri"` // BIP21 URI for wallets
+	ExpiresAt             *time.Time           `json:"expires_at"`
+}
+
+// GetCheckout returns the public view of a payment. Viewing it never changes
+// the payment; lapsed quotes are renewed by the PaymentRequoter.
+func (s *PaymentService) GetCheckout(paymentID string) (*Checkout, error) {
+	payment, err := s.repo.FindByID(paymentID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPaymentNotFound
+		}
+		return nil, err
+	}
+
+	return &Checkout{
+		PaymentID:             payment.PaymentID,
+		Status:                payment.Status,
+		Final:                 payment.Status.IsFinal(),
+		Label:                 payment.Label,
+		Description:           payment.Description,
+		Address:               payment.BitcoinAddress,
+		AmountBTC:             strconv.FormatFloat(btcutil.Amount(payment.AmountSats).ToBTC(), 'f', -1, 64),
+		AmountSats:            payment.AmountSats,
+		Amount:                payment.Amount,
+		Currency:              payment.Currency,
+		ExchangeRate:          payment.ExchangeRate,
+		RateLockedUntil:       payment.RateLockedUntil,
+		ReceivedSats:          payment.ReceivedSats,
+		Confirmations:         payment.Confirmations,
+		RequiredConfirmations: s.requiredConfirmations,
+		PaymentURI:            PaymentURI(payment),
+		ExpiresAt:             payment.ExpiresAt,
+	}, nil
+}
@@ -38,6 +38,12 @@ func (s *companyService) UpdateCompany(id uint, updated *models.Company) (*model
 	if updated.CompanyDetails != "" {
 		company.CompanyDetails = updated.CompanyDetails
 	}
+	if updated.PaymentExpiryMinutes < 0 || updated.PaymentExpiryMinutes > maxPaymentExpiryMinutes {
+		return nil, ErrInvalidPaymentExpiry
+	}
+	if updated.PaymentExpiryMinutes != 0 {
+		company.PaymentExpiryMinutes = updated.PaymentExpiryMinutes
+	}
 
 	if err := s.repo.Update(company); err != nil {
 		return nil, err
@@ -0,0 +1,89 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"own-paynet/config"
+	"strconv"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// githubProvider signs users in with GitHub, which speaks plain OAuth 2.0
+// rather than OpenID Connect, so the profile comes from the REST API
+type githubProvider struct {
+	name  string
+	oauth *oauth2.Config
+}
+
+func newGitHubProvider(cfg config.IdentityProviderConfig) *githubProvider {
+	return &githubProvider{
+		name: cfg.Name,
+		oauth: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       cfg.Scopes,
+			Endpoint:     github.Endpoint,
+		},
+	}
+}
+
+func (p *githubProvider) Name() string {
+	return p.name
+}
+
+func (p *githubProvider) AuthCodeURL(_ context.Context, state, codeVerifier, _ string) (string, error) {
+	return p.oauth.AuthCodeURL(state, oauth2.S256ChallengeOption(codeVerifier)), nil
+}
+
+func (p *githubProvider) Exchange(ctx context.Context, code, codeVerifier, _ string) (*Profile, error) {
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+	client := p.oauth.Client(ctx, token)
+
+	var user struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &user); err != nil {
+		return nil, fmt.Errorf("failed to get user info: %w", err)
+	}
+	if user.ID == 0 {
+		return nil, errors.New("GitHub returned no user ID")
+	}
+
+	// The public profile email may be unverified, so use the primary verified address instead
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return nil, fmt.Errorf("failed to get user emails: %w", err)
+	}
+
+	profile := &Profile{
+		Subject: strconv.FormatInt(user.ID, 10),
+		Name:    user.Name,
+		Picture: user.AvatarURL,
+	}
+	if profile.Name == "" {
+		profile.Name = user.Login
+	}
+	for _, email := range emails {
+		if email.Primary {
+			profile.Email = email.Email
+			profile.EmailVerified = email.Verified
+			break
+		}
+	}
+
+	return profile, nil
+}
@@ -0,0 +1,76 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"own-paynet/config"
+	"sort"
+)
+
+// Profile is the identity an external provider vouches for
+type Profile struct {
+	Subject       string // Stable user identifier at the provider
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+	Locale        string
+}
+
+// Provider is an external identity provider users can sign in with
+type Provider interface {
+	// Name is the identifier used in routes and stored with linked identities
+	Name() string
+	// AuthCodeURL returns the URL to send the user to for consent
+	AuthCodeURL(ctx context.Context, state, codeVerifier, nonce string) (string, error)
+	// Exchange redeems an authorization code and returns the verified profile
+	Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Profile, error)
+}
+
+// Registry holds the configured identity providers by name
+type Registry struct {
+	providers map[string]Provider
+}
+
+// NewRegistry creates a provider for every identity provider in the config
+func NewRegistry(cfg *config.Config) (*Registry, error) {
+	registry := &Registry{providers: make(map[string]Provider)}
+
+	for _, providerCfg := range cfg.IdentityProviders {
+		var provider Provider
+		switch providerCfg.Type {
+		case config.IdentityProviderOIDC:
+			if providerCfg.IssuerURL == "" {
+				return nil, fmt.Errorf("identity provider %s has no issuer URL", providerCfg.Name)
+			}
+			provider = newOIDCProvider(providerCfg)
+		case config.IdentityProviderGitHub:
+			provider = newGitHubProvider(providerCfg)
+		default:
+			return nil, fmt.Errorf("identity provider %s has unknown type %q", providerCfg.Name, providerCfg.Type)
+		}
+
+		if _, exists := registry.providers[provider.Name()]; exists {
+			return nil, fmt.Errorf("identity provider %s is configured twice", provider.Name())
+		}
+		registry.providers[provider.Name()] = provider
+	}
+
+	return registry, nil
+}
+
+// Get returns the provider with the given name
+func (r *Registry) Get(name string) (Provider, bool) {
+	provider, ok := r.providers[name]
+	return provider, ok
+}
+
+// Names returns the names of all configured providers
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,124 @@
+package identity
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwksRefreshInterval limits how often an unknown key ID triggers a refetch
+const jwksRefreshInterval = time.Minute
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// keySet caches the signing keys of an issuer, refetching them when a token
+// refers to a key we have not seen, which is how providers roll keys
+type keySet struct {
+	httpClient *http.Client
+	url        string
+
+	mu          sync.Mutex
+	keys        map[string]interface{}
+	lastFetched time.Time
+}
+
+func newKeySet(httpClient *http.Client, url string) *keySet {
+	return &keySet{httpClient: httpClient, url: url, keys: make(map[string]interface{})}
+}
+
+func (s *keySet) get(ctx context.Context, kid string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(s.lastFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	if err := s.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+func (s *keySet) refresh(ctx context.Context) error {
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, s.httpClient, s.url, &document); err != nil {
+		return fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+	s.lastFetched = time.Now()
+
+	keys := make(map[string]interface{}, len(document.Keys))
+	for _, jwk := range document.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Skip key types we cannot use rather than rejecting the whole set
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	s.keys = keys
+
+	return nil
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
@@ -0,0 +1,207 @@
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"own-paynet/config"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+// discoveryDocument is the subset of the OpenID provider metadata we use
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider signs users in with any OpenID Connect issuer. Endpoints are
+// discovered lazily so an unreachable provider does not prevent startup.
+type oidcProvider struct {
+	cfg        config.IdentityProviderConfig
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	discovery *discoveryDocument
+	oauth     *oauth2.Config
+	keys      *keySet
+}
+
+func newOIDCProvider(cfg config.IdentityProviderConfig) *oidcProvider {
+	return &oidcProvider{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *oidcProvider) Name() string {
+	return p.cfg.Name
+}
+
+func (p *oidcProvider) AuthCodeURL(ctx context.Context, state, codeVerifier, nonce string) (string, error) {
+	oauthCfg, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return oauthCfg.AuthCodeURL(state,
+		oauth2.S256ChallengeOption(codeVerifier),
+		oauth2.SetAuthURLParam("nonce", nonce),
+	), nil
+}
+
+func (p *oidcProvider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Profile, error) {
+	oauthCfg, discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := oauthCfg.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, errors.New("token response did not include an ID token")
+	}
+
+	claims, err := p.verifyIDToken(ctx, discovery, rawIDToken, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	profile := &Profile{}
+	profile.Subject, _ = claims["sub"].(string)
+	profile.Email, _ = claims["email"].(string)
+	profile.Name, _ = claims["name"].(string)
+	profile.Picture, _ = claims["picture"].(string)
+	profile.Locale, _ = claims["locale"].(string)
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		profile.EmailVerified = verified
+	case string:
+		profile.EmailVerified = verified == "true"
+	}
+
+	if profile.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return profile, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token
+func (p *oidcProvider) verifyIDToken(ctx context.Context, discovery *discoveryDocument, rawIDToken, nonce string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(rawIDToken, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.keys.get(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, jwt.ErrSignatureInvalid
+	}
+
+	// Multi-tenant issuers such as Microsoft's "common" endpoint advertise a templated issuer
+	expectedIssuer := discovery.Issuer
+	if tenantID, ok := claims["tid"].(string); ok {
+		expectedIssuer = strings.ReplaceAll(expectedIssuer, "{tenantid}", tenantID)
+	}
+	if issuer, _ := claims["iss"].(string); issuer != expectedIssuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims["iss"])
+	}
+
+	if !hasAudience(claims["aud"], p.cfg.ClientID) {
+		return nil, errors.New("token was not issued for this client")
+	}
+
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	return claims, nil
+}
+
+// discover fetches and caches the provider metadata
+func (p *oidcProvider) discover(ctx context.Context) (*oauth2.Config, *discoveryDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.oauth, p.discovery, nil
+	}
+
+	url := strings.TrimSuffix(p.cfg.IssuerURL, "/") + "/.well-known/openid-configuration"
+	var discovery discoveryDocument
+	if err := getJSON(ctx, p.httpClient, url, &discovery); err != nil {
+		return nil, nil, fmt.Errorf("failed to discover %s: %w", p.cfg.Name, err)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, nil, fmt.Errorf("incomplete discovery document for %s", p.cfg.Name)
+	}
+
+	p.discovery = &discovery
+	p.keys = newKeySet(p.httpClient, discovery.JWKSURI)
+	p.oauth = &oauth2.Config{
+		ClientID:     p.cfg.ClientID,
+		ClientSecret: p.cfg.ClientSecret,
+		RedirectURL:  p.cfg.RedirectURL,
+		Scopes:       p.cfg.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		},
+	}
+
+	return p.oauth, p.discovery, nil
+}
+
+// hasAudience reports whether the aud claim, a string or a list, contains the client ID
+func hasAudience(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, value := range aud {
+			if value == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, target interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
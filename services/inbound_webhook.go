@@ -0,0 +1,77 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"own-paynet/database"
+	"own-paynet/models"
+	"own-paynet/utils/webhook"
+	"time"
+)
+
+// Inbound webhook settings
+const (
+	inboundWebhookTolerance   = 5 * time.Minute // How far the signed timestamp may be from server time
+	inboundWebhookEventExpiry = 24 * time.Hour  // How long processed event IDs are remembered
+	maxWebhookEventIDLength   = 128
+)
+
+// Inbound webhook errors
+var (
+	ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+	ErrInvalidWebhookPayload   = errors.New("invalid webhook payload")
+	ErrDuplicateWebhookEvent   = errors.New("webhook event already processed")
+)
+
+// InboundWebhook is the body of a webhook reporting a payment's status
+type InboundWebhook struct {
+	ID        string               `json:"id"` // Unique per event, used to drop replays
+	PaymentID string               `json:"payment_id"`
+	Status    models.PaymentStatus `json:"status"`
+	Address   string               `json:"address"`
+}
+
+// ProcessWebhook verifies and applies an inbound webhook. The signature
+// header has the same t=<unix time>,v1=<signature> form as the webhooks we
+// send, keyed with WEBHOOK_SECRET. Each event ID is only applied once.
+func (s *PaymentService) ProcessWebhook(ctx context.Context, signature string, payload []byte) error {
+	if err := webhook.Verify(s.webhookSecret, signature, payload, inboundWebhookTolerance, time.Now()); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhookSignature, err)
+	}
+
+	var event InboundWebhook
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return ErrInvalidWebhookPayload
+	}
+	if event.ID == "" || len(event.ID) > maxWebhookEventIDLength || event.PaymentID == "" {
+		return fmt.Errorf("%w: id and payment_id are required", ErrInvalidWebhookPayload)
+	}
+
+	fresh, err := database.ReserveWebhookEvent(ctx, event.ID, inboundWebhookEventExpiry)
+	if err != nil {
+		return fmt.Errorf("failed to record webhook event: %w", err)
+	}
+	if !fresh {
+		return ErrDuplicateWebhookEvent
+	}
+
+	if err := s.ApplyWebhookStatus(event.PaymentID, event.Address, event.Status); err != nil {
+		// Let the sender retry unless the event itself is wrong
+		if !isWebhookRejection(err) {
+			if releaseErr := database.ReleaseWebhookEvent(ctx, event.ID); releaseErr != nil {
+				log.Printf("failed to release webhook event %s: %v", event.ID, releaseErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// isWebhookRejection reports whether an error means the event can never be applied
+func isWebhookRejection(err error) bool {
+	return errors.Is(err, ErrInvalidPaymentStatus) || errors.Is(err, ErrPaymentNotFound) ||
+		errors.Is(err, ErrPaymentAddressMismatch) || errors.Is(err, models.ErrInvalidPaymentTransition)
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// ledgerReconcileInterval is how often the ledger is reconciled
+const ledgerReconcileInterval = time.Hour
+
+// LedgerReconciler periodically proves that the ledger balances and logs
+// anything that does not add up
+type LedgerReconciler struct {
+	ledger *LedgerService
+}
+
+func NewLedgerReconciler(ledger *LedgerService) *LedgerReconciler {
+	return &LedgerReconciler{ledger: ledger}
+}
+
+// Run reconciles the ledger until the context is cancelled
+func (r *LedgerReconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(ledgerReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		r.runOnce()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *LedgerReconciler) runOnce() {
+	report, err := r.ledger.Reconcile()
+	if err != nil {
+		log.Printf("ledger reconciliation: %v", err)
+		return
+	}
+	if report.Balanced() {
+		return
+	}
+
+	for _, entry := range report.UnbalancedEntries {
+		log.Printf("ledger reconciliation: journal entry %d postings sum to %d", entry.JournalEntryID, entry.Sum)
+	}
+	for _, mismatch := range report.BalanceMismatches {
+		log.Printf("ledger reconciliation: account %s has balance %d but postings of %d", mismatch.Code, mismatch.Balance, mismatch.Postings)
+	}
+	for _, total := range report.CurrencyTotals {
+		if total.Sum != 0 {
+			log.Printf("ledger reconciliation: %s postings sum to %d", total.Currency, total.Sum)
+		}
+	}
+}
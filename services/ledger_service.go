@@ -0,0 +1,130 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"own-paynet/models"
+	"own-paynet/repository"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// maxLedgerEntries is the number of journal entries returned for a wallet
+const maxLedgerEntries = 100
+
+// ErrWalletCurrencyMismatch is returned for transfers between wallets of different currencies
+var ErrWalletCurrencyMismatch = errors.New("wallets hold different currencies")
+
+// LedgerService moves money between payout wallets through the double-entry
+// ledger. Wallet balances are never written directly: every change is a
+// journal entry whose postings sum to zero.
+type LedgerService struct {
+	repo *repository.LedgerRepository
+}
+
+func NewLedgerService(repo *repository.LedgerRepository) *LedgerService {
+	return &LedgerService{repo: repo}
+}
+
+// walletAccount returns the ledger account of a payout wallet, opening it on first use
+func (s *LedgerService) walletAccount(wallet *models.PayoutWallet) (*models.LedgerAccount, error) {
+	walletID := wallet.ID
+	account, err := s.repo.FindOrCreateAccount(&models.LedgerAccount{
+		Code:           models.WalletAccountCode(wallet.ID),
+		PayoutWalletID: &walletID,
+		Currency:       wallet.Currency,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if account.Currency != wallet.Currency {
+		if err := s.repo.UpdateEmptyAccountCurrency(account, wallet.Currency); err != nil {
+			return nil, err
+		}
+	}
+	return account, nil
+}
+
+// Transfer moves amount, in minor units, from one payout wallet to another.
+// The reference identifies the transfer, so posting it again does nothing.
+// It fails with models.ErrInsufficientFunds if the sender's balance is short.
+func (s *LedgerService) Transfer(reference, description string, transactionID *uint, from, to *models.PayoutWallet, amount int64) error {
+	if amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	if from.Currency != to.Currency {
+		return ErrWalletCurrencyMismatch
+	}
+
+	fromAccount, err := s.walletAccount(from)
+	if err != nil {
+		return err
+	}
+	toAccount, err := s.walletAccount(to)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.repo.Post(&models.JournalEntry{
+		Reference:     reference,
+		Description:   description,
+		TransactionID: transactionID,
+		Postings: []models.Posting{
+			{AccountID: fromAccount.ID, Amount: -amount},
+			{AccountID: toAccount.ID, Amount: amount},
+		},
+	})
+	return err
+}
+
+// GetWalletEntries returns the latest journal entries of a payout wallet, newest first
+func (s *LedgerService) GetWalletEntries(wallet *models.PayoutWallet) ([]models.JournalEntry, error) {
+	account, err := s.repo.FindAccountByWalletID(wallet.ID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return []models.JournalEntry{}, nil // Nothing was ever posted
+		}
+		return nil, err
+	}
+	return s.repo.FindEntriesByAccountID(account.ID, maxLedgerEntries)
+}
+
+// LedgerReport is the result of reconciling the ledger
+type LedgerReport struct {
+	CheckedAt         time.Time                    `json:"checked_at"`
+	UnbalancedEntries []repository.UnbalancedEntry `json:"unbalanced_entries"`
+	BalanceMismatches []repository.BalanceMismatch `json:"balance_mismatches"`
+	CurrencyTotals    []repository.CurrencyTotal   `json:"currency_totals"` // Each must be zero
+}
+
+// Balanced reports whether the reconciliation found nothing wrong
+func (r *LedgerReport) Balanced() bool {
+	if len(r.UnbalancedEntries) > 0 || len(r.BalanceMismatches) > 0 {
+		return false
+	}
+	for _, total := range r.CurrencyTotals {
+		if total.Sum != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Reconcile checks that every journal entry balances, that every cached
+// account balance equals the sum of its postings, and that the postings of
+// each currency sum to zero
+func (s *LedgerService) Reconcile() (*LedgerReport, error) {
+	report := &LedgerReport{CheckedAt: time.Now()}
+	var err error
+	if report.UnbalancedEntries, err = s.repo.FindUnbalancedEntries(); err != nil {
+		return nil, fmt.Errorf("failed to check journal entries: %w", err)
+	}
+	if report.BalanceMismatches, err = s.repo.FindBalanceMismatches(); err != nil {
+		return nil, fmt.Errorf("failed to check account balances: %w", err)
+	}
+	if report.CurrencyTotals, err = s.repo.CurrencyTotals(); err != nil {
+		return nil, fmt.Errorf("failed to sum postings: %w", err)
+	}
+	return report, nil
+}
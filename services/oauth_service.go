@@ -0,0 +1,241 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"own-paynet/database"
+	"own-paynet/models"
+	"own-paynet/repository"
+	"own-paynet/services/identity"
+	"own-paynet/utils"
+	"own-paynet/utils/email"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUnknownIdentityProvider = errors.New("unknown identity provider")
+	ErrInvalidOAuthState       = errors.New("invalid or expired OAuth state")
+	ErrOAuthAccountExists      = errors.New("an account with this email already exists, sign in with your password and link the provider from your account")
+	ErrOAuthEmailNotVerified   = errors.New("the provider has not verified this email address")
+	ErrIdentityAlreadyLinked   = errors.New("this account is already linked to another user")
+	ErrProviderAlreadyLinked   = errors.New("an account from this provider is already linked")
+	ErrIdentityNotLinked       = errors.New("no account from this provider is linked")
+	ErrLastSigninMethod        = errors.New("set a password or link another provider before unlinking, otherwise you will not be able to sign in")
+)
+
+// OAuthService signs users in through external identity providers and
+// manages the identities linked to their accounts
+type OAuthService struct {
+	registry     *identity.Registry
+	identityRepo *repository.UserIdentityRepository
+	userRepo     *repository.UserRepository
+	authService  *AuthService
+	emailService *email.EmailService
+}
+
+func NewOAuthService(registry *identity.Registry, identityRepo *repository.UserIdentityRepository, userRepo *repository.UserRepository, authService *AuthService, emailService *email.EmailService) *OAuthService {
+	return &OAuthService{
+		registry:     registry,
+		identityRepo: identityRepo,
+		userRepo:     userRepo,
+		authService:  authService,
+		emailService: emailService,
+	}
+}
+
+// Providers returns the names of the configured identity providers
+func (s *OAuthService) Providers() []string {
+	return s.registry.Names()
+}
+
+// StartFlow starts an OAuth flow with a provider, returning the state to bind
+// to the browser and the consent URL. A non-zero userID marks the flow as
+// linking the provider to that existing account.
+func (s *OAuthService) StartFlow(ctx context.Context, providerName string, userID uint) (string, string, error) {
+	provider, ok := s.registry.Get(providerName)
+	if !ok {
+		return "", "", ErrUnknownIdentityProvider
+	}
+
+	state := utils.GenerateRandomToken(32)
+	data := &models.OAuthState{
+		Provider:     providerName,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		Nonce:        utils.GenerateRandomToken(16),
+		Mode:         models.OAuthModeLogin,
+	}
+	if userID != 0 {
+		data.Mode = models.OAuthModeLink
+		data.UserID = userID
+	}
+
+	url, err := provider.AuthCodeURL(ctx, state, data.CodeVerifier, data.Nonce)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := database.StoreOAuthState(ctx, state, data, 10*time.Minute); err != nil {
+		return "", "", err
+	}
+
+	return state, url, nil
+}
+
+// CompleteFlow validates the state returned to a callback, redeems the code
+// and returns the verified profile. Each state can only be used once.
+func (s *OAuthService) CompleteFlow(ctx context.Context, providerName, state, code string) (*models.OAuthState, *identity.Profile, error) {
+	if state == "" {
+		return nil, nil, ErrInvalidOAuthState
+	}
+
+	data, err := database.ConsumeOAuthState(ctx, state)
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil, ErrInvalidOAuthState
+		}
+		return nil, nil, err
+	}
+	if data.Provider != providerName {
+		return nil, nil, ErrInvalidOAuthState
+	}
+
+	provider, ok := s.registry.Get(providerName)
+	if !ok {
+		return nil, nil, ErrUnknownIdentityProvider
+	}
+
+	profile, err := provider.Exchange(ctx, code, data.CodeVerifier, data.Nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, profile, nil
+}
+
+// SigninWithProvider signs in the user linked to a provider account, creating
+// and provisioning a new account if the email address is not registered yet.
+// Existing accounts are never linked implicitly, the owner has to sign in and
+// link the provider through LinkIdentity.
+func (s *OAuthService) SigninWithProvider(providerName string, profile *identity.Profile, meta SessionMetadata) (*SigninResult, *models.User, error) {
+	linked, err := s.identityRepo.FindByProviderSubject(providerName, profile.Subject)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, err
+	}
+
+	var user *models.User
+	if linked != nil {
+		user, err = s.userRepo.FindByID(linked.UserID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Keep the profile in sync with the provider
+		user.Name = profile.Name
+		user.Avatar = profile.Picture
+		user.Locale = profile.Locale
+		if err := s.userRepo.Update(user); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if !profile.EmailVerified || profile.Email == "" {
+			return nil, nil, ErrOAuthEmailNotVerified
+		}
+		if existingUser, err := s.userRepo.FindByEmail(profile.Email); err == nil && existingUser != nil {
+			return nil, nil, ErrOAuthAccountExists
+		}
+
+		now := time.Now()
+		user = &models.User{
+			Email:           profile.Email,
+			Name:            profile.Name,
+			Avatar:          profile.Picture,
+			Locale:          profile.Locale,
+			EmailVerified:   true, // Verified by the provider
+			EmailVerifiedAt: &now,
+		}
+		if err := s.authService.createAccount(user, ""); err != nil {
+			return nil, nil, err
+		}
+
+		if err := s.identityRepo.Create(&models.UserIdentity{
+			UserID:   user.ID,
+			Provider: providerName,
+			Subject:  profile.Subject,
+			Email:    profile.Email,
+		}); err != nil {
+			return nil, nil, err
+		}
+
+		if err := s.emailService.SendWelcomeEmail(user.Email); err != nil {
+			log.Printf("failed to send welcome email to user %d: %v", user.ID, err)
+		}
+	}
+
+	result, err := s.authService.completeSignin(user, meta)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return result, user, nil
+}
+
+// LinkIdentity links a provider account to an existing user
+func (s *OAuthService) LinkIdentity(userID uint, providerName string, profile *identity.Profile) (*models.UserIdentity, error) {
+	if _, err := s.identityRepo.FindByUserAndProvider(userID, providerName); err == nil {
+		return nil, ErrProviderAlreadyLinked
+	}
+
+	if linked, err := s.identityRepo.FindByProviderSubject(providerName, profile.Subject); err == nil && linked != nil {
+		return nil, ErrIdentityAlreadyLinked
+	}
+
+	userIdentity := &models.UserIdentity{
+		UserID:   userID,
+		Provider: providerName,
+		Subject:  profile.Subject,
+		Email:    profile.Email,
+	}
+	if err := s.identityRepo.Create(userIdentity); err != nil {
+		return nil, err
+	}
+
+	return userIdentity, nil
+}
+
+// UnlinkIdentity removes a provider account from a user. The account must
+// keep a password or another linked provider so the user is not locked out.
+func (s *OAuthService) UnlinkIdentity(userID uint, providerName string) error {
+	userIdentity, err := s.identityRepo.FindByUserAndProvider(userID, providerName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrIdentityNotLinked
+		}
+		return err
+	}
+
+	user, err := s.userRepo.FindByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.Password == "" {
+		identities, err := s.identityRepo.FindByUserID(userID)
+		if err != nil {
+			return err
+		}
+		if len(identities) <= 1 {
+			return ErrLastSigninMethod
+		}
+	}
+
+	return s.identityRepo.Delete(userIdentity.ID)
+}
+
+// ListIdentities returns the provider accounts linked to a user
+func (s *OAuthService) ListIdentities(userID uint) ([]models.UserIdentity, error) {
+	return s.identityRepo.FindByUserID(userID)
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"own-paynet/services/bitcoin"
+
+	"gorm.io/gorm"
+)
+
+// ErrAddressGapLimit is returned when the next address derived from a
+// merchant's extended public key would be past the gap limit of their wallet
+var ErrAddressGapLimit = errors.New("too many unpaid payments in a row, the merchant's wallet would not see the next address until one of them is paid")
+
+// paymentAddress is the address a new payment is paid to
+type paymentAddress struct {
+	Address         string
+	PayoutWalletID  *uint // Wallet the address was derived from, nil for node wallet addresses
+	DerivationIndex *uint32
+}
+
+// newPaymentAddress picks the address for a new payment. When the merchant's
+// default BTC payout wallet has an extended public key, the next address is
+// derived from it, so funds go straight to the merchant's own wallet and the
+// node only watches the address. Otherwise the node's wallet provides one.
+func (s *PaymentService) newPaymentAddress(userID uint) (*paymentAddress, error) {
+	wallet, err := s.walletRepo.FindDefaultWallet(userID, "BTC")
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if wallet == nil || wallet.ExtendedPublicKey == "" {
+		address, err := s.bitcoin.GenerateAddress()
+		if err != nil {
+			return nil, err
+		}
+		return &paymentAddress{Address: address}, nil
+	}
+
+	key, err := bitcoin.ParseExtendedPublicKey(wallet.ExtendedPublicKey, s.netParams)
+	if err != nil {
+		return nil, fmt.Errorf("payout wallet %d: %w", wallet.ID, err)
+	}
+	index, ok, err := s.walletRepo.ReserveAddressIndex(wallet.ID, uint32(s.gapLimit))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// The merchant's wallet would not show funds sent to the next address
+		return nil, ErrAddressGapLimit
+	}
+	address, err := key.Address(index)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.bitcoin.WatchAddress(address); err != nil {
+		return nil, err
+	}
+	return &paymentAddress{Address: address, PayoutWalletID: &wallet.ID, DerivationIndex: &index}, nil
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"own-paynet/models"
+	"own-paynet/repository"
+	"time"
+)
+
+// paymentExpiryInterval is how often the sweeper looks for overdue payments
+const paymentExpiryInterval = time.Minute
+
+// expiryRules maps the statuses of overdue payments to the status they close with
+var expiryRules = []struct {
+	from, to models.PaymentStatus
+}{
+	{models.PaymentStatusWaiting, models.PaymentStatusExpired},
+	{models.PaymentStatusPartiallyPaid, models.PaymentStatusUnderpaid},
+}
+
+// PaymentExpirySweeper closes payments that have not received the full
+// amount by their expiry: payments with nothing received become expired and
+// partially paid ones become underpaid. Payments already paid in full but
+// still confirming are left to the watcher.
+type PaymentExpirySweeper struct {
+	paymentRepo *repository.PaymentRepository
+}
+
+func NewPaymentExpirySweeper(paymentRepo *repository.PaymentRepository) *PaymentExpirySweeper {
+	return &PaymentExpirySweeper{paymentRepo: paymentRepo}
+}
+
+// Run sweeps overdue payments until the context is cancelled
+func (s *PaymentExpirySweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(paymentExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		s.runOnce()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *PaymentExpirySweeper) runOnce() {
+	now := time.Now()
+	closed := 0
+	for _, rule := range expiryRules {
+		payments, err := s.paymentRepo.FindOverdue(rule.from, now)
+		if err != nil {
+			log.Printf("failed to load overdue payments: %v", err)
+			return
+		}
+
+		for _, payment := range payments {
+			err := s.paymentRepo.UpdateStatus(payment.PaymentID, rule.to, models.PaymentEventSourceSweeper)
+			if errors.Is(err, models.ErrInvalidPaymentTransition) {
+				continue // The watcher moved it on since it was loaded
+			}
+			if err != nil {
+				log.Printf("failed to expire payment %s: %v", payment.PaymentID, err)
+				continue
+			}
+			closed++
+		}
+	}
+	if closed > 0 {
+		log.Printf("expired %d overdue payments", closed)
+	}
+}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"own-paynet/models"
+	"own-paynet/repository"
+	"strings"
+	"time"
+)
+
+// Page sizes for listing payments
+const (
+	defaultPaymentPageSize = 20
+	maxPaymentPageSize     = 100
+)
+
+// ErrInvalidPaymentQuery is returned for payment list parameters that cannot be used
+var ErrInvalidPaymentQuery = errors.New("invalid payment query")
+
+// PaymentQuery holds the parameters for listing payments
+type PaymentQuery struct {
+	Statuses      []models.PaymentStatus
+	Currency      string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	MinAmountSats *int64
+	MaxAmountSats *int64
+	Sort          string // created_at or amount_sats, prefixed with "-" for descending order
+	Cursor        string // NextCursor of the previous page
+	Limit         int
+}
+
+// PaymentPage is one page of payments. NextCursor is empty on the last page.
+type PaymentPage struct {
+	Payments   []models.Payment
+	NextCursor string
+}
+
+// paymentCursor is the position after the last payment of a page. It carries
+// the sort so a cursor cannot be reused with a different order.
+type paymentCursor struct {
+	Sort       string    `json:"s"`
+	CreatedAt  time.Time `json:"c"`
+	AmountSats int64     `json:"a"`
+	ID         uint      `json:"i"`
+}
+
+func encodePaymentCursor(sort string, payment *models.Payment) string {
+	data, _ := json.Marshal(paymentCursor{
+		Sort:       sort,
+		CreatedAt:  payment.CreatedAt,
+		AmountSats: payment.AmountSats,
+		ID:         payment.ID,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePaymentCursor(sort, encoded string) (*models.Payment, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidPaymentQuery)
+	}
+	var cursor paymentCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID == 0 {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidPaymentQuery)
+	}
+	if cursor.Sort != sort {
+		return nil, fmt.Errorf("%w: cursor was issued for a different sort", ErrInvalidPaymentQuery)
+	}
+
+	payment := &models.Payment{AmountSats: cursor.AmountSats}
+	payment.ID = cursor.ID
+	payment.CreatedAt = cursor.CreatedAt
+	return payment, nil
+}
+
+// paymentFilter validates a query and turns it into a repository filter
+func paymentFilter(userID uint, query PaymentQuery) (repository.PaymentFilter, error) {
+	filter := repository.PaymentFilter{
+		UserID:        userID,
+		Currency:      query.Currency,
+		CreatedAfter:  query.CreatedAfter,
+		CreatedBefore: query.CreatedBefore,
+		MinAmountSats: query.MinAmountSats,
+		MaxAmountSats: query.MaxAmountSats,
+		Limit:         query.Limit,
+	}
+
+	for _, status := range query.Statuses {
+		if !status.Valid() {
+			return filter, fmt.Errorf("%w: unknown status %q", ErrInvalidPaymentQuery, status)
+		}
+	}
+	filter.Statuses = query.Statuses
+
+	if filter.Limit == 0 {
+		filter.Limit = defaultPaymentPageSize
+	}
+	if filter.Limit < 1 || filter.Limit > maxPaymentPageSize {
+		return filter, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidPaymentQuery, maxPaymentPageSize)
+	}
+
+	sort := query.Sort
+	if sort == "" {
+		sort = "-" + repository.PaymentSortCreatedAt
+	}
+	filter.Descending = strings.HasPrefix(sort, "-")
+	filter.SortBy = strings.TrimPrefix(sort, "-")
+	if filter.SortBy != repository.PaymentSortCreatedAt && filter.SortBy != repository.PaymentSortAmountSats {
+		return filter, fmt.Errorf("%w: sort must be created_at or amount_sats", ErrInvalidPaymentQuery)
+	}
+
+	if query.Cursor != "" {
+		after, err := decodePaymentCursor(sort, query.Cursor)
+		if err != nil {
+			return filter, err
+		}
+		filter.After = after
+	}
+	return filter, nil
+}
+
+// ListPayments returns a page of the user's payments matching the query
+func (s *PaymentService) ListPayments(userID uint, query PaymentQuery) (*PaymentPage, error) {
+	filter, err := paymentFilter(userID, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch one extra payment to learn whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+	payments, err := s.repo.FindByFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &PaymentPage{Payments: payments}
+	if len(payments) > limit {
+		page.Payments = payments[:limit]
+		sort := filter.SortBy
+		if filter.Descending {
+			sort = "-" + sort
+		}
+		page.NextCursor = encodePaymentCursor(sort, &page.Payments[limit-1])
+	}
+	return page, nil
+}
+
+// GetPayment returns a payment owned by the user
+func (s *PaymentService) GetPayment(userID uint, paymentID string) (*models.Payment, error) {
+	return s.getOwnedPayment(userID, paymentID)
+}
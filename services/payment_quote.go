@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"own-paynet/models"
+	"time"
+)
+
+// paymentRequoteInterval is how often the requoter looks for lapsed rate locks
+const paymentRequoteInterval = time.Minute
+
+// PaymentRequoter quotes fiat priced payments again at the current exchange
+// rate once their rate lock has lapsed. It runs in the background so that
+// opening or polling a checkout page never changes what a payment costs.
+type PaymentRequoter struct {
+	paymentService *PaymentService
+}
+
+func NewPaymentRequoter(paymentService *PaymentService) *PaymentRequoter {
+	return &PaymentRequoter{paymentService: paymentService}
+}
+
+// Run quotes lapsed payments again until the context is cancelled
+func (q *PaymentRequoter) Run(ctx context.Context) {
+	ticker := time.NewTicker(paymentRequoteInterval)
+	defer ticker.Stop()
+
+	for {
+		q.runOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *PaymentRequoter) runOnce(ctx context.Context) {
+	s := q.paymentService
+	now := time.Now()
+	payments, err := s.repo.FindLapsedQuotes(now.Add(-s.rateLockGrace), now)
+	if err != nil {
+		log.Printf("failed to load payments with lapsed quotes: %v", err)
+		return
+	}
+
+	requoted := 0
+	for i := range payments {
+		updated, err := s.requote(ctx, &payments[i], now)
+		if err != nil {
+			log.Printf("failed to quote payment %s again: %v", payments[i].PaymentID, err)
+			continue
+		}
+		if updated {
+			requoted++
+		}
+	}
+	if requoted > 0 {
+		log.Printf("quoted %d payments again at current rates", requoted)
+	}
+}
+
+// requote converts a fiat priced payment at the current exchange rate and
+// locks the new rate. Only payments still waiting for their first funds, with
+// no output to their address seen even in the mempool, are quoted again: a
+// payer who has sent money has accepted the amount. It reports whether the
+// payment was updated.
+func (s *PaymentService) requote(ctx context.Context, payment *models.Payment, now time.Time) (bool, error) {
+	amountSats, quote, err := s.quoteAmount(ctx, payment.Amount, payment.Currency)
+	if err != nil {
+		return false, err
+	}
+	if quote == nil || amountSats <= 0 {
+		return false, fmt.Errorf("cannot quote %v %s", payment.Amount, payment.Currency)
+	}
+
+	lockedUntil := s.rateLockEnd(now, payment.ExpiresAt)
+	return s.repo.UpdateQuote(payment.PaymentID, amountSats, quote.Rate, quote.Source, lockedUntil)
+}
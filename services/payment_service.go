@@ -1,121 +1,321 @@
 package services
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"math"
+	"own-paynet/config"
 	"own-paynet/models"
 	"own-paynet/repository"
 	"own-paynet/services/bitcoin"
+	"own-paynet/services/rates"
+	"strings"
+	"time"
 
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
+	"gorm.io/gorm"
+)
+
+// Limits on new payments
+const (
+	maxPaymentExpiryMinutes     = 30 * 24 * 60 // Longest lifetime a payment can be given
+	maxPaymentDescriptionLength = 200
 )
 
 type PaymentService struct {
-	repo      *repository.PaymentRepository
-	bitcoin   *bitcoin.BitcoinService
-	baseURL   string
-	netParams *chaincfg.Params
+	repo          *repository.PaymentRepository
+	eventRepo     *repository.PaymentEventRepository
+	userRepo      *repository.UserRepository
+	walletRepo    *repository.PayoutWalletRepository
+	bitcoin       *bitcoin.BitcoinService
+	watcher       *PaymentWatcher
+	baseURL       string
+	netParams     *chaincfg.Params
+	defaultExpiry int // Payment lifetime in minutes when neither the request nor the company sets one
+	rates         rates.Provider
+	rateLock      time.Duration // How long the amount of a fiat priced payment holds
+	rateLockGrace time.Duration // Wait after a lock ends before quoting again, for payments already on their way
+	gapLimit      int           // Unused derived addresses in a row the merchant's wallet is expected to scan
+
+	requiredConfirmations int64
+	webhookSecret         string // Signs inbound webhooks
 }
 
-// Add network params in the constructor
-func NewPaymentService(repo *repository.PaymentRepository, bitcoin *bitcoin.BitcoinService, baseURL string, network string) *PaymentService {
+func NewPaymentService(repo *repository.PaymentRepository, eventRepo *repository.PaymentEventRepository, userRepo *repository.UserRepository, walletRepo *repository.PayoutWalletRepository, bitcoinService *bitcoin.BitcoinService, watcher *PaymentWatcher, rateProvider rates.Provider, cfg *config.Config) *PaymentService {
 	return &PaymentService{
-		repo:      repo,
-		bitcoin:   bitcoin,
-		baseURL:   baseURL,
-		netParams: getNetParams(network),
+		repo:          repo,
+		eventRepo:     eventRepo,
+		userRepo:      userRepo,
+		walletRepo:    walletRepo,
+		bitcoin:       bitcoinService,
+		watcher:       watcher,
+		baseURL:       cfg.BaseURL,
+		netParams:     bitcoinService.NetParams(),
+		defaultExpiry: cfg.PaymentExpiry,
+		rates:         rateProvider,
+		rateLock:      time.Duration(cfg.RateLockMinutes) * time.Minute,
+		rateLockGrace: time.Duration(cfg.RateLockGraceMinutes) * time.Minute,
+		gapLimit:      cfg.AddressGapLimit,
+
+		requiredConfirmations: int64(cfg.RequiredConfirmations),
+		webhookSecret:         cfg.WebhookSecret,
 	}
 }
 
-// Utility to select correct Bitcoin network
-func getNetParams(network string) *chaincfg.Params {
-	switch network {
-	case "mainnet":
-		return &chaincfg.MainNetParams
-	case "testnet":
-		return &chaincfg.TestNet3Params
-	case "regtest":
-		return &chaincfg.RegressionNetParams
-	default:
-		return &chaincfg.TestNet3Params
+// ErrUnsupportedCurrency is returned for payments in a currency we cannot convert to satoshis
+var ErrUnsupportedCurrency = errors.New("unsupported currency, use BTC, SATS or a fiat currency with an exchange rate")
+
+// ErrExchangeRateUnavailable is returned when the exchange rate provider cannot be reached
+var ErrExchangeRateUnavailable = errors.New("exchange rate unavailable, try again later")
+
+// Payment errors
+var (
+	ErrPaymentNotFound           = errors.New("payment not found")
+	ErrInvalidPaymentStatus      = errors.New("invalid payment status")
+	ErrPaymentAddressMismatch    = errors.New("address does not belong to the payment")
+	ErrPaymentDescriptionTooLong = fmt.Errorf("description must be at most %d characters", maxPaymentDescriptionLength)
+)
+
+// ErrInvalidPaymentExpiry is returned for a requested lifetime outside the allowed range
+var ErrInvalidPaymentExpiry = fmt.Errorf("expiry must be between 1 and %d minutes", maxPaymentExpiryMinutes)
+
+// quoteAmount converts a payment amount to satoshis. Amounts in a fiat
+// currency are converted at the current exchange rate, which is returned
+// along with them; the quote is nil for BTC and SATS.
+func (s *PaymentService) quoteAmount(ctx context.Context, amount float64, currency string) (int64, *rates.Quote, error) {
+	switch currency {
+	case "BTC":
+		sats, err := btcutil.NewAmount(amount)
+		if err != nil {
+			return 0, nil, err
+		}
+		return int64(sats), nil, nil
+	case "SAT", "SATS":
+		return int64(math.Round(amount)), nil, nil
+	}
+
+	if !isCurrencyCode(currency) {
+		return 0, nil, ErrUnsupportedCurrency
+	}
+	quote, err := s.rates.Quote(ctx, currency)
+	if err != nil {
+		if errors.Is(err, rates.ErrUnsupportedCurrency) {
+			return 0, nil, ErrUnsupportedCurrency
+		}
+		return 0, nil, fmt.Errorf("%w: %v", ErrExchangeRateUnavailable, err)
+	}
+	return int64(math.Round(amount / quote.Rate * btcutil.SatoshiPerBitcoin)), quote, nil
+}
+
+// isCurrencyCode reports whether currency looks like an ISO 4217 code
+func isCurrencyCode(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, r := range currency {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
 	}
+	return true
 }
 
-func (s *PaymentService) CreatePayment(userID uint, amount float64, merchantWallet, currency string) (*models.Payment, error) {
+// rateLockEnd is when a rate quoted at now stops holding. The lock never
+// outlasts the payment.
+func (s *PaymentService) rateLockEnd(now time.Time, expiresAt *time.Time) time.Time {
+	end := now.Add(s.rateLock)
+	if expiresAt != nil && end.After(*expiresAt) {
+		return *expiresAt
+	}
+	return end
+}
+
+// expiryMinutes picks the lifetime of a new payment: the one requested,
+// otherwise the merchant's company default, otherwise the global default
+func (s *PaymentService) expiryMinutes(merchant *models.User, requested int) (int, error) {
+	if requested != 0 {
+		if requested < 1 || requested > maxPaymentExpiryMinutes {
+			return 0, ErrInvalidPaymentExpiry
+		}
+		return requested, nil
+	}
+	if merchant.Company.PaymentExpiryMinutes > 0 {
+		return merchant.Company.PaymentExpiryMinutes, nil
+	}
+	return s.defaultExpiry, nil
+}
+
+// CreatePayment creates a payment that expires after expiresInMinutes, or
+// the merchant's default lifetime if 0. The description is shown to payers
+// in their wallet. Amounts in a fiat currency are converted at the current
+// exchange rate, which is locked for a while and quoted again once it lapses.
+func (s *PaymentService) CreatePayment(ctx context.Context, userID uint, amount float64, merchantWallet, currency, description string, expiresInMinutes int) (*models.Payment, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	amountSats, quote, err := s.quoteAmount(ctx, amount, currency)
+	if err != nil {
+		return nil, err
+	}
+	if amountSats <= 0 {
+		return nil, errors.New("amount must be at least one satoshi")
+	}
+
+	if len(description) > maxPaymentDescriptionLength {
+		return nil, ErrPaymentDescriptionTooLong
+	}
+	if err := bitcoin.ValidateAddress(merchantWallet, s.netParams); err != nil {
+		return nil, fmt.Errorf("merchant_wallet: %w", err)
+	}
+
+	merchant, err := s.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	lifetime, err := s.expiryMinutes(merchant, expiresInMinutes)
+	if err != nil {
+		return nil, err
+	}
+
 	bytes := make([]byte, 16)
 	if _, err := rand.Read(bytes); err != nil {
 		return nil, err
 	}
 	paymentID := hex.EncodeToString(bytes)
 
-	btcAddress, err := s.bitcoin.GenerateAddress()
+	address, err := s.newPaymentAddress(userID)
 	if err != nil {
 		return nil, err
 	}
 
 	paymentURL := fmt.Sprintf("%s/pay/%s", s.baseURL, paymentID)
-
-	// Monitor the address for transactions with enhanced confirmation handling
-	if err := s.bitcoin.MonitorAddress(btcAddress, func(txID, status string, confirmations int64) {
-		// Update payment status with confirmation count
-		_, err := s.repo.FindByID(paymentID)
-		if err != nil {
-			log.Printf("Failed to find payment %s: %v", paymentID, err)
-			return
-		}
-
-		// Update status based on confirmations
-		if status == "confirmed" {
-			_ = s.repo.UpdateStatus(paymentID, "confirmed")
-			// Here you could trigger additional business logic for confirmed payments
-		} else if status == "pending_confirmation" {
-			_ = s.repo.UpdateStatus(paymentID, fmt.Sprintf("pending_confirmation (%d/6)", confirmations))
-		} else {
-			_ = s.repo.UpdateStatus(paymentID, status)
-		}
-	}, s.netParams); err != nil {
-		return nil, err
-	}
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(lifetime) * time.Minute)
 
 	payment := &models.Payment{
 		PaymentID:      paymentID,
 		UserID:         userID,
 		Amount:         amount,
 		Currency:       currency,
-		Status:         "waiting",
+		AmountSats:     amountSats,
+		Status:         models.PaymentStatusWaiting,
 		PaymentURL:     paymentURL,
-		BitcoinAddress: btcAddress,
+		BitcoinAddress: address.Address,
 		MerchantWallet: merchantWallet,
+		Label:          merchant.Company.CompanyName,
+		Description:    description,
+		ExpiresAt:      &expiresAt,
+
+		PayoutWalletID:  address.PayoutWalletID,
+		DerivationIndex: address.DerivationIndex,
+	}
+	if quote != nil {
+		lockedUntil := s.rateLockEnd(now, &expiresAt)
+		payment.ExchangeRate = quote.Rate
+		payment.RateSource = quote.Source
+		payment.RateLockedUntil = &lockedUntil
 	}
 
 	if err := s.repo.Create(payment); err != nil {
 		return nil, err
 	}
+	s.watcher.Watch(payment)
 
 	return payment, nil
 }
 
-func (s *PaymentService) UpdatePaymentStatus(paymentID, status string) error {
-	return s.repo.UpdateStatus(paymentID, status)
+// ApplyWebhookStatus moves a payment to the status reported by an inbound
+// webhook. The webhook must name the payment's own address, the status must
+// be known, the state machine must allow the move, and it must fit the
+// payment's expiry: statuses for late payments only after it, the others
+// only before it.
+func (s *PaymentService) ApplyWebhookStatus(paymentID, address string, status models.PaymentStatus) error {
+	if !status.Valid() {
+		return ErrInvalidPaymentStatus
+	}
+
+	payment, err := s.repo.FindByID(paymentID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPaymentNotFound
+		}
+		return err
+	}
+	if address != payment.BitcoinAddress {
+		return ErrPaymentAddressMismatch
+	}
+
+	expired := payment.ExpiresAt != nil && time.Now().After(*payment.ExpiresAt)
+	switch status {
+	case models.PaymentStatusExpired, models.PaymentStatusUnderpaid,
+		models.PaymentStatusPaidLate, models.PaymentStatusNeedsReview:
+		if !expired {
+			return fmt.Errorf("%w: %s before the payment expires", models.ErrInvalidPaymentTransition, status)
+		}
+	default:
+		if expired {
+			return fmt.Errorf("%w: %s after the payment expired", models.ErrInvalidPaymentTransition, status)
+		}
+	}
+
+	return s.repo.UpdateStatus(paymentID, status, models.PaymentEventSourceWebhook)
+}
+
+// GetPaymentEvents returns the status history of a payment owned by the user
+func (s *PaymentService) GetPaymentEvents(userID uint, paymentID string) ([]models.PaymentEvent, error) {
+	if _, err := s.getOwnedPayment(userID, paymentID); err != nil {
+		return nil, err
+	}
+	return s.eventRepo.FindByPaymentID(paymentID)
+}
+
+// getOwnedPayment loads a payment, treating payments of other users as missing
+func (s *PaymentService) getOwnedPayment(userID uint, paymentID string) (*models.Payment, error) {
+	payment, err := s.repo.FindByID(paymentID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPaymentNotFound
+		}
+		return nil, err
+	}
+	if payment.UserID != userID {
+		return nil, ErrPaymentNotFound
+	}
+	return payment, nil
 }
 
 // GetPaymentStatus returns the current status and confirmation count of a payment
-func (s *PaymentService) GetPaymentStatus(paymentID string) (string, int64, error) {
+func (s *PaymentService) GetPaymentStatus(paymentID string) (models.PaymentStatus, int64, error) {
 	payment, err := s.repo.FindByID(paymentID)
 	if err != nil {
 		return "", 0, err
 	}
 
-	// If the payment has a transaction ID, get its confirmations
-	if payment.Status == "pending_confirmation" || payment.Status == "confirmed" {
-		confirmations, err := s.bitcoin.GetTransactionConfirmations(paymentID)
-		if err != nil {
-			return payment.Status, 0, err
-		}
-		return payment.Status, confirmations, nil
+	return payment.Status, payment.Confirmations, nil
+}
+
+// PaymentURI builds the BIP21 URI for a payment. Once part of the amount has
+// arrived it only asks for what is still missing.
+func PaymentURI(payment *models.Payment) string {
+	amount := payment.AmountSats - payment.ReceivedSats
+	if amount <= 0 {
+		amount = payment.AmountSats
 	}
+	return bitcoin.PaymentRequest{
+		Address:    payment.BitcoinAddress,
+		AmountSats: amount,
+		Label:      payment.Label,
+		Message:    payment.Description,
+	}.URI()
+}
 
-	return payment.Status, 0, nil
+// GetPaymentURI returns the BIP21 URI of a payment owned by the user
+func (s *PaymentService) GetPaymentURI(userID uint, paymentID string) (string, error) {
+	payment, err := s.getOwnedPayment(userID, paymentID)
+	if err != nil {
+		return "", err
+	}
+	return PaymentURI(payment), nil
 }
@@ -0,0 +1,503 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"own-paynet/config"
+	"own-paynet/models"
+	"own-paynet/repository"
+	"own-paynet/services/bitcoin"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// paymentWatcherCheckpoint names the watcher's row in the checkpoint table
+const paymentWatcherCheckpoint = "payments"
+
+// PaymentWatcher follows the wallet for transactions paying open payments.
+// A single watcher serves every payment: each poll asks the node for all
+// wallet transactions since the last checkpoint, so the cost does not grow
+// with the number of open payments. The checkpoint is stored in the
+// database, so payments keep being watched across restarts, and payments
+// stop being watched once they reach a final status.
+//
+// Payments that expired unpaid keep being watched for a grace period so
+// funds sent after expiry are still recorded. Once such late funds confirm
+// the payment becomes paid_late if they complete the amount, and
+// needs_review otherwise.
+//
+// When Bitcoin Core's ZMQ notifications are configured, transactions are
+// matched against the watched addresses as soon as they enter the mempool
+// and confirmations are refreshed on every new block. Polling continues as a
+// fallback for missed notifications.
+type PaymentWatcher struct {
+	paymentRepo           *repository.PaymentRepository
+	checkpointRepo        *repository.WatcherCheckpointRepository
+	paymentTxRepo         *repository.PaymentTransactionRepository
+	bitcoin               *bitcoin.BitcoinService
+	notifications         *bitcoin.NotificationListener
+	netParams             *chaincfg.Params
+	requiredConfirmations int64
+	underpaidToleranceBPS int64
+	overpaidToleranceBPS  int64
+	pollInterval          time.Duration
+	lateGrace             time.Duration
+	pendingTimeout        time.Duration
+
+	mu      sync.Mutex
+	watched map[string]string // Bitcoin address to payment ID of watched payments
+}
+
+func NewPaymentWatcher(paymentRepo *repository.PaymentRepository, checkpointRepo *repository.WatcherCheckpointRepository, paymentTxRepo *repository.PaymentTransactionRepository, bitcoinService *bitcoin.BitcoinService, cfg *config.Config) *PaymentWatcher {
+	return &PaymentWatcher{
+		paymentRepo:           paymentRepo,
+		checkpointRepo:        checkpointRepo,
+		paymentTxRepo:         paymentTxRepo,
+		bitcoin:               bitcoinService,
+		notifications:         bitcoin.NewNotificationListener(cfg),
+		netParams:             bitcoinService.NetParams(),
+		requiredConfirmations: int64(cfg.RequiredConfirmations),
+		underpaidToleranceBPS: int64(cfg.UnderpaidToleranceBPS),
+		overpaidToleranceBPS:  int64(cfg.OverpaidToleranceBPS),
+		pollInterval:          time.Duration(cfg.PaymentPollInterval) * time.Second,
+		lateGrace:             time.Duration(cfg.LatePaymentGrace) * time.Hour,
+		pendingTimeout:        time.Duration(cfg.PendingTimeout) * time.Hour,
+		watched:               make(map[string]string),
+	}
+}
+
+// Watch starts watching a newly created payment without waiting for the next poll
+func (w *PaymentWatcher) Watch(payment *models.Payment) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watched[payment.BitcoinAddress] = payment.PaymentID
+}
+
+// Run watches payments until the context is cancelled
+func (w *PaymentWatcher) Run(ctx context.Context) {
+	if watched, err := w.paymentRepo.CountWatched(w.lateCutoff(), w.requiredConfirmations); err == nil {
+		log.Printf("payment watcher started with %d watched payments", watched)
+	}
+
+	notifications := make(chan bitcoin.Notification, 256)
+	if w.notifications.Enabled() {
+		go w.notifications.Run(ctx, notifications)
+	}
+
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	w.pollAndLog()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("payment watcher stopped")
+			return
+		case <-ticker.C:
+			w.pollAndLog()
+		case notification := <-notifications:
+			switch {
+			case notification.Gap, notification.Topic == bitcoin.TopicHashBlock:
+				// A new block changes confirmations, a gap means we may have missed something
+				w.pollAndLog()
+			case notification.Topic == bitcoin.TopicRawTx:
+				if err := w.handleRawTx(notification.Body); err != nil {
+					log.Printf("payment watcher: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (w *PaymentWatcher) pollAndLog() {
+	if err := w.poll(); err != nil {
+		log.Printf("payment watcher: %v", err)
+	}
+}
+
+// handleRawTx records outputs paying watched payments as soon as a transaction is announced
+func (w *PaymentWatcher) handleRawTx(rawTx []byte) error {
+	txID, outputs, err := bitcoin.DecodeTxOutputs(rawTx, w.netParams)
+	if err != nil {
+		return fmt.Errorf("failed to decode transaction: %w", err)
+	}
+
+	affected := make(map[string]bool)
+	for _, output := range outputs {
+		w.mu.Lock()
+		paymentID, ok := w.watched[output.Address]
+		w.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		// rawtx also fires for transactions in new blocks, so never
+		// overwrite what the wallet has already told us about an output
+		err := w.paymentTxRepo.CreateIfMissing(&models.PaymentTransaction{
+			PaymentID:  paymentID,
+			TxID:       txID,
+			Vout:       output.Vout,
+			AmountSats: output.Amount,
+			SeenAt:     time.Now(), // Announced just now
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record transaction %s: %w", txID, err)
+		}
+		affected[paymentID] = true
+	}
+
+	for paymentID := range affected {
+		if err := w.updatePayment(paymentID, txID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lateCutoff is the expiry before which expired payments are no longer watched
+func (w *PaymentWatcher) lateCutoff() time.Time {
+	return time.Now().Add(-w.lateGrace)
+}
+
+// refreshWatched reloads the addresses of watched payments
+func (w *PaymentWatcher) refreshWatched() error {
+	payments, err := w.paymentRepo.FindWatched(w.lateCutoff(), w.requiredConfirmations)
+	if err != nil {
+		return err
+	}
+
+	watched := make(map[string]string, len(payments))
+	for _, payment := range payments {
+		watched[payment.BitcoinAddress] = payment.PaymentID
+	}
+
+	w.mu.Lock()
+	w.watched = watched
+	w.mu.Unlock()
+	return nil
+}
+
+// poll processes the wallet transactions since the checkpoint and advances it.
+// The checkpoint only moves after every payment has been updated, so a
+// failure or crash part way through replays the same transactions next time.
+func (w *PaymentWatcher) poll() (err error) {
+	// Keep the watcher alive if processing a transaction panics
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered from panic: %v", r)
+		}
+	}()
+
+	checkpoint, err := w.checkpointRepo.Get(paymentWatcherCheckpoint)
+	if err != nil {
+		return fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+
+	received, lastBlock, err := w.bitcoin.ListReceivedSince(checkpoint, int(w.requiredConfirmations))
+	if err != nil {
+		return fmt.Errorf("failed to list wallet transactions: %w", err)
+	}
+
+	if err := w.processReceived(received); err != nil {
+		return err
+	}
+	if err := w.reconcileUnconfirmed(); err != nil {
+		return err
+	}
+
+	if lastBlock != "" && lastBlock != checkpoint {
+		if err := w.checkpointRepo.Save(paymentWatcherCheckpoint, lastBlock); err != nil {
+			return fmt.Errorf("failed to save checkpoint: %w", err)
+		}
+	}
+
+	// Drop payments that reached a final status or whose grace period ended,
+	// and pick up any created elsewhere
+	if err := w.refreshWatched(); err != nil {
+		return fmt.Errorf("failed to load watched payments: %w", err)
+	}
+	return nil
+}
+
+func (w *PaymentWatcher) processReceived(received []bitcoin.ReceivedTransaction) error {
+	if len(received) == 0 {
+		return nil
+	}
+
+	addresses := make([]string, 0, len(received))
+	for _, tx := range received {
+		addresses = append(addresses, tx.Address)
+	}
+	payments, err := w.paymentRepo.FindWatchedByAddresses(addresses, w.lateCutoff(), w.requiredConfirmations)
+	if err != nil {
+		return fmt.Errorf("failed to load watched payments: %w", err)
+	}
+
+	byAddress := make(map[string]string, len(payments))
+	for _, payment := range payments {
+		byAddress[payment.BitcoinAddress] = payment.PaymentID
+	}
+
+	// Record every output first, then re-evaluate each payment once
+	latestTx := make(map[string]string)
+	for _, tx := range received {
+		paymentID, ok := byAddress[tx.Address]
+		if !ok {
+			continue // Not one of our watched payments
+		}
+
+		amount, err := btcutil.NewAmount(tx.Amount)
+		if err != nil {
+			return fmt.Errorf("invalid amount in transaction %s: %w", tx.TxID, err)
+		}
+		err = w.paymentTxRepo.Upsert(&models.PaymentTransaction{
+			PaymentID:     paymentID,
+			TxID:          tx.TxID,
+			Vout:          tx.Vout,
+			AmountSats:    int64(amount),
+			Confirmations: tx.Confirmations,
+			SeenAt:        tx.SeenAt,
+			Dropped:       tx.Confirmations < 0, // Conflicts with a transaction in the chain
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record transaction %s: %w", tx.TxID, err)
+		}
+		latestTx[paymentID] = tx.TxID
+	}
+
+	for paymentID, txID := range latestTx {
+		if err := w.updatePayment(paymentID, txID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unknownTxGrace is how long an output seen through ZMQ may stay unknown to
+// the wallet before it is dropped, covering the time the wallet takes to
+// process the transaction
+const unknownTxGrace = 10 * time.Minute
+
+// reconcileUnconfirmed checks the unconfirmed outputs of watched payments
+// against the node and drops those whose transaction was replaced,
+// double-spent or evicted from the mempool, so that they stop counting
+func (w *PaymentWatcher) reconcileUnconfirmed() error {
+	w.mu.Lock()
+	paymentIDs := make([]string, 0, len(w.watched))
+	for _, paymentID := range w.watched {
+		paymentIDs = append(paymentIDs, paymentID)
+	}
+	w.mu.Unlock()
+	if len(paymentIDs) == 0 {
+		return nil
+	}
+
+	paymentTxs, err := w.paymentTxRepo.FindUnconfirmed(paymentIDs, w.requiredConfirmations)
+	if err != nil {
+		return fmt.Errorf("failed to load unconfirmed transactions: %w", err)
+	}
+
+	// Every payment with unconfirmed outputs is re-evaluated, as outputs also
+	// stop counting once they have been pending for too long
+	affected := make(map[string]bool)
+	for _, paymentTx := range paymentTxs {
+		affected[paymentTx.PaymentID] = true
+
+		status, err := w.bitcoin.GetTransactionStatus(paymentTx.TxID)
+		if err != nil {
+			return fmt.Errorf("failed to check transaction %s: %w", paymentTx.TxID, err)
+		}
+
+		confirmations := paymentTx.Confirmations
+		dropped := false
+		switch {
+		case !status.Known:
+			dropped = time.Since(paymentTx.CreatedAt) > unknownTxGrace
+		case status.Confirmations < 0:
+			dropped = true
+		case status.Confirmations == 0 && !status.InMempool:
+			dropped = true
+		default:
+			confirmations = status.Confirmations
+		}
+		if !dropped && confirmations == paymentTx.Confirmations {
+			continue
+		}
+
+		if err := w.paymentTxRepo.UpdateState(paymentTx.ID, confirmations, dropped); err != nil {
+			return fmt.Errorf("failed to update transaction %s: %w", paymentTx.TxID, err)
+		}
+		if dropped {
+			log.Printf("payment %s: output %s:%d was replaced, double-spent or evicted and no longer counts",
+				paymentTx.PaymentID, paymentTx.TxID, paymentTx.Vout)
+		}
+	}
+
+	for paymentID := range affected {
+		if err := w.updatePayment(paymentID, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// counts reports whether an output counts towards its payment. Outputs that
+// were dropped, or that stayed unconfirmed past the pending timeout, do not.
+func (w *PaymentWatcher) counts(paymentTx *models.PaymentTransaction) bool {
+	if paymentTx.Dropped {
+		return false
+	}
+	return paymentTx.Confirmations > 0 || time.Since(paymentTx.SeenAt) <= w.pendingTimeout
+}
+
+// updatePayment recomputes the amount received for a payment from its
+// recorded outputs and moves it to the matching status
+func (w *PaymentWatcher) updatePayment(paymentID, latestTxID string) error {
+	payment, err := w.paymentRepo.FindByID(paymentID)
+	if err != nil {
+		return fmt.Errorf("failed to load payment %s: %w", paymentID, err)
+	}
+	paymentTxs, err := w.paymentTxRepo.FindByPaymentID(paymentID)
+	if err != nil {
+		return fmt.Errorf("failed to load transactions of payment %s: %w", paymentID, err)
+	}
+
+	var received int64
+	minConfirmations := int64(-1)
+	for i := range paymentTxs {
+		paymentTx := &paymentTxs[i]
+		if !w.counts(paymentTx) {
+			continue
+		}
+		received += paymentTx.AmountSats
+		if minConfirmations < 0 || paymentTx.Confirmations < minConfirmations {
+			minConfirmations = paymentTx.Confirmations
+		}
+	}
+	if minConfirmations < 0 {
+		minConfirmations = 0
+	}
+
+	status := w.statusFor(payment.AmountSats, received, minConfirmations)
+	// Payments not paid in full by their expiry close, including ones whose
+	// pending funds stopped counting after it
+	if payment.ExpiresAt != nil && time.Now().After(*payment.ExpiresAt) && (expirable(payment.Status) || expirable(status)) {
+		status = w.lateStatusFor(payment, paymentTxs)
+	}
+	if status != payment.Status && payment.Status.CheckTransition(status) != nil {
+		if payment.Status.CheckTransition(models.PaymentStatusNeedsReview) != nil {
+			log.Printf("payment %s: cannot move from %s to %s", paymentID, payment.Status, status)
+			return nil
+		}
+		// The state machine has no such move, so leave the payment to a person
+		log.Printf("payment %s: cannot move from %s to %s, flagging it for review", paymentID, payment.Status, status)
+		status = models.PaymentStatusNeedsReview
+	}
+	if payment.ReceivedSats == received && payment.Confirmations == minConfirmations && payment.Status == status {
+		return nil
+	}
+
+	payment.ReceivedSats = received
+	payment.Confirmations = minConfirmations
+	if latestTxID != "" {
+		payment.TransactionID = latestTxID
+	}
+	payment.Status = status
+	if err := w.paymentRepo.UpdateReceived(payment, models.PaymentEventSourceWatcher); err != nil {
+		if errors.Is(err, models.ErrInvalidPaymentTransition) {
+			// Leave the payment for review rather than stalling the watcher
+			log.Printf("payment %s: %v", paymentID, err)
+			return nil
+		}
+		return fmt.Errorf("failed to update payment %s: %w", paymentID, err)
+	}
+	log.Printf("payment %s is %s with %d of %d sats received", paymentID, status, received, payment.AmountSats)
+	return nil
+}
+
+// statusFor maps the amount received for a payment and the confirmations of
+// its least confirmed output to the payment's status. A payment is only
+// settled once every output counted towards it has enough confirmations.
+func (w *PaymentWatcher) statusFor(amountDue, received, confirmations int64) models.PaymentStatus {
+	switch {
+	case received == 0:
+		return models.PaymentStatusWaiting
+	case !w.covers(amountDue, received):
+		return models.PaymentStatusPartiallyPaid
+	case confirmations == 0:
+		return models.PaymentStatusPending
+	case confirmations < w.requiredConfirmations:
+		return models.PaymentStatusPendingConfirmation
+	case received > amountDue+amountDue*w.overpaidToleranceBPS/10000:
+		return models.PaymentStatusOverpaid
+	default:
+		return models.PaymentStatusPaid
+	}
+}
+
+// covers reports whether received pays amountDue, allowing for the underpaid tolerance
+func (w *PaymentWatcher) covers(amountDue, received int64) bool {
+	return received >= amountDue-amountDue*w.underpaidToleranceBPS/10000
+}
+
+// expirable reports whether a payment in the given status had not been paid
+// in full, so reaching its expiry closes it
+func expirable(status models.PaymentStatus) bool {
+	switch status {
+	case models.PaymentStatusWaiting, models.PaymentStatusPartiallyPaid,
+		models.PaymentStatusExpired, models.PaymentStatusUnderpaid:
+		return true
+	}
+	return false
+}
+
+// lateStatusFor decides the status of a payment checked after its expiry.
+// Outputs the node first saw, or that were mined, after the expiry are late;
+// when the watcher recorded them does not matter. A payment whose outputs
+// from before the expiry cover the amount was paid in time, even if a missed
+// notification or downtime kept the watcher from noticing until after it,
+// and gets the status it would have had then. Otherwise, until late funds
+// have enough confirmations the payment keeps its closed status; once they
+// do, it is paid_late if everything received covers the amount and
+// needs_review otherwise, so a person can decide whether to refund.
+func (w *PaymentWatcher) lateStatusFor(payment *models.Payment, paymentTxs []models.PaymentTransaction) models.PaymentStatus {
+	var inTime, late int64
+	confirmations, lateConfirmations := int64(-1), int64(-1)
+	for i := range paymentTxs {
+		paymentTx := &paymentTxs[i]
+		if !w.counts(paymentTx) {
+			continue
+		}
+		if confirmations < 0 || paymentTx.Confirmations < confirmations {
+			confirmations = paymentTx.Confirmations
+		}
+		if !paymentTx.SeenAt.After(*payment.ExpiresAt) {
+			inTime += paymentTx.AmountSats
+			continue
+		}
+		late += paymentTx.AmountSats
+		if lateConfirmations < 0 || paymentTx.Confirmations < lateConfirmations {
+			lateConfirmations = paymentTx.Confirmations
+		}
+	}
+
+	due := payment.AmountSats
+	if inTime > 0 && w.covers(due, inTime) {
+		return w.statusFor(due, inTime+late, confirmations)
+	}
+	if late == 0 || lateConfirmations < w.requiredConfirmations {
+		if inTime == 0 {
+			return models.PaymentStatusExpired
+		}
+		return models.PaymentStatusUnderpaid
+	}
+	if !w.covers(due, inTime+late) {
+		return models.PaymentStatusNeedsReview
+	}
+	return models.PaymentStatusPaidLate
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"own-paynet/models"
+	"testing"
+	"time"
+)
+
+func newTestWatcher() *PaymentWatcher {
+	return &PaymentWatcher{
+		requiredConfirmations: 3,
+		underpaidToleranceBPS: 100, // 1%
+		overpaidToleranceBPS:  100,
+		pendingTimeout:        72 * time.Hour,
+	}
+}
+
+func TestPaymentWatcherStatusFor(t *testing.T) {
+	tests := []struct {
+		name          string
+		received      int64
+		confirmations int64
+		want          models.PaymentStatus
+	}{
+		{"nothing received", 0, 0, models.PaymentStatusWaiting},
+		{"partial", 5_000, 6, models.PaymentStatusPartiallyPaid},
+		{"just below tolerance", 9_899, 6, models.PaymentStatusPartiallyPaid},
+		{"within underpaid tolerance", 9_900, 6, models.PaymentStatusPaid},
+		{"unconfirmed", 10_000, 0, models.PaymentStatusPending},
+		{"confirming", 10_000, 2, models.PaymentStatusPendingConfirmation},
+		{"paid", 10_000, 3, models.PaymentStatusPaid},
+		{"within overpaid tolerance", 10_100, 3, models.PaymentStatusPaid},
+		{"overpaid", 10_101, 3, models.PaymentStatusOverpaid},
+		{"overpaid but unconfirmed", 20_000, 0, models.PaymentStatusPending},
+	}
+
+	w := newTestWatcher()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := w.statusFor(10_000, tt.received, tt.confirmations); got != tt.want {
+				t.Fatalf("statusFor() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaymentWatcherLateStatusFor(t *testing.T) {
+	expiresAt := time.Now().Add(-time.Hour)
+	before := expiresAt.Add(-10 * time.Minute)
+	after := expiresAt.Add(10 * time.Minute)
+	output := func(amount, confirmations int64, seenAt time.Time) models.PaymentTransaction {
+		return models.PaymentTransaction{AmountSats: amount, Confirmations: confirmations, SeenAt: seenAt}
+	}
+	dropped := output(10_000, 0, before)
+	dropped.Dropped = true
+
+	tests := []struct {
+		name    string
+		outputs []models.PaymentTransaction
+		want    models.PaymentStatus
+	}{
+		{"nothing received", nil, models.PaymentStatusExpired},
+		{"in time and confirmed", []models.PaymentTransaction{output(10_000, 3, before)}, models.PaymentStatusPaid},
+		{"in time but unconfirmed", []models.PaymentTransaction{output(10_000, 0, before)}, models.PaymentStatusPending},
+		{"in time and confirming", []models.PaymentTransaction{output(10_000, 1, before)}, models.PaymentStatusPendingConfirmation},
+		{"in time and overpaid", []models.PaymentTransaction{output(15_000, 3, before)}, models.PaymentStatusOverpaid},
+		{"in time across outputs", []models.PaymentTransaction{output(6_000, 4, before), output(4_000, 3, before)}, models.PaymentStatusPaid},
+		{"in time with unconfirmed late extra", []models.PaymentTransaction{output(10_000, 3, before), output(1_000, 0, after)}, models.PaymentStatusPending},
+		{"partial in time", []models.PaymentTransaction{output(5_000, 3, before)}, models.PaymentStatusUnderpaid},
+		{"late and unconfirmed", []models.PaymentTransaction{output(10_000, 1, after)}, models.PaymentStatusExpired},
+		{"partial in time, late unconfirmed", []models.PaymentTransaction{output(5_000, 3, before), output(5_000, 0, after)}, models.PaymentStatusUnderpaid},
+		{"late and confirmed", []models.PaymentTransaction{output(10_000, 3, after)}, models.PaymentStatusPaidLate},
+		{"completed late", []models.PaymentTransaction{output(5_000, 3, before), output(5_000, 3, after)}, models.PaymentStatusPaidLate},
+		{"late but short", []models.PaymentTransaction{output(5_000, 3, after)}, models.PaymentStatusNeedsReview},
+		{"dropped output does not count", []models.PaymentTransaction{dropped}, models.PaymentStatusExpired},
+		{"seen exactly at expiry is in time", []models.PaymentTransaction{output(10_000, 3, expiresAt)}, models.PaymentStatusPaid},
+	}
+
+	w := newTestWatcher()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payment := &models.Payment{AmountSats: 10_000, ExpiresAt: &expiresAt}
+			got := w.lateStatusFor(payment, tt.outputs)
+			if got != tt.want {
+				t.Fatalf("lateStatusFor() = %s, want %s", got, tt.want)
+			}
+			// The watcher reaches this from payments the sweeper may or may not have closed yet
+			for _, from := range []models.PaymentStatus{models.PaymentStatusWaiting, models.PaymentStatusPartiallyPaid, models.PaymentStatusExpired, models.PaymentStatusUnderpaid} {
+				if from == got {
+					continue
+				}
+				if err := from.CheckTransition(got); err != nil {
+					t.Errorf("%s cannot move to %s: %v", from, got, err)
+				}
+			}
+		})
+	}
+}
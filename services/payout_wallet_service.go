@@ -4,55 +4,71 @@ import (
 	"errors"
 	"own-paynet/models"
 	"own-paynet/repository"
+	"own-paynet/services/bitcoin"
 
-	"github.com/btcsuite/btcd/btcec/v2"
-	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 )
 
 type PayoutWalletService struct {
-	repo *repository.PayoutWalletRepository
+	repo      *repository.PayoutWalletRepository
+	netParams *chaincfg.Params
 }
 
-func NewPayoutWalletService(repo *repository.PayoutWalletRepository) *PayoutWalletService {
-	return &PayoutWalletService{repo: repo}
+func NewPayoutWalletService(repo *repository.PayoutWalletRepository, netParams *chaincfg.Params) *PayoutWalletService {
+	return &PayoutWalletService{repo: repo, netParams: netParams}
 }
 
-func (s *PayoutWalletService) generateBTCAddress() (string, error) {
-	// Generate a new random private key
-	privKey, err := btcec.NewPrivateKey()
-	if err != nil {
-		return "", err
-	}
-
-	// Get the public key
-	pubKey := privKey.PubKey()
+// Payout wallet errors
+var (
+	ErrExtendedKeyNotBTC       = errors.New("extended public keys are only supported for BTC wallets")
+	ErrWalletAddressRequired   = errors.New("a wallet address or extended public key is required")
+	ErrDerivedAddressImmutable = errors.New("the address of a wallet with an extended public key cannot be changed")
+	ErrExtendedKeyImmutable    = errors.New("the extended public key of a wallet cannot be changed, create a new wallet instead")
+	ErrWalletHasBalance        = errors.New("the wallet still has a balance")
+)
 
-	// Create a P2PKH address
-	addr, err := btcutil.NewAddressPubKey(pubKey.SerializeCompressed(), &chaincfg.MainNetParams)
-	if err != nil {
-		return "", err
-	}
+// ValidateAddress checks a BTC address against the configured network
+func (s *PayoutWalletService) ValidateAddress(address string) error {
+	return bitcoin.ValidateAddress(address, s.netParams)
+}
 
-	return addr.EncodeAddress(), nil
+// ValidateExtendedPublicKey checks an account extended public key against the configured network
+func (s *PayoutWalletService) ValidateExtendedPublicKey(extendedPublicKey string) error {
+	_, err := bitcoin.ParseExtendedPublicKey(extendedPublicKey, s.netParams)
+	return err
 }
 
-// CreatePayoutWallet creates a new payout wallet for a user
-func (s *PayoutWalletService) CreatePayoutWallet(userID uint, currency, walletAddress string, isDefault bool) (*models.PayoutWallet, error) {
+// CreatePayoutWallet creates a new payout wallet for a user. A BTC wallet
+// can be given an account extended public key (xpub, ypub or zpub) instead
+// of an address; payments to the merchant then each get a fresh address
+// derived from it, and the wallet address is its first one. Payments start
+// at the second address, so none is paid to the wallet address.
+func (s *PayoutWalletService) CreatePayoutWallet(userID uint, currency, walletAddress, extendedPublicKey string, isDefault bool) (*models.PayoutWallet, error) {
 	// Validate inputs
 	if currency == "" {
 		return nil, errors.New("currency is required")
 	}
 
-	// If no wallet address provided and currency is BTC, generate one
-	if walletAddress == "" && currency == "BTC" {
-		var err error
-		walletAddress, err = s.generateBTCAddress()
+	var addressType string
+	if extendedPublicKey != "" {
+		if currency != "BTC" {
+			return nil, ErrExtendedKeyNotBTC
+		}
+		key, err := bitcoin.ParseExtendedPublicKey(extendedPublicKey, s.netParams)
 		if err != nil {
-			return nil, errors.New("failed to generate BTC address")
+			return nil, err
+		}
+		if walletAddress, err = key.Address(0); err != nil {
+			return nil, err
 		}
+		addressType = key.AddressType()
 	} else if walletAddress == "" {
-		return nil, errors.New("wallet address is required for non-BTC currencies")
+		// We never hold merchants' keys, so there is no address to make up
+		return nil, ErrWalletAddressRequired
+	} else if currency == "BTC" {
+		if err := s.ValidateAddress(walletAddress); err != nil {
+			return nil, err
+		}
 	}
 
 	// If this is going to be the default wallet, unset any existing default
@@ -70,6 +86,12 @@ func (s *PayoutWalletService) CreatePayoutWallet(userID uint, currency, walletAd
 		WalletAddress: walletAddress,
 		Balance:       0, // Initial balance is zero
 		IsDefault:     isDefault,
+
+		ExtendedPublicKey: extendedPublicKey,
+		AddressType:       addressType,
+	}
+	if extendedPublicKey != "" {
+		wallet.NextAddressIndex = models.FirstPaymentAddressIndex
 	}
 
 	err := s.repo.Create(wallet)
@@ -81,9 +103,10 @@ func (s *PayoutWalletService) CreatePayoutWallet(userID uint, currency, walletAd
 	return wallet, nil
 }
 
-// CreateDefaultBTCWallet creates a default BTC wallet for a new user
-func (s *PayoutWalletService) CreateDefaultBTCWallet(userID uint) (*models.PayoutWallet, error) {
-	return s.CreatePayoutWallet(userID, "BTC", "", true)
+// CreateDefaultBTCWallet creates the default BTC wallet of a new user from
+// an account extended public key the merchant holds the private keys of
+func (s *PayoutWalletService) CreateDefaultBTCWallet(userID uint, extendedPublicKey string) (*models.PayoutWallet, error) {
+	return s.CreatePayoutWallet(userID, "BTC", "", extendedPublicKey, true)
 }
 
 // GetPayoutWallet retrieves a payout wallet by ID
@@ -101,8 +124,10 @@ func (s *PayoutWalletService) GetDefaultWallet(userID uint, currency string) (*m
 	return s.repo.FindDefaultWallet(userID, currency)
 }
 
-// UpdatePayoutWallet updates a payout wallet's address
-func (s *PayoutWalletService) UpdatePayoutWallet(id uint, currency, walletAddress string, isDefault bool) (*models.PayoutWallet, error) {
+// UpdatePayoutWallet updates a payout wallet's address. The extended public
+// key of a wallet is fixed: its derivation index and the payments derived
+// from it only make sense for that key, so switching keys takes a new wallet.
+func (s *PayoutWalletService) UpdatePayoutWallet(id uint, currency, walletAddress, extendedPublicKey string, isDefault bool) (*models.PayoutWallet, error) {
 	wallet, err := s.repo.FindByID(id)
 	if err != nil {
 		return nil, err
@@ -117,11 +142,31 @@ func (s *PayoutWalletService) UpdatePayoutWallet(id uint, currency, walletAddres
 	}
 
 	// Update fields
+	if extendedPublicKey != "" && extendedPublicKey != wallet.ExtendedPublicKey {
+		return nil, ErrExtendedKeyImmutable
+	}
+	if wallet.ExtendedPublicKey != "" {
+		if walletAddress != "" && walletAddress != wallet.WalletAddress {
+			return nil, ErrDerivedAddressImmutable
+		}
+		if currency != "" && currency != "BTC" {
+			return nil, ErrExtendedKeyNotBTC
+		}
+	}
+	if currency != "" && currency != wallet.Currency {
+		// The ledger account keeps the currency its balance is in
+		if wallet.Balance != 0 {
+			return nil, ErrWalletHasBalance
+		}
+		wallet.Currency = currency
+	}
 	if walletAddress != "" {
 		wallet.WalletAddress = walletAddress
 	}
-	if currency != "" {
-		wallet.Currency = currency
+	if (walletAddress != "" || currency != "") && wallet.Currency == "BTC" {
+		if err := s.ValidateAddress(wallet.WalletAddress); err != nil {
+			return nil, err
+		}
 	}
 	wallet.IsDefault = isDefault
 
@@ -153,51 +198,11 @@ func (s *PayoutWalletService) DeletePayoutWallet(id uint) error {
 	if wallet.IsDefault {
 		return errors.New("cannot delete the default wallet")
 	}
-
-	return s.repo.Delete(id)
-}
-
-// UpdateBalance updates the balance of a payout wallet
-func (s *PayoutWalletService) UpdateBalance(id uint, newBalance float64) error {
-	if newBalance < 0 {
-		return errors.New("balance cannot be negative")
-	}
-
-	return s.repo.UpdateBalance(id, newBalance)
-}
-
-// AddFunds adds funds to a payout wallet
-func (s *PayoutWalletService) AddFunds(id uint, amount float64) error {
-	if amount <= 0 {
-		return errors.New("amount must be positive")
-	}
-
-	wallet, err := s.repo.FindByID(id)
-	if err != nil {
-		return err
+	if wallet.Balance != 0 {
+		return ErrWalletHasBalance
 	}
 
-	newBalance := wallet.Balance + amount
-	return s.repo.UpdateBalance(id, newBalance)
-}
-
-// WithdrawFunds withdraws funds from a payout wallet
-func (s *PayoutWalletService) WithdrawFunds(id uint, amount float64) error {
-	if amount <= 0 {
-		return errors.New("amount must be positive")
-	}
-
-	wallet, err := s.repo.FindByID(id)
-	if err != nil {
-		return err
-	}
-
-	if wallet.Balance < amount {
-		return errors.New("insufficient funds")
-	}
-
-	newBalance := wallet.Balance - amount
-	return s.repo.UpdateBalance(id, newBalance)
+	return s.repo.Delete(id)
 }
 
 // GetPayoutWalletByAddress retrieves a payout wallet by its address
@@ -0,0 +1,86 @@
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpProvider fetches rates from a CoinGecko compatible simple price API,
+// which answers GET <url>?ids=bitcoin&vs_currencies=usd with
+// {"bitcoin": {"usd": 65000}}. Rates are cached so checkout pages polling
+// for status do not hit the API on every request.
+type httpProvider struct {
+	url      string
+	cacheTTL time.Duration
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*Quote
+}
+
+func newHTTPProvider(url string, cacheTTL time.Duration) *httpProvider {
+	return &httpProvider{
+		url:      url,
+		cacheTTL: cacheTTL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		cache:    make(map[string]*Quote),
+	}
+}
+
+func (p *httpProvider) Name() string {
+	return ProviderHTTP
+}
+
+func (p *httpProvider) Quote(ctx context.Context, currency string) (*Quote, error) {
+	p.mu.Lock()
+	cached, ok := p.cache[currency]
+	p.mu.Unlock()
+	if ok && time.Since(cached.FetchedAt) < p.cacheTTL {
+		return cached, nil
+	}
+
+	quote, err := p.fetch(ctx, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.cache[currency] = quote
+	p.mu.Unlock()
+	return quote, nil
+}
+
+// fetch asks the API for the current rate
+func (p *httpProvider) fetch(ctx context.Context, currency string) (*Quote, error) {
+	query := url.Values{"ids": {"bitcoin"}, "vs_currencies": {strings.ToLower(currency)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch exchange rate: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from exchange rate API", resp.Status)
+	}
+
+	var prices map[string]map[string]float64
+	if err := json.NewDecoder(resp.Body).Decode(&prices); err != nil {
+		return nil, fmt.Errorf("failed to parse exchange rate: %w", err)
+	}
+	rate := prices["bitcoin"][strings.ToLower(currency)]
+	if rate <= 0 {
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedCurrency, currency)
+	}
+	return &Quote{Currency: currency, Rate: rate, Source: p.Name(), FetchedAt: time.Now()}, nil
+}
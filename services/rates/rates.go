@@ -0,0 +1,49 @@
+package rates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"own-paynet/config"
+	"time"
+)
+
+// Exchange rate provider types
+const (
+	ProviderStatic = "static"
+	ProviderHTTP   = "http"
+)
+
+// ErrUnsupportedCurrency is returned for currencies the provider has no rate for
+var ErrUnsupportedCurrency = errors.New("no exchange rate for currency")
+
+// Quote is the price of one bitcoin in a fiat currency
+type Quote struct {
+	Currency  string    // ISO 4217 code, e.g. USD
+	Rate      float64   // Units of Currency per bitcoin
+	Source    string    // Provider the rate came from
+	FetchedAt time.Time // When the provider published or returned the rate
+}
+
+// Provider looks up bitcoin exchange rates
+type Provider interface {
+	// Name identifies the provider in stored quotes
+	Name() string
+	// Quote returns the current price of one bitcoin in currency
+	Quote(ctx context.Context, currency string) (*Quote, error)
+}
+
+// NewProvider creates the exchange rate provider selected in the config
+func NewProvider(cfg *config.Config) (Provider, error) {
+	switch cfg.ExchangeRateProvider {
+	case ProviderStatic:
+		return newStaticProvider(cfg.ExchangeRatesFile)
+	case ProviderHTTP:
+		if cfg.ExchangeRateURL == "" {
+			return nil, errors.New("EXCHANGE_RATE_URL is required for the http provider")
+		}
+		return newHTTPProvider(cfg.ExchangeRateURL, time.Duration(cfg.ExchangeRateCacheSeconds)*time.Second), nil
+	default:
+		return nil, fmt.Errorf("unknown exchange rate provider %q", cfg.ExchangeRateProvider)
+	}
+}
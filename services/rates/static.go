@@ -0,0 +1,53 @@
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// staticProvider serves fixed rates read from a JSON file mapping currency
+// codes to the price of one bitcoin, e.g. {"USD": 65000, "EUR": 60000}. It
+// needs no network access, which makes it suited to testing and regtest.
+type staticProvider struct {
+	rates    map[string]float64
+	loadedAt time.Time
+}
+
+func newStaticProvider(path string) (*staticProvider, error) {
+	provider := &staticProvider{rates: make(map[string]float64), loadedAt: time.Now()}
+	if path == "" {
+		return provider, nil // Only BTC and SATS payments are possible
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read exchange rates file: %w", err)
+	}
+	var rates map[string]float64
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return nil, fmt.Errorf("failed to parse exchange rates file: %w", err)
+	}
+	for currency, rate := range rates {
+		if rate <= 0 {
+			return nil, fmt.Errorf("exchange rate for %s must be positive", currency)
+		}
+		provider.rates[strings.ToUpper(currency)] = rate
+	}
+	return provider, nil
+}
+
+func (p *staticProvider) Name() string {
+	return ProviderStatic
+}
+
+func (p *staticProvider) Quote(_ context.Context, currency string) (*Quote, error) {
+	rate, ok := p.rates[currency]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedCurrency, currency)
+	}
+	return &Quote{Currency: currency, Rate: rate, Source: p.Name(), FetchedAt: p.loadedAt}, nil
+}
@@ -0,0 +1,255 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"own-paynet/config"
+	"own-paynet/database"
+	"own-paynet/models"
+	"own-paynet/utils"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrInvalidMFAChallenge = errors.New("invalid or expired 2FA challenge")
+	ErrTooManyMFAAttempts  = errors.New("too many 2FA attempts")
+)
+
+// maxMFAAttempts is the number of codes that may be tried against one sign-in challenge
+const maxMFAAttempts = 5
+
+// SessionMetadata describes the device a session is created from
+type SessionMetadata struct {
+	DeviceName string
+	IPAddress  string
+	UserAgent  string
+}
+
+// TokenPair is the result of signing in or refreshing a session
+type TokenPair struct {
+	AccessToken  string    `json:"token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	SessionID    string    `json:"session_id"`
+}
+
+type SessionService struct {
+	accessTokenExpiry  time.Duration
+	refreshTokenExpiry time.Duration
+	mfaChallengeExpiry time.Duration
+}
+
+func NewSessionService(cfg *config.Config) *SessionService {
+	return &SessionService{
+		accessTokenExpiry:  time.Duration(cfg.AccessTokenExpiry) * time.Minute,
+		refreshTokenExpiry: time.Duration(cfg.RefreshTokenExpiry) * time.Hour,
+		mfaChallengeExpiry: time.Duration(cfg.MFAChallengeExpiry) * time.Minute,
+	}
+}
+
+// CreateSession starts a new session for the user and issues its first token pair
+func (s *SessionService) CreateSession(userID uint, meta SessionMetadata) (*TokenPair, error) {
+	now := time.Now()
+	session := &models.Session{
+		ID:         utils.GenerateRandomToken(16),
+		UserID:     userID,
+		DeviceName: meta.DeviceName,
+		IPAddress:  meta.IPAddress,
+		UserAgent:  meta.UserAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.refreshTokenExpiry),
+	}
+
+	refreshToken, refreshHash := newRefreshToken(session.ID)
+
+	ctx := context.Background()
+	if err := database.StoreSession(ctx, session, refreshHash, s.refreshTokenExpiry); err != nil {
+		return nil, fmt.Errorf("failed to store session: %w", err)
+	}
+
+	return s.issueTokens(userID, session.ID, refreshToken)
+}
+
+// Refresh rotates a refresh token and issues a new token pair. Presenting a
+// refresh token that has already been rotated out revokes the whole session,
+// since it means the token has been copied.
+func (s *SessionService) Refresh(refreshToken string, meta SessionMetadata) (*TokenPair, error) {
+	sessionID, _, ok := strings.Cut(refreshToken, ".")
+	if !ok || sessionID == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	ctx := context.Background()
+	session, err := database.GetSession(ctx, sessionID)
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	newToken, newHash := newRefreshToken(sessionID)
+	result, err := database.RotateRefreshToken(ctx, session.UserID, sessionID, hashRefreshToken(refreshToken), newHash, meta.IPAddress, s.refreshTokenExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	switch result {
+	case database.RefreshTokenRotated:
+		return s.issueTokens(session.UserID, sessionID, newToken)
+	case database.RefreshTokenReused:
+		log.Printf("refresh token reuse detected for session %s of user %d, revoking session", sessionID, session.UserID)
+		if err := database.DeleteSession(ctx, session.UserID, sessionID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	default:
+		return nil, ErrInvalidRefreshToken
+	}
+}
+
+// ListSessions returns the active sessions of a user, most recently used first
+func (s *SessionService) ListSessions(userID uint) ([]models.Session, error) {
+	ctx := context.Background()
+	sessions, err := database.ListUserSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+// Revoke ends a single session belonging to the user
+func (s *SessionService) Revoke(userID uint, sessionID string) error {
+	ctx := context.Background()
+	session, err := database.GetSession(ctx, sessionID)
+	if err != nil {
+		if err == redis.Nil {
+			return ErrSessionNotFound
+		}
+		return err
+	}
+	if session.UserID != userID {
+		return ErrSessionNotFound
+	}
+
+	return database.DeleteSession(ctx, userID, sessionID)
+}
+
+// RevokeOthers ends every session of the user except the current one
+func (s *SessionService) RevokeOthers(userID uint, currentSessionID string) (int, error) {
+	ctx := context.Background()
+	sessions, err := database.ListUserSessions(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, session := range sessions {
+		if session.ID == currentSessionID {
+			continue
+		}
+		if err := database.DeleteSession(ctx, userID, session.ID); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// RevokeAll ends every session of a user
+func (s *SessionService) RevokeAll(userID uint) error {
+	ctx := context.Background()
+	return database.DeleteUserSessions(ctx, userID)
+}
+
+// CreateMFAChallenge issues the token a user exchanges for a session once they pass 2FA
+func (s *SessionService) CreateMFAChallenge(userID uint) (string, error) {
+	challengeID := utils.GenerateRandomToken(16)
+
+	ctx := context.Background()
+	if err := database.StoreMFAChallenge(ctx, challengeID, userID, s.mfaChallengeExpiry); err != nil {
+		return "", fmt.Errorf("failed to store 2FA challenge: %w", err)
+	}
+
+	return utils.GenerateMFAChallengeToken(userID, challengeID, s.mfaChallengeExpiry)
+}
+
+// CheckMFAChallenge validates a challenge token and counts the attempt against it.
+// The challenge is discarded once too many codes have been tried.
+func (s *SessionService) CheckMFAChallenge(challengeToken string) (uint, string, error) {
+	userID, challengeID, err := utils.ValidateMFAChallengeToken(challengeToken)
+	if err != nil {
+		return 0, "", ErrInvalidMFAChallenge
+	}
+
+	ctx := context.Background()
+	attempts, err := database.IncrementMFAChallengeAttempts(ctx, challengeID, userID)
+	if err != nil {
+		if err == redis.Nil {
+			return 0, "", ErrInvalidMFAChallenge
+		}
+		return 0, "", err
+	}
+	if attempts > maxMFAAttempts {
+		_, _ = database.DeleteMFAChallenge(ctx, challengeID)
+		return 0, "", ErrTooManyMFAAttempts
+	}
+
+	return userID, challengeID, nil
+}
+
+// CompleteMFAChallenge consumes a challenge so it cannot be used twice. Only
+// the request that actually deletes it may go on to issue a session, so
+// concurrent requests with the same code get ErrInvalidMFAChallenge.
+func (s *SessionService) CompleteMFAChallenge(challengeID string) error {
+	ctx := context.Background()
+	deleted, err := database.DeleteMFAChallenge(ctx, challengeID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrInvalidMFAChallenge
+	}
+	return nil
+}
+
+func (s *SessionService) issueTokens(userID uint, sessionID, refreshToken string) (*TokenPair, error) {
+	accessToken, expiresAt, err := utils.GenerateAccessToken(userID, sessionID, s.accessTokenExpiry)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt,
+		SessionID:    sessionID,
+	}, nil
+}
+
+// newRefreshToken returns a refresh token for the session along with the hash stored in Redis
+func newRefreshToken(sessionID string) (string, string) {
+	token := sessionID + "." + utils.GenerateRandomToken(32)
+	return token, hashRefreshToken(token)
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
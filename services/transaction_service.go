@@ -2,6 +2,8 @@ package services
 
 import (
 	"errors"
+	"fmt"
+	"log"
 	"own-paynet/models"
 	"own-paynet/repository"
 	"own-paynet/services/bitcoin"
@@ -10,14 +12,18 @@ import (
 type TransactionService struct {
 	transactionRepo *repository.TransactionRepository
 	walletService   *PayoutWalletService
+	ledgerService   *LedgerService
 	bitcoinService  *bitcoin.BitcoinService
+	webhookService  *WebhookService
 }
 
-func NewTransactionService(transactionRepo *repository.TransactionRepository, walletService *PayoutWalletService, bitcoinService *bitcoin.BitcoinService) *TransactionService {
+func NewTransactionService(transactionRepo *repository.TransactionRepository, walletService *PayoutWalletService, ledgerService *LedgerService, bitcoinService *bitcoin.BitcoinService, webhookService *WebhookService) *TransactionService {
 	return &TransactionService{
 		transactionRepo: transactionRepo,
 		walletService:   walletService,
+		ledgerService:   ledgerService,
 		bitcoinService:  bitcoinService,
+		webhookService:  webhookService,
 	}
 }
 
@@ -48,10 +54,22 @@ func (s *TransactionService) CreateTransaction(walletID uint, transactionType mo
 	if receiverWalletFound == nil {
 		return nil, errors.New("receiver wallet not found")
 	}
+	if receiverWalletFound.Currency != senderWallet.Currency {
+		return nil, ErrWalletCurrencyMismatch
+	}
+
+	// The ledger works in whole minor units of the wallet currency
+	ledgerAmount, err := models.ToMinorUnits(amount, senderWallet.Currency)
+	if err != nil {
+		return nil, err
+	}
+	if ledgerAmount <= 0 {
+		return nil, errors.New("amount is smaller than the currency's smallest unit")
+	}
 
-	// Check sender's balance
-	if senderWallet.Balance < amount {
-		return nil, errors.New("insufficient funds")
+	// Check sender's balance. The ledger checks it again when the transfer is posted.
+	if senderWallet.Balance < ledgerAmount {
+		return nil, models.ErrInsufficientFunds
 	}
 
 	// Create transaction record with pending status
@@ -59,6 +77,7 @@ func (s *TransactionService) CreateTransaction(walletID uint, transactionType mo
 		PayoutWalletID: walletID,
 		Type:           models.TransactionTypeDebit,
 		Amount:         amount,
+		LedgerAmount:   ledgerAmount,
 		PriceCurrency:  priceCurrency,
 		PayCurrency:    payCurrency,
 		Comment:        comment,
@@ -85,7 +104,7 @@ func (s *TransactionService) CreateTransaction(walletID uint, transactionType mo
 		confirmations, err := s.bitcoinService.GetTransactionConfirmations(transaction.TransactionID)
 		if err != nil {
 			// Update transaction status to failed
-			_ = s.transactionRepo.UpdateStatus(transaction.ID, "failed")
+			s.finishTransaction(transaction, "failed")
 			_ = s.transactionRepo.MarkAsProcessed(transaction.ID)
 			return
 		}
@@ -98,27 +117,22 @@ func (s *TransactionService) CreateTransaction(walletID uint, transactionType mo
 				return
 			}
 
-			// Deduct amount from sender's wallet
-			err = s.walletService.WithdrawFunds(walletID, amount)
-			if err != nil {
-				_ = s.transactionRepo.UpdateStatus(transaction.ID, "failed")
-				return
-			}
-
-			// Add amount to receiver's wallet
-			err = s.walletService.AddFunds(receiverWalletFound.ID, amount)
+			// Move the amount in one balanced journal entry, so it is either
+			// taken from the sender and given to the receiver or not moved at all
+			reference := fmt.Sprintf("transaction:%d", transaction.ID)
+			description := fmt.Sprintf("Transaction %d to %s", transaction.ID, receiverWallet)
+			err = s.ledgerService.Transfer(reference, description, &transaction.ID, senderWallet, receiverWalletFound, ledgerAmount)
 			if err != nil {
-				// If adding to receiver fails, refund sender
-				_ = s.walletService.AddFunds(walletID, amount)
-				_ = s.transactionRepo.UpdateStatus(transaction.ID, "failed")
+				log.Printf("transaction %d: %v", transaction.ID, err)
+				s.finishTransaction(transaction, "failed")
 				return
 			}
 
 			// Update transaction status to completed
-			_ = s.transactionRepo.UpdateStatus(transaction.ID, "completed")
+			s.finishTransaction(transaction, "completed")
 		} else {
 			// Not enough confirmations, mark as failed and processed
-			_ = s.transactionRepo.UpdateStatus(transaction.ID, "failed")
+			s.finishTransaction(transaction, "failed")
 			_ = s.transactionRepo.MarkAsProcessed(transaction.ID)
 		}
 	}()
@@ -126,6 +140,40 @@ func (s *TransactionService) CreateTransaction(walletID uint, transactionType mo
 	return transaction, nil
 }
 
+// finishTransaction records the final status of a transaction and notifies the sender's webhooks
+func (s *TransactionService) finishTransaction(transaction *models.Transaction, status string) {
+	if err := s.transactionRepo.UpdateStatus(transaction.ID, status); err != nil {
+		log.Printf("failed to update transaction %d: %v", transaction.ID, err)
+		return
+	}
+
+	eventType := models.WebhookEventTransactionFailed
+	if status == "completed" {
+		eventType = models.WebhookEventTransactionCompleted
+	}
+	eventID := fmt.Sprintf("evt_transaction_%d_%s", transaction.ID, status)
+	data := map[string]interface{}{
+		"id":               transaction.ID,
+		"status":           status,
+		"type":             transaction.Type,
+		"amount":           transaction.Amount,
+		"ledger_amount":    transaction.LedgerAmount,
+		"price_currency":   transaction.PriceCurrency,
+		"pay_currency":     transaction.PayCurrency,
+		"payout_wallet_id": transaction.PayoutWalletID,
+		"receiver_wallet":  transaction.ReceiverWallet,
+		"transaction_id":   transaction.TransactionID,
+	}
+	if err := s.webhookService.Emit(transaction.SenderID, eventID, eventType, data); err != nil {
+		log.Printf("failed to queue webhooks for transaction %d: %v", transaction.ID, err)
+	}
+}
+
+// GetWalletLedger retrieves the latest journal entries posted to a wallet
+func (s *TransactionService) GetWalletLedger(wallet *models.PayoutWallet) ([]models.JournalEntry, error) {
+	return s.ledgerService.GetWalletEntries(wallet)
+}
+
 // GetTransaction retrieves a transaction by ID
 func (s *TransactionService) GetTransaction(id uint) (*models.Transaction, error) {
 	return s.transactionRepo.FindByID(id)
@@ -1,10 +1,13 @@
 package services
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base32"
 	"fmt"
 	"math/big"
+	"own-paynet/database"
 	"own-paynet/models"
 	"own-paynet/repository"
 	"strings"
@@ -298,19 +301,54 @@ func (s *TwoFactorService) Verify2FA(userID uint, code string) (bool, error) {
 		}
 	}
 	// Check authenticator
-	if user.Authenticator2FAEnabled && totp.Validate(code, user.TwoFactorSecret) {
-		return true, nil
+	if user.Authenticator2FAEnabled {
+		if step, ok := matchTOTP(code, user.TwoFactorSecret, time.Now()); ok {
+			// Each step's code is accepted once, so an intercepted or replayed code is useless
+			fresh, err := database.ReserveTOTPStep(context.Background(), user.ID, step, totpStepExpiry)
+			if err != nil {
+				return false, err
+			}
+			return fresh, nil
+		}
 	}
 	// Check email OTP
-	if user.Email2FAEnabled && user.OTPSecret == code {
+	if user.Email2FAEnabled && user.OTPSecret != "" && user.OTPSecret == code {
 		if user.LastOTPSentAt != nil && time.Since(*user.LastOTPSentAt) > 5*time.Minute {
 			return false, fmt.Errorf("OTP expired")
 		}
+		// Email OTPs are single use
+		user.OTPSecret = ""
+		if err := s.userRepo.Update(user); err != nil {
+			return false, err
+		}
 		return true, nil
 	}
 	return false, nil
 }
 
+// totpPeriod is the length of an authenticator time step, and totpStepExpiry
+// how long a used step is remembered, which covers the allowed clock skew
+const (
+	totpPeriod     = 30 * time.Second
+	totpStepExpiry = 3 * totpPeriod
+)
+
+// matchTOTP returns the time step whose authenticator code equals code,
+// allowing one step of clock skew either way
+func matchTOTP(code, secret string, now time.Time) (int64, bool) {
+	for _, skew := range []time.Duration{0, -totpPeriod, totpPeriod} {
+		at := now.Add(skew)
+		expected, err := totp.GenerateCode(secret, at)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return at.Unix() / int64(totpPeriod/time.Second), true
+		}
+	}
+	return 0, false
+}
+
 // SendOTP sends a new OTP to the user's email
 func (s *TwoFactorService) SendOTP(userID uint) error {
 	user, err := s.userRepo.FindByID(userID)
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// errWebhookAddressNotAllowed is returned when a webhook endpoint resolves to
+// an address on the server's own network
+var errWebhookAddressNotAllowed = errors.New("webhook endpoints must resolve to public addresses")
+
+// nonPublicPrefixes are ranges not covered by the netip.Addr predicates that
+// webhooks must not reach either
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "This network"
+	netip.MustParsePrefix("100.64.0.0/10"),   // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),   // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),     // Reserved, including broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, which can embed any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // Local-use NAT64
+	netip.MustParsePrefix("2002::/16"),       // 6to4, which can embed any IPv4 address
+	netip.MustParsePrefix("2001::/32"),       // Teredo
+	netip.MustParsePrefix("fec0::/10"),       // Deprecated site-local
+	netip.MustParsePrefix("100::/64"),        // Discard-only
+	netip.MustParsePrefix("2001:db8::/32"),   // Documentation
+	netip.MustParsePrefix("192.0.2.0/24"),    // Documentation
+	netip.MustParsePrefix("198.51.100.0/24"), // Documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // Documentation
+}
+
+// isPublicAddress reports whether webhooks may be sent to addr. Loopback,
+// private, link-local, multicast and reserved addresses are refused, so an
+// endpoint cannot be used to reach the server itself, cloud metadata services
+// or other hosts on the internal network.
+func isPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsUnspecified() || addr.IsLoopback() || addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookHost resolves host and fails unless every address it resolves
+// to is public. It catches bad URLs when an endpoint is saved; the dialer
+// checks again on every delivery, since DNS answers can change.
+func checkWebhookHost(ctx context.Context, host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !isPublicAddress(addr) {
+			return errWebhookAddressNotAllowed
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !isPublicAddress(addr) {
+			return errWebhookAddressNotAllowed
+		}
+	}
+	return nil
+}
+
+// webhookDialControl runs after DNS resolution, just before each connection
+// is made, so it sees the address actually dialled and a host that resolves
+// to a public address when the endpoint is saved cannot later be rebound to
+// an internal one
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddress(addrPort.Addr()) {
+		return errWebhookAddressNotAllowed
+	}
+	return nil
+}
+
+// newWebhookClient returns the HTTP client webhooks are sent with. It only
+// connects to public addresses, ignores proxy settings from the environment,
+// which would hide the real destination from the dialer, and does not
+// follow redirects.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: webhookDialControl,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		// A redirect could point the signed payload somewhere the merchant did not register
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,318 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"own-paynet/models"
+	"own-paynet/repository"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Limits on webhook endpoints
+const (
+	maxWebhookEndpoints   = 20
+	maxWebhookDeliveryLog = 100
+	webhookResolveTimeout = 5 * time.Second // Time allowed to resolve an endpoint's host when it is saved
+)
+
+// Webhook errors
+var (
+	ErrWebhookEndpointNotFound = errors.New("webhook endpoint not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrInvalidWebhookURL       = errors.New("invalid webhook URL")
+	ErrInvalidWebhookEvent     = errors.New("invalid webhook event")
+	ErrTooManyWebhookEndpoints = fmt.Errorf("a user can have at most %d webhook endpoints", maxWebhookEndpoints)
+)
+
+// WebhookEvent is the body posted to webhook endpoints
+type WebhookEvent struct {
+	ID        string      `json:"id"` // The same for every endpoint and redelivery, so receivers can deduplicate
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookEndpointUpdate holds the fields to change on an endpoint, nil fields are left as they are
+type WebhookEndpointUpdate struct {
+	URL         *string
+	Description *string
+	Events      []string // Nil leaves the subscriptions unchanged, empty subscribes to everything
+	IsActive    *bool
+}
+
+type WebhookService struct {
+	endpointRepo *repository.WebhookEndpointRepository
+	deliveryRepo *repository.WebhookDeliveryRepository
+}
+
+func NewWebhookService(endpointRepo *repository.WebhookEndpointRepository, deliveryRepo *repository.WebhookDeliveryRepository) *WebhookService {
+	return &WebhookService{
+		endpointRepo: endpointRepo,
+		deliveryRepo: deliveryRepo,
+	}
+}
+
+// CreateEndpoint registers a URL to receive events. The returned endpoint
+// carries its signing secret, which is not shown again.
+func (s *WebhookService) CreateEndpoint(userID uint, rawURL, description string, events []string) (*models.WebhookEndpoint, error) {
+	if err := validateWebhookURL(rawURL); err != nil {
+		return nil, err
+	}
+	events, err := normalizeWebhookEvents(events)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := s.endpointRepo.FindByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= maxWebhookEndpoints {
+		return nil, ErrTooManyWebhookEndpoints
+	}
+
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := &models.WebhookEndpoint{
+		UserID:      userID,
+		URL:         rawURL,
+		Description: description,
+		Secret:      secret,
+		Events:      strings.Join(events, ","),
+		IsActive:    true,
+	}
+	if err := s.endpointRepo.Create(endpoint); err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+// ListEndpoints returns the user's webhook endpoints without their secrets
+func (s *WebhookService) ListEndpoints(userID uint) ([]models.WebhookEndpoint, error) {
+	endpoints, err := s.endpointRepo.FindByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range endpoints {
+		endpoints[i].Secret = ""
+	}
+	return endpoints, nil
+}
+
+// GetEndpoint returns one of the user's webhook endpoints without its secret
+func (s *WebhookService) GetEndpoint(userID, endpointID uint) (*models.WebhookEndpoint, error) {
+	endpoint, err := s.getOwnedEndpoint(userID, endpointID)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.Secret = ""
+	return endpoint, nil
+}
+
+// UpdateEndpoint changes the URL, description, subscriptions or active state of an endpoint
+func (s *WebhookService) UpdateEndpoint(userID, endpointID uint, update WebhookEndpointUpdate) (*models.WebhookEndpoint, error) {
+	endpoint, err := s.getOwnedEndpoint(userID, endpointID)
+	if err != nil {
+		return nil, err
+	}
+
+	if update.URL != nil {
+		if err := validateWebhookURL(*update.URL); err != nil {
+			return nil, err
+		}
+		endpoint.URL = *update.URL
+	}
+	if update.Description != nil {
+		endpoint.Description = *update.Description
+	}
+	if update.Events != nil {
+		events, err := normalizeWebhookEvents(update.Events)
+		if err != nil {
+			return nil, err
+		}
+		endpoint.Events = strings.Join(events, ",")
+	}
+	if update.IsActive != nil {
+		endpoint.IsActive = *update.IsActive
+	}
+
+	if err := s.endpointRepo.Update(endpoint); err != nil {
+		return nil, err
+	}
+	endpoint.Secret = ""
+	return endpoint, nil
+}
+
+// DeleteEndpoint removes an endpoint. Deliveries still queued for it are dropped when they come up.
+func (s *WebhookService) DeleteEndpoint(userID, endpointID uint) error {
+	if _, err := s.getOwnedEndpoint(userID, endpointID); err != nil {
+		return err
+	}
+	return s.endpointRepo.Delete(endpointID)
+}
+
+// ListDeliveries returns the most recent deliveries to one of the user's endpoints
+func (s *WebhookService) ListDeliveries(userID, endpointID uint) ([]models.WebhookDelivery, error) {
+	if _, err := s.getOwnedEndpoint(userID, endpointID); err != nil {
+		return nil, err
+	}
+	return s.deliveryRepo.FindByEndpointID(endpointID, maxWebhookDeliveryLog)
+}
+
+// GetDelivery returns a delivery along with the log of attempts to send it
+func (s *WebhookService) GetDelivery(userID, deliveryID uint) (*models.WebhookDelivery, []models.WebhookAttempt, error) {
+	delivery, err := s.getOwnedDelivery(userID, deliveryID)
+	if err != nil {
+		return nil, nil, err
+	}
+	attempts, err := s.deliveryRepo.FindAttempts(deliveryID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return delivery, attempts, nil
+}
+
+// Redeliver sends a delivery again right away, whether it succeeded or
+// failed before. If the attempt fails the usual retries follow.
+func (s *WebhookService) Redeliver(userID, deliveryID uint) error {
+	if _, err := s.getOwnedDelivery(userID, deliveryID); err != nil {
+		return err
+	}
+	return s.deliveryRepo.Requeue(deliveryID, time.Now())
+}
+
+// Emit queues an event for every active endpoint of the user subscribed to
+// its type. Emitting the same event ID again does not queue it twice, so
+// callers can safely retry.
+func (s *WebhookService) Emit(userID uint, eventID, eventType string, data interface{}) error {
+	endpoints, err := s.endpointRepo.FindActiveByUserID(userID)
+	if err != nil {
+		return fmt.Errorf("failed to load webhook endpoints: %w", err)
+	}
+
+	var subscribed []models.WebhookEndpoint
+	for _, endpoint := range endpoints {
+		if endpoint.Subscribes(eventType) {
+			subscribed = append(subscribed, endpoint)
+		}
+	}
+	if len(subscribed) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(WebhookEvent{
+		ID:        eventID,
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook event: %w", err)
+	}
+
+	now := time.Now()
+	deliveries := make([]models.WebhookDelivery, 0, len(subscribed))
+	for _, endpoint := range subscribed {
+		deliveries = append(deliveries, models.WebhookDelivery{
+			EndpointID:    endpoint.ID,
+			EventID:       eventID,
+			EventType:     eventType,
+			Payload:       string(payload),
+			Status:        models.WebhookDeliveryPending,
+			NextAttemptAt: &now,
+		})
+	}
+	if err := s.deliveryRepo.CreateIfMissing(deliveries); err != nil {
+		return fmt.Errorf("failed to queue webhook deliveries: %w", err)
+	}
+	return nil
+}
+
+// getOwnedEndpoint loads an endpoint, treating endpoints of other users as missing
+func (s *WebhookService) getOwnedEndpoint(userID, endpointID uint) (*models.WebhookEndpoint, error) {
+	endpoint, err := s.endpointRepo.FindByID(endpointID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrWebhookEndpointNotFound
+		}
+		return nil, err
+	}
+	if endpoint.UserID != userID {
+		return nil, ErrWebhookEndpointNotFound
+	}
+	return endpoint, nil
+}
+
+// getOwnedDelivery loads a delivery, treating deliveries to other users' endpoints as missing
+func (s *WebhookService) getOwnedDelivery(userID, deliveryID uint) (*models.WebhookDelivery, error) {
+	delivery, err := s.deliveryRepo.FindByID(deliveryID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrWebhookDeliveryNotFound
+		}
+		return nil, err
+	}
+	if _, err := s.getOwnedEndpoint(userID, delivery.EndpointID); err != nil {
+		return nil, ErrWebhookDeliveryNotFound
+	}
+	return delivery, nil
+}
+
+// validateWebhookURL checks that rawURL is an http or https URL whose host
+// resolves only to public addresses
+func validateWebhookURL(rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return fmt.Errorf("%w: must be an absolute http or https URL", ErrInvalidWebhookURL)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookResolveTimeout)
+	defer cancel()
+	if err := checkWebhookHost(ctx, parsed.Hostname()); err != nil {
+		if errors.Is(err, errWebhookAddressNotAllowed) {
+			return fmt.Errorf("%w: %v", ErrInvalidWebhookURL, err)
+		}
+		return fmt.Errorf("%w: host %s could not be resolved", ErrInvalidWebhookURL, parsed.Hostname())
+	}
+	return nil
+}
+
+// normalizeWebhookEvents validates requested event types, removing duplicates
+func normalizeWebhookEvents(events []string) ([]string, error) {
+	if len(events) == 0 {
+		return models.AllWebhookEvents, nil
+	}
+
+	for _, requested := range events {
+		if !containsString(models.AllWebhookEvents, requested) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidWebhookEvent, requested)
+		}
+	}
+
+	var normalized []string
+	for _, event := range models.AllWebhookEvents {
+		if containsString(events, event) {
+			normalized = append(normalized, event)
+		}
+	}
+	return normalized, nil
+}
+
+func generateWebhookSecret() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(bytes), nil
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"own-paynet/config"
+	"own-paynet/models"
+	"own-paynet/repository"
+	"own-paynet/utils/webhook"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Webhook worker settings
+const (
+	webhookInterval        = 5 * time.Second  // How often the queue is checked
+	webhookBatchSize       = 20               // Deliveries sent per check
+	webhookEventBatchSize  = 100              // Payment events turned into deliveries per check
+	webhookFirstRetryDelay = 30 * time.Second // Doubles after every failed attempt
+	webhookMaxRetryDelay   = 6 * time.Hour
+	webhookMaxResponseBody = 4096 // Bytes of the endpoint's response read so the connection can be reused
+)
+
+// WebhookWorker turns payment status changes into webhook events and sends
+// queued deliveries, retrying failures with exponential backoff. The queue
+// lives in the database, so deliveries survive restarts.
+type WebhookWorker struct {
+	webhookService *WebhookService
+	endpointRepo   *repository.WebhookEndpointRepository
+	deliveryRepo   *repository.WebhookDeliveryRepository
+	eventRepo      *repository.PaymentEventRepository
+	paymentRepo    *repository.PaymentRepository
+	client         *http.Client
+	maxAttempts    int
+}
+
+func NewWebhookWorker(webhookService *WebhookService, endpointRepo *repository.WebhookEndpointRepository, deliveryRepo *repository.WebhookDeliveryRepository, eventRepo *repository.PaymentEventRepository, paymentRepo *repository.PaymentRepository, cfg *config.Config) *WebhookWorker {
+	return &WebhookWorker{
+		webhookService: webhookService,
+		endpointRepo:   endpointRepo,
+		deliveryRepo:   deliveryRepo,
+		eventRepo:      eventRepo,
+		paymentRepo:    paymentRepo,
+		client:         newWebhookClient(time.Duration(cfg.WebhookTimeout) * time.Second),
+		maxAttempts:    cfg.WebhookMaxAttempts,
+	}
+}
+
+// Run sends webhooks until the context is cancelled
+func (w *WebhookWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(webhookInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.queuePaymentEvents(); err != nil {
+			log.Printf("webhook worker: %v", err)
+		}
+		if err := w.deliverDue(ctx); err != nil {
+			log.Printf("webhook worker: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// queuePaymentEvents emits a webhook event for every payment status change
+// not handled yet. payment_events acts as an outbox: an event is only marked
+// dispatched after its deliveries are queued, and event IDs are derived from
+// the payment event so a crash in between cannot queue it twice.
+func (w *WebhookWorker) queuePaymentEvents() error {
+	events, err := w.eventRepo.FindUndispatched(webhookEventBatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to load payment events: %w", err)
+	}
+
+	payments := make(map[string]*models.Payment)
+	dispatched := make([]uint, 0, len(events))
+	for _, event := range events {
+		payment, ok := payments[event.PaymentID]
+		if !ok {
+			payment, err = w.paymentRepo.FindByID(event.PaymentID)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				payment = nil // Deleted, there is no one to notify
+			} else if err != nil {
+				return fmt.Errorf("failed to load payment %s: %w", event.PaymentID, err)
+			}
+			payments[event.PaymentID] = payment
+		}
+
+		eventType, known := models.WebhookEventForPaymentStatus[event.ToStatus]
+		if event.ToStatus == models.PaymentStatusWaiting && event.FromStatus != "" {
+			eventType = models.WebhookEventPaymentReverted
+		}
+		if payment != nil && known {
+			eventID := "evt_payment_" + strconv.FormatUint(uint64(event.ID), 10)
+			if err := w.webhookService.Emit(payment.UserID, eventID, eventType, paymentEventData(payment, &event)); err != nil {
+				return err
+			}
+		}
+		dispatched = append(dispatched, event.ID)
+	}
+
+	if err := w.eventRepo.MarkDispatched(dispatched, time.Now()); err != nil {
+		return fmt.Errorf("failed to mark payment events dispatched: %w", err)
+	}
+	return nil
+}
+
+// paymentEventData is the data of a payment webhook event, as of the status change
+func paymentEventData(payment *models.Payment, event *models.PaymentEvent) map[string]interface{} {
+	return map[string]interface{}{
+		"payment_id":      payment.PaymentID,
+		"status":          event.ToStatus,
+		"previous_status": event.FromStatus,
+		"amount":          payment.Amount,
+		"currency":        payment.Currency,
+		"amount_sats":     payment.AmountSats,
+		"received_sats":   event.ReceivedSats,
+		"confirmations":   event.Confirmations,
+		"transaction_id":  event.TransactionID,
+		"bitcoin_address": payment.BitcoinAddress,
+		"expires_at":      payment.ExpiresAt,
+	}
+}
+
+// deliverDue sends the deliveries whose next attempt is due
+func (w *WebhookWorker) deliverDue(ctx context.Context) error {
+	// Hold claimed deliveries long enough for every send in the batch to time out
+	lease := time.Duration(webhookBatchSize+1) * w.client.Timeout
+	deliveries, err := w.deliveryRepo.ClaimDue(time.Now(), lease, webhookBatchSize)
+	if err != nil {
+		return fmt.Errorf("failed to load due deliveries: %w", err)
+	}
+
+	for i := range deliveries {
+		if ctx.Err() != nil {
+			return nil // The lease runs out and the delivery is retried after the restart
+		}
+		if err := w.deliver(ctx, &deliveries[i]); err != nil {
+			log.Printf("webhook worker: delivery %d: %v", deliveries[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// deliver makes one attempt at a delivery and schedules the next one if it fails
+func (w *WebhookWorker) deliver(ctx context.Context, delivery *models.WebhookDelivery) error {
+	attempt := &models.WebhookAttempt{DeliveryID: delivery.ID}
+	started := time.Now()
+
+	endpoint, err := w.endpointRepo.FindByID(delivery.EndpointID)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return w.giveUp(delivery, attempt, started, "endpoint was deleted")
+	case err != nil:
+		return fmt.Errorf("failed to load endpoint: %w", err)
+	case !endpoint.IsActive:
+		return w.giveUp(delivery, attempt, started, "endpoint is disabled")
+	}
+
+	err = w.send(ctx, endpoint, delivery, attempt)
+	attempt.DurationMs = time.Since(started).Milliseconds()
+	delivery.Attempts++
+	delivery.LastAttemptAt = &started
+
+	switch {
+	case err == nil:
+		delivery.Status = models.WebhookDeliverySucceeded
+		delivery.NextAttemptAt = nil
+	case delivery.Attempts >= w.maxAttempts:
+		attempt.Error = err.Error()
+		delivery.Status = models.WebhookDeliveryFailed
+		delivery.NextAttemptAt = nil
+	default:
+		attempt.Error = err.Error()
+		next := time.Now().Add(webhookRetryDelay(delivery.Attempts))
+		delivery.Status = models.WebhookDeliveryPending
+		delivery.NextAttemptAt = &next
+	}
+	return w.deliveryRepo.RecordAttempt(delivery, attempt)
+}
+
+// giveUp marks a delivery failed without sending it
+func (w *WebhookWorker) giveUp(delivery *models.WebhookDelivery, attempt *models.WebhookAttempt, started time.Time, reason string) error {
+	attempt.Error = reason
+	delivery.Status = models.WebhookDeliveryFailed
+	delivery.NextAttemptAt = nil
+	delivery.LastAttemptAt = &started
+	return w.deliveryRepo.RecordAttempt(delivery, attempt)
+}
+
+// send posts a delivery's payload to its endpoint, recording the response
+// status in attempt. Anything but a 2xx response is an error.
+func (w *WebhookWorker) send(ctx context.Context, endpoint *models.WebhookEndpoint, delivery *models.WebhookDelivery, attempt *models.WebhookAttempt) error {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "own-paynet-webhooks/1.0")
+	req.Header.Set("X-Paynet-Event", delivery.EventType)
+	req.Header.Set("X-Paynet-Event-ID", delivery.EventID)
+	req.Header.Set("X-Paynet-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign(endpoint.Secret, time.Now(), payload))
+
+	resp, err := w.client.Do(req)
+	if errors.Is(err, errWebhookAddressNotAllowed) {
+		// Leave out the resolved address, which may be an internal one
+		return errWebhookAddressNotAllowed
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The body is discarded rather than logged, so it can never echo back
+	// what the endpoint returned to merchants
+	io.Copy(io.Discard, io.LimitReader(resp.Body, webhookMaxResponseBody))
+	attempt.ResponseStatus = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookRetryDelay is the wait after the given number of failed attempts.
+// It doubles each time up to webhookMaxRetryDelay, with up to 10% jitter so
+// deliveries that failed together do not all retry at once.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookMaxRetryDelay
+	if attempts < 20 {
+		if d := webhookFirstRetryDelay << (attempts - 1); d < delay {
+			delay = d
+		}
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay/10)+1))
+}
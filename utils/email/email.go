@@ -7,6 +7,7 @@ import (
 	"net/smtp"
 	"own-paynet/config"
 	"path/filepath"
+	"time"
 )
 
 type EmailService struct {
@@ -120,3 +121,20 @@ func (s *EmailService) SendWelcomeEmail(email string) error {
 		},
 	})
 }
+
+// SendAPIKeyExpiryEmail warns the owner of an API key that it is about to expire
+func (s *EmailService) SendAPIKeyExpiryEmail(email, description, publicKey string, expiresAt time.Time) error {
+	return s.SendEmail(EmailData{
+		To:       email,
+		Subject:  "Your API Key Is About to Expire",
+		Template: "api_key_expiry.html",
+		Data: map[string]interface{}{
+			"Email":       email,
+			"Description": description,
+			"PublicKey":   publicKey,
+			"ExpiresAt":   expiresAt.UTC().Format("January 2, 2006 15:04 MST"),
+			"AppName":     "Manty Pay",
+			"KeysURL":     fmt.Sprintf("%s/api-keys", s.Config.BaseURL),
+		},
+	})
+}
@@ -4,74 +4,110 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
-	"own-paynet/config"
 	"own-paynet/database"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
-	"github.com/redis/go-redis/v9"
+	"github.com/golang-jwt/jwt/v5"
 )
 
-// GenerateJWT creates a new JWT token for the given user ID
-func GenerateJWT(userID uint) (string, error) {
-	cfg := config.LoadConfig()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+// Token types carried in the "typ" claim
+const (
+	TokenTypeAccess     = "access"
+	TokenTypeMFAPending = "mfa_pending"
+)
+
+// AccessClaims holds the identity carried by a validated access token
+type AccessClaims struct {
+	UserID    uint
+	SessionID string
+}
+
+// GenerateAccessToken creates a short-lived access token bound to a session
+func GenerateAccessToken(userID uint, sessionID string, expiry time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(expiry)
+	tokenString, err := signToken(jwt.MapClaims{
+		"sub":     fmt.Sprintf("%d", userID),
 		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * time.Duration(cfg.TokenExpiry)).Unix(),
+		"sid":     sessionID,
+		"typ":     TokenTypeAccess,
+		"iat":     now.Unix(),
+		"exp":     expiresAt.Unix(),
 	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
 
-	tokenString, err := token.SignedString([]byte(cfg.JWTSecret))
+	return tokenString, expiresAt, nil
+}
+
+// ValidateJWT validates an access token and checks that its session is still alive
+func ValidateJWT(tokenString string) (*AccessClaims, error) {
+	claims, err := parseToken(tokenString)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	if typ, _ := claims["typ"].(string); typ != TokenTypeAccess {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	userIDClaim, ok := claims["user_id"].(float64)
+	if !ok {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	sessionID, _ := claims["sid"].(string)
+	if sessionID == "" {
+		return nil, jwt.ErrSignatureInvalid
 	}
+	userID := uint(userIDClaim)
 
-	// Store token in Redis
+	// Validate the session against Redis so revoked sessions stop working immediately
 	ctx := context.Background()
-	err = database.StoreToken(ctx, userID, tokenString, time.Hour*time.Duration(cfg.TokenExpiry))
+	valid, err := database.TouchSession(ctx, userID, sessionID)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if !valid {
+		return nil, jwt.ErrSignatureInvalid // Session revoked or expired
 	}
 
-	return tokenString, nil
+	return &AccessClaims{UserID: userID, SessionID: sessionID}, nil
 }
 
-func ValidateJWT(tokenString string) (uint, error) {
-	cfg := config.LoadConfig()
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(cfg.JWTSecret), nil
+// GenerateMFAChallengeToken creates the short-lived token handed out after a
+// correct password when the account still has to pass two-factor authentication
+func GenerateMFAChallengeToken(userID uint, challengeID string, expiry time.Duration) (string, error) {
+	now := time.Now()
+	return signToken(jwt.MapClaims{
+		"sub":     fmt.Sprintf("%d", userID),
+		"user_id": userID,
+		"jti":     challengeID,
+		"typ":     TokenTypeMFAPending,
+		"iat":     now.Unix(),
+		"exp":     now.Add(expiry).Unix(),
 	})
+}
 
+// ValidateMFAChallengeToken validates a challenge token and returns the user and challenge it belongs to
+func ValidateMFAChallengeToken(tokenString string) (uint, string, error) {
+	claims, err := parseToken(tokenString)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		userID := uint(claims["user_id"].(float64))
-
-		// Validate token against Redis
-		ctx := context.Background()
-		valid, err := database.ValidateToken(ctx, userID, tokenString)
-		if err != nil {
-			if err == redis.Nil {
-				return 0, jwt.ErrSignatureInvalid // Token not found in Redis
-			}
-			return 0, err
-		}
-
-		if !valid {
-			return 0, jwt.ErrSignatureInvalid // Token doesn't match stored token
-		}
-
-		return userID, nil
+	if typ, _ := claims["typ"].(string); typ != TokenTypeMFAPending {
+		return 0, "", jwt.ErrSignatureInvalid
+	}
+	userID, ok := claims["user_id"].(float64)
+	if !ok {
+		return 0, "", jwt.ErrSignatureInvalid
+	}
+	challengeID, _ := claims["jti"].(string)
+	if challengeID == "" {
+		return 0, "", jwt.ErrSignatureInvalid
 	}
 
-	return 0, jwt.ErrSignatureInvalid
-}
-
-// InvalidateToken removes a token from Redis
-func InvalidateToken(userID uint) error {
-	ctx := context.Background()
-	return database.DeleteToken(ctx, userID)
+	return uint(userID), challengeID, nil
 }
 
 // GenerateRandomToken generates a random string of specified length
@@ -0,0 +1,316 @@
+package utils
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"os/signal"
+	"own-paynet/config"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtKey is a key that can verify, and if its private half is known, sign tokens
+type jwtKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	PrivateKey interface{}
+	PublicKey  interface{}
+}
+
+// jwtKeyRing holds the key used to sign new tokens and every key still accepted for verification
+type jwtKeyRing struct {
+	signing *jwtKey
+	keys    map[string]*jwtKey
+	issuer  string
+}
+
+// JSONWebKey is a public key in JWK format (RFC 7517)
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// JSONWebKeySet is the document served at /.well-known/jwks.json
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// activeKeyIDFile names the file in JWT_KEYS_DIR that, if present, holds the
+// ID of the signing key and overrides JWT_ACTIVE_KID, so the signing key can
+// be switched without a restart
+const activeKeyIDFile = "active_kid"
+
+var (
+	keyRingMu sync.RWMutex
+	keyRing   *jwtKeyRing
+)
+
+// LoadSigningKeys loads the JWT key ring so configuration errors surface at startup
+func LoadSigningKeys() error {
+	return ReloadSigningKeys()
+}
+
+// ReloadSigningKeys reads the key ring again and swaps it in. Only the JWT
+// settings and key directory are read, and on error the keys loaded before
+// stay in use.
+func ReloadSigningKeys() error {
+	ring, err := loadKeyRing(config.LoadJWTKeyConfig())
+	if err != nil {
+		return err
+	}
+
+	keyRingMu.Lock()
+	keyRing = ring
+	keyRingMu.Unlock()
+	return nil
+}
+
+// WatchSigningKeys reloads the key ring on SIGHUP and every interval until
+// the context is cancelled, so keys can be added, switched and retired on
+// every instance without a restart
+func WatchSigningKeys(ctx context.Context, interval time.Duration) {
+	if config.LoadJWTKeyConfig().KeysDir == "" {
+		return // Nothing can change without a restart
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		case <-ticker.C:
+		}
+
+		if err := ReloadSigningKeys(); err != nil {
+			log.Printf("failed to reload JWT signing keys, keeping the current ones: %v", err)
+		}
+	}
+}
+
+func getKeyRing() (*jwtKeyRing, error) {
+	keyRingMu.RLock()
+	defer keyRingMu.RUnlock()
+
+	if keyRing == nil {
+		return nil, errors.New("JWT signing keys are not loaded")
+	}
+	return keyRing, nil
+}
+
+// loadKeyRing reads every <kid>.pem file in JWT_KEYS_DIR. Private keys can
+// sign and verify; public keys only verify, which lets a retired key keep
+// validating tokens issued before a rotation. The signing key is named by the
+// active_kid file in the directory, or else JWT_ACTIVE_KID. Without a key
+// directory tokens fall back to HS256 with JWT_SECRET.
+func loadKeyRing(cfg config.JWTKeyConfig) (*jwtKeyRing, error) {
+	ring := &jwtKeyRing{keys: make(map[string]*jwtKey), issuer: cfg.Issuer}
+
+	if cfg.KeysDir == "" {
+		if cfg.Secret == "" {
+			return nil, errors.New("either JWT_KEYS_DIR or JWT_SECRET must be set")
+		}
+		log.Println("JWT_KEYS_DIR is not set, signing tokens with HS256 and JWT_SECRET")
+		ring.signing = &jwtKey{
+			Method:     jwt.SigningMethodHS256,
+			PrivateKey: []byte(cfg.Secret),
+			PublicKey:  []byte(cfg.Secret),
+		}
+		return ring, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(cfg.KeysDir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		key, err := loadJWTKey(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWT key %s: %w", file, err)
+		}
+		ring.keys[key.ID] = key
+	}
+
+	activeKeyID := cfg.ActiveKeyID
+	data, err := os.ReadFile(filepath.Join(cfg.KeysDir, activeKeyIDFile))
+	if err == nil {
+		activeKeyID = strings.TrimSpace(string(data))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	active, ok := ring.keys[activeKeyID]
+	if !ok {
+		return nil, fmt.Errorf("active JWT key %q not found in %s", activeKeyID, cfg.KeysDir)
+	}
+	if active.PrivateKey == nil {
+		return nil, fmt.Errorf("active JWT key %q has no private key", activeKeyID)
+	}
+	ring.signing = active
+
+	return ring, nil
+}
+
+func loadJWTKey(file string) (*jwtKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	key := &jwtKey{ID: strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key.PrivateKey = privateKey
+		key.PublicKey = privateKey.(crypto.Signer).Public()
+	case "RSA PRIVATE KEY":
+		privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key.PrivateKey = privateKey
+		key.PublicKey = &privateKey.PublicKey
+	case "PUBLIC KEY":
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key.PublicKey = publicKey
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+
+	switch key.PublicKey.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, errors.New("only RSA and Ed25519 keys are supported")
+	}
+
+	return key, nil
+}
+
+// signToken signs the claims with the active key, stamping the issuer and key ID
+func signToken(claims jwt.MapClaims) (string, error) {
+	ring, err := getKeyRing()
+	if err != nil {
+		return "", err
+	}
+
+	claims["iss"] = ring.issuer
+	token := jwt.NewWithClaims(ring.signing.Method, claims)
+	if ring.signing.ID != "" {
+		token.Header["kid"] = ring.signing.ID
+	}
+
+	return token.SignedString(ring.signing.PrivateKey)
+}
+
+// parseToken verifies a token against the key named by its kid header
+func parseToken(tokenString string) (jwt.MapClaims, error) {
+	ring, err := getKeyRing()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		key := ring.signing
+		if len(ring.keys) > 0 {
+			kid, _ := token.Header["kid"].(string)
+			var ok bool
+			if key, ok = ring.keys[kid]; !ok {
+				return nil, fmt.Errorf("unknown key ID %q", kid)
+			}
+		}
+		// Only accept the algorithm the key was issued for
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.PublicKey, nil
+	}, jwt.WithIssuer(ring.issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, jwt.ErrSignatureInvalid
+	}
+
+	return claims, nil
+}
+
+// JWKS returns the public verification keys in JWK Set format
+func JWKS() (*JSONWebKeySet, error) {
+	ring, err := getKeyRing()
+	if err != nil {
+		return nil, err
+	}
+
+	kids := make([]string, 0, len(ring.keys))
+	for kid := range ring.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	set := &JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, kid := range kids {
+		key := ring.keys[kid]
+		jwk := JSONWebKey{KeyID: key.ID, Use: "sig", Algorithm: key.Method.Alg()}
+
+		switch publicKey := key.PublicKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set, nil
+}
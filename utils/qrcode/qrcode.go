@@ -0,0 +1,85 @@
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+)
+
+// quietZone is the blank border around the code in modules, as the QR spec requires
+const quietZone = 4
+
+func encode(content string) (barcode.Barcode, error) {
+	code, err := qr.Encode(content, qr.M, qr.Auto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %w", err)
+	}
+	return code, nil
+}
+
+// PNG renders content as a QR code PNG of at most size pixels square,
+// including the quiet zone. Modules are whole pixels so the code stays
+// sharp, which can leave the image slightly smaller than size.
+func PNG(content string, size int) ([]byte, error) {
+	code, err := encode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	modules := code.Bounds().Dx()
+	scale := size / (modules + 2*quietZone)
+	if scale < 1 {
+		scale = 1
+	}
+	width := (modules + 2*quietZone) * scale
+
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := 0; y < modules; y++ {
+		for x := 0; x < modules; x++ {
+			if r, _, _, _ := code.At(x, y).RGBA(); r != 0 {
+				continue
+			}
+			module := image.Rect(x+quietZone, y+quietZone, x+quietZone+1, y+quietZone+1)
+			draw.Draw(img, image.Rect(module.Min.X*scale, module.Min.Y*scale, module.Max.X*scale, module.Max.Y*scale),
+				image.Black, image.Point{}, draw.Src)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to render QR code: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG renders content as a square QR code SVG of size pixels. Each dark
+// module is a unit square in the view box, so the image scales without blur.
+func SVG(content string, size int) ([]byte, error) {
+	code, err := encode(content)
+	if err != nil {
+		return nil, err
+	}
+
+	modules := code.Bounds().Dx()
+	viewBox := modules + 2*quietZone
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, viewBox, viewBox)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, viewBox, viewBox)
+	for y := 0; y < modules; y++ {
+		for x := 0; x < modules; x++ {
+			if r, _, _, _ := code.At(x, y).RGBA(); r == 0 {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+quietZone, y+quietZone)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,79 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the signature of a webhook payload
+const SignatureHeader = "X-Paynet-Signature"
+
+// Sign returns the signature header value for a payload sent at timestamp,
+// in the form t=<unix seconds>,v1=<hex HMAC-SHA256>. The HMAC covers
+// "<unix seconds>.<payload>", so the timestamp cannot be swapped without
+// breaking the signature.
+func Sign(secret string, timestamp time.Time, payload []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + computeSignature(secret, t, payload)
+}
+
+func computeSignature(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Signature verification errors
+var (
+	ErrMalformedSignature = errors.New("malformed webhook signature")
+	ErrSignatureExpired   = errors.New("webhook timestamp outside the tolerance window")
+	ErrSignatureMismatch  = errors.New("webhook signature mismatch")
+)
+
+// Verify checks a signature header produced by Sign. The timestamp must be
+// within tolerance of now in either direction, and one of the v1 signatures
+// must match; senders rotating their secret can include one per secret.
+// Signatures are compared in constant time.
+func Verify(secret, header string, payload []byte, tolerance time.Duration, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return ErrMalformedSignature
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return ErrMalformedSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrMalformedSignature
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrSignatureExpired
+	}
+
+	expected := []byte(computeSignature(secret, timestamp, payload))
+	for _, signature := range signatures {
+		if hmac.Equal(expected, []byte(signature)) {
+			return nil
+		}
+	}
+	return ErrSignatureMismatch
+}
@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	header := Sign("whsec_test", time.Unix(1700000000, 0), []byte(`{"id":"evt_1"}`))
+	if !regexp.MustCompile(`^t=1700000000,v1=[0-9a-f]{64}$`).MatchString(header) {
+		t.Fatalf("unexpected header format %q", header)
+	}
+	if again := Sign("whsec_test", time.Unix(1700000000, 0), []byte(`{"id":"evt_1"}`)); again != header {
+		t.Fatalf("Sign is not deterministic: %q != %q", again, header)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	const secret = "whsec_test"
+	now := time.Unix(1700000000, 0)
+	payload := []byte(`{"id":"evt_1","type":"payment.confirmed"}`)
+	valid := Sign(secret, now, payload)
+	validSignature := valid[len("t=1700000000,"):]
+	rotated := Sign("whsec_old", now, payload)[len("t=1700000000,"):]
+
+	tests := []struct {
+		name    string
+		secret  string
+		header  string
+		payload []byte
+		now     time.Time
+		want    error
+	}{
+		{"valid", secret, valid, payload, now, nil},
+		{"valid with spaces", secret, "t=1700000000, " + validSignature, payload, now, nil},
+		{"one of several signatures matches", secret, "t=1700000000," + rotated + "," + validSignature, payload, now, nil},
+		{"within tolerance in the past", secret, valid, payload, now.Add(5 * time.Minute), nil},
+		{"within tolerance in the future", secret, valid, payload, now.Add(-5 * time.Minute), nil},
+		{"too old", secret, valid, payload, now.Add(5*time.Minute + time.Second), ErrSignatureExpired},
+		{"too far in the future", secret, valid, payload, now.Add(-5*time.Minute - time.Second), ErrSignatureExpired},
+		{"wrong secret", "whsec_other", valid, payload, now, ErrSignatureMismatch},
+		{"tampered payload", secret, valid, []byte(`{"id":"evt_2","type":"payment.confirmed"}`), now, ErrSignatureMismatch},
+		{"swapped timestamp", secret, "t=1700000001," + validSignature, payload, now, ErrSignatureMismatch},
+		{"empty header", secret, "", payload, now, ErrMalformedSignature},
+		{"missing timestamp", secret, validSignature, payload, now, ErrMalformedSignature},
+		{"missing signature", secret, "t=1700000000", payload, now, ErrMalformedSignature},
+		{"part without value", secret, "t=1700000000,v1", payload, now, ErrMalformedSignature},
+		{"non-numeric timestamp", secret, "t=yesterday," + validSignature, payload, now, ErrMalformedSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.header, tt.payload, 5*time.Minute, tt.now)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}